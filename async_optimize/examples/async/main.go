@@ -55,6 +55,7 @@ func main() {
 
 	//control := controller.Simple{}
 	//control := &controller.Avoid{NumGuess: 100}
+	//control := &controller.Genetic{PopSize: 10, Selection: controller.Roulette{}}
 	control := &controller.AsyncAvoid{}
 
 	objer := Varied{
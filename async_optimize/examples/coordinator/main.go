@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/functions"
+	"github.com/btracey/goexamples/async_optimize/optimize"
+	"github.com/btracey/goexamples/async_optimize/optimize/controller"
+)
+
+// Instead of dialing servers at fixed ports like the tcp example, the optimizer
+// listens and the evaluation servers connect to it. Start this program, then
+// start as many servers as you like with
+//		server -connect localhost:2000
+// The run starts as soon as the first one connects.
+
+func main() {
+	rand.Seed(time.Now().UnixNano())
+
+	objer := functions.Varied{
+		Fixed:  time.Second,
+		Varied: 3500 * time.Millisecond,
+	}
+
+	optimizer := &optimize.Async{
+		MaxFunEvals:  25,
+		NumDim:       2,
+		Listen:       ":2000",
+		PrintReturns: true,
+
+		Controller: &controller.AsyncAvoid{},
+	}
+
+	ans, err := optimizer.Optimize(objer)
+	if err != nil {
+		fmt.Println("Error optimizing ", err)
+	}
+	fmt.Println("Optimization finished\nBest location is", ans.Loc, "\nBest value is ", ans.Obj)
+}
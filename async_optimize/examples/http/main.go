@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/functions"
+	"github.com/btracey/goexamples/async_optimize/optimize"
+	"github.com/btracey/goexamples/async_optimize/optimize/controller"
+)
+
+// The other remote examples use gob, so both ends must be Go programs. Here
+// the objective function is served over HTTP with JSON instead (see the wire
+// package for the format), so the server could be written in any language.
+// To keep the example self contained, the server runs in this program using
+// functions.HTTPHandler.
+
+func main() {
+	rand.Seed(time.Now().UnixNano())
+
+	objer := functions.Varied{
+		Fixed:  100 * time.Millisecond,
+		Varied: 400 * time.Millisecond,
+	}
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go http.Serve(l, functions.HTTPHandler{Objer: objer})
+	url := "http://" + l.Addr().String() + "/"
+
+	// One worker making four requests at once
+	optimizer := &optimize.Async{
+		MaxFunEvals:  25,
+		NumDim:       2,
+		PrintReturns: true,
+		Workers: []optimize.Worker{
+			&optimize.HTTPWorker{Id: 0, URL: url, Concurrency: 4, Output: true},
+		},
+
+		Controller: &controller.AsyncAvoid{},
+	}
+
+	// The server decides what is evaluated, so the objective function given
+	// here is not used
+	ans, err := optimizer.Optimize(objer)
+	if err != nil {
+		fmt.Println("Error optimizing ", err)
+	}
+	fmt.Println("Optimization finished\nBest location is", ans.Loc, "\nBest value is ", ans.Obj)
+}
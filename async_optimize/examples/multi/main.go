@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/optimize"
+	"github.com/btracey/goexamples/async_optimize/optimize/controller"
+)
+
+// Schaffer is a classic two-objective test problem. The first objective wants
+// every element to be zero, the second wants every element to be two, so the
+// Pareto front is the set of points in between.
+type Schaffer struct{}
+
+func (s Schaffer) Obj(x []float64) float64 {
+	return s.Objs(x)[0]
+}
+
+func (Schaffer) Objs(x []float64) []float64 {
+	var f1, f2 float64
+	for _, v := range x {
+		f1 += v * v
+		f2 += (v - 2) * (v - 2)
+	}
+	return []float64{f1, f2}
+}
+
+func main() {
+	nCpu := runtime.NumCPU()
+	runtime.GOMAXPROCS(nCpu)
+	rand.Seed(time.Now().UnixNano())
+
+	workers := make([]optimize.Worker, nCpu)
+	for i := range workers {
+		workers[i] = &optimize.LocalWorker{Id: i}
+	}
+
+	optimizer := &optimize.Async{
+		MaxFunEvals: 2000,
+		NumDim:      2,
+		Workers:     workers,
+
+		Controller: &controller.NSGA2{},
+	}
+
+	_, err := optimizer.Optimize(Schaffer{})
+	if err != nil {
+		fmt.Println("Error optimizing ", err)
+		return
+	}
+	pareto := optimizer.Pareto()
+	fmt.Println("Optimization finished\nNumber of non-dominated points is", pareto.Len())
+	fmt.Println("Hypervolume is", pareto.Hypervolume([]float64{10, 10}))
+	pareto.WriteCSV(os.Stdout)
+}
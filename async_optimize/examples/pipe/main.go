@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/functions"
+	"github.com/btracey/goexamples/async_optimize/optimize"
+	"github.com/btracey/goexamples/async_optimize/optimize/controller"
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// The remote workers and the server normally talk over TCP. With the Pipe
+// transport they can run in the same program instead, connected in memory.
+// Everything else, the handshake, heartbeats and request IDs, is exactly the
+// same as over the network, so this is a handy way to try out the remote code
+// without starting any servers.
+
+func main() {
+	rand.Seed(time.Now().UnixNano())
+
+	pipe := &wire.Pipe{}
+	receiver := &functions.RemoteReceiver{Port: "server", Transport: pipe, MaxConcurrent: 4}
+	// Listen before serving in the background, so the workers can connect
+	// as soon as they start
+	if err := receiver.Listen(); err != nil {
+		fmt.Println("Error listening ", err)
+		return
+	}
+	go receiver.Serve()
+
+	objer := functions.Varied{
+		Fixed:  100 * time.Millisecond,
+		Varied: 400 * time.Millisecond,
+	}
+
+	workers := make([]optimize.Worker, 2)
+	for i := range workers {
+		workers[i] = &optimize.RemoteHost{
+			RemoteWorker: optimize.RemoteWorker{Id: i, Port: "server", Transport: pipe, Output: true},
+			Capacity:     2,
+		}
+	}
+
+	optimizer := &optimize.Async{
+		MaxFunEvals:  25,
+		NumDim:       2,
+		Workers:      workers,
+		PrintReturns: true,
+
+		Controller: &controller.AsyncAvoid{},
+	}
+
+	ans, err := optimizer.Optimize(objer)
+	if err != nil {
+		fmt.Println("Error optimizing ", err)
+	}
+	fmt.Println("Optimization finished\nBest location is", ans.Loc, "\nBest value is ", ans.Obj)
+}
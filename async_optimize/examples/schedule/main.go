@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/functions"
+	"github.com/btracey/goexamples/async_optimize/optimize"
+	"github.com/btracey/goexamples/async_optimize/optimize/controller"
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// Not every machine is as fast as every other. Each server describes itself
+// when a worker connects, and Async measures how long each worker takes, so a
+// Scheduler can decide which worker gets each point. Here there are two
+// servers, a big one which runs four evaluations at once and a small one
+// which only runs one. Both are sent four points at a time, so the points
+// sent to the small one spend most of their time waiting, and it looks slow.
+
+func main() {
+	rand.Seed(time.Now().UnixNano())
+
+	pipe := &wire.Pipe{}
+	big := &functions.RemoteReceiver{Port: "big", Transport: pipe, MaxConcurrent: 4, Tags: []string{"big"}}
+	small := &functions.RemoteReceiver{Port: "small", Transport: pipe, MaxConcurrent: 1, Tags: []string{"small"}}
+	// Listen before serving in the background, so the workers can connect
+	// as soon as they start
+	for _, r := range []*functions.RemoteReceiver{big, small} {
+		if err := r.Listen(); err != nil {
+			fmt.Println("Error listening ", err)
+			return
+		}
+		go r.Serve()
+	}
+
+	objer := functions.Varied{
+		Fixed:  20 * time.Millisecond,
+		Varied: 20 * time.Millisecond,
+	}
+
+	workers := []optimize.Worker{
+		&optimize.RemoteHost{RemoteWorker: optimize.RemoteWorker{Id: 0, Port: "big", Transport: pipe}, Capacity: 4},
+		&optimize.RemoteHost{RemoteWorker: optimize.RemoteWorker{Id: 1, Port: "small", Transport: pipe}, Capacity: 4},
+	}
+
+	optimizer := &optimize.Async{
+		MaxFunEvals: 200,
+		NumDim:      2,
+		Workers:     workers,
+
+		Controller: &controller.AsyncAvoid{},
+
+		// Pretend that points far from the origin are expensive, and keep
+		// them off a worker that takes more than twice as long as the
+		// fastest one. Everything else goes to the fastest free worker.
+		Scheduler: optimize.CostAware{
+			Cost: func(x []float64) float64 {
+				return x[0]*x[0] + x[1]*x[1]
+			},
+			Threshold: 4,
+		},
+	}
+
+	ans, err := optimizer.Optimize(objer)
+	if err != nil {
+		fmt.Println("Error optimizing ", err)
+	}
+	fmt.Println("Optimization finished\nBest location is", ans.Loc, "\nBest value is ", ans.Obj)
+	for _, w := range optimizer.WorkerStats() {
+		fmt.Printf("%v: %d cores, %d evaluations, %v each, %.1f per second\n",
+			w.Capabilities.Tags, w.Capabilities.Cores, w.Evaluations, w.EvalTime, w.Throughput())
+	}
+}
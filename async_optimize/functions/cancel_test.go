@@ -0,0 +1,187 @@
+package functions
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+func init() {
+	gob.Register(blocker{})
+}
+
+// blocker runs until its context is done at points with a negative first
+// element, reporting when it starts and why it stopped. The server gets a
+// copy of the objective function, so the channels are package variables.
+type blocker struct{}
+
+var (
+	blockerStarted = make(chan error, 10)
+	blockerStopped = make(chan error, 10)
+)
+
+func (blocker) Obj(x []float64) float64 {
+	panic("blocker needs a context")
+}
+
+func (blocker) ObjCtx(ctx context.Context, x []float64) (float64, error) {
+	if x[0] >= 0 {
+		return x[0], nil
+	}
+	blockerStarted <- nil
+	<-ctx.Done()
+	blockerStopped <- ctx.Err()
+	return 0, ctx.Err()
+}
+
+// await waits for an error from c, failing the test after a few seconds
+func await(t *testing.T, what string, c <-chan error) error {
+	select {
+	case err := <-c:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+	return nil
+}
+
+type ctxKey struct{}
+
+// constrained has ObjCtx as well as ObjCons, and checks that it is given the
+// context in ObjConsCtx
+type constrained struct{}
+
+func (constrained) Obj(x []float64) float64 { return x[0] }
+func (constrained) ObjCtx(ctx context.Context, x []float64) (float64, error) {
+	return x[0], nil
+}
+func (constrained) ObjCons(x []float64) (float64, []float64) {
+	return x[0], []float64{x[1]}
+}
+
+type constrainedCtx struct{ constrained }
+
+func (constrainedCtx) ObjConsCtx(ctx context.Context, x []float64) (float64, []float64, error) {
+	if ctx.Value(ctxKey{}) == nil {
+		return 0, nil, errors.New("not given the context")
+	}
+	return x[0], []float64{x[1]}, nil
+}
+
+// multi has ObjCtx as well as Objs
+type multi struct{}
+
+func (multi) Obj(x []float64) float64 { return x[0] }
+func (multi) ObjCtx(ctx context.Context, x []float64) (float64, error) {
+	return x[0], nil
+}
+func (multi) Objs(x []float64) []float64 { return x }
+
+func TestEvaluateContext(t *testing.T) {
+	ctx := context.WithValue(context.Background(), ctxKey{}, true)
+	x := []float64{1, 2}
+	for _, obj := range []Objer{constrained{}, constrainedCtx{}} {
+		m := evaluate(ctx, obj, 1, x)
+		if m.Kind != wire.Result || m.Obj != 1 || len(m.Cons) != 1 || m.Cons[0] != 2 {
+			t.Errorf("%T: reply %+v, want the constraints", obj, m)
+		}
+	}
+	m := evaluate(ctx, multi{}, 1, x)
+	if m.Kind != wire.Result || m.Obj != 1 || len(m.Objs) != 2 {
+		t.Errorf("reply %+v, want the objectives", m)
+	}
+	m = evaluate(ctx, multi{}, 1, nil)
+	if m.Kind != wire.Error || m.Err != ErrNoObjectives.Error() {
+		t.Errorf("reply %+v with no objectives", m)
+	}
+
+	// A request canceled before it starts is not evaluated
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	m = evaluate(canceled, panicky{}, 1, []float64{-1})
+	if m.Kind != wire.Error || m.Err != context.Canceled.Error() {
+		t.Errorf("reply %+v to a canceled request", m)
+	}
+}
+
+func TestReceiverCancel(t *testing.T) {
+	r := &RemoteReceiver{}
+	pipe := serve(t, r)
+	conn := dial(t, pipe, blocker{})
+	defer conn.Close()
+	if err := conn.Send(wire.Message{Kind: wire.Evaluate, ID: 1, X: []float64{-1}}); err != nil {
+		t.Fatal(err)
+	}
+	await(t, "the evaluation to start", blockerStarted)
+	if err := conn.Send(wire.Message{Kind: wire.Cancel, ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := await(t, "the evaluation to stop", blockerStopped); err != context.Canceled {
+		t.Errorf("evaluation stopped with %v, want context.Canceled", err)
+	}
+
+	// No answer is sent for the canceled request
+	if err := conn.Send(wire.Message{Kind: wire.Evaluate, ID: 2, X: []float64{2}}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := conn.ReceiveMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 2 || m.Kind != wire.Result || m.Obj != 2 {
+		t.Errorf("reply %+v, want the result of request 2", m)
+	}
+}
+
+func TestReceiverShutdown(t *testing.T) {
+	r := &RemoteReceiver{}
+	pipe := serve(t, r)
+	conn := dial(t, pipe, slow{})
+	defer conn.Close()
+	if err := conn.Send(wire.Message{Kind: wire.Evaluate, ID: 1, X: []float64{3}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the evaluation to start", func() bool { return r.Stats().Running == 1 })
+	errc := make(chan error, 1)
+	go func() { errc <- r.Shutdown(context.Background()) }()
+
+	// The running evaluation is finished and sent, then the client is told
+	m, err := conn.ReceiveMessage()
+	if err != nil || m.Kind != wire.Result || m.ID != 1 || m.Obj != 3 {
+		t.Errorf("reply %+v, %v, want the result", m, err)
+	}
+	m, err = conn.ReceiveMessage()
+	if err != nil || m.Kind != wire.Shutdown {
+		t.Errorf("reply %+v, %v, want shutdown", m, err)
+	}
+	if err := await(t, "Shutdown to return", errc); err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+}
+
+func TestReceiverShutdownTimeout(t *testing.T) {
+	r := &RemoteReceiver{}
+	pipe := serve(t, r)
+	conn := dial(t, pipe, blocker{})
+	defer conn.Close()
+	if err := conn.Send(wire.Message{Kind: wire.Evaluate, ID: 1, X: []float64{-1}}); err != nil {
+		t.Fatal(err)
+	}
+	await(t, "the evaluation to start", blockerStarted)
+
+	// The evaluation never finishes by itself, so it is canceled when the
+	// context given to Shutdown expires
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v, want DeadlineExceeded", err)
+	}
+	if err := await(t, "the evaluation to stop", blockerStopped); err != context.Canceled {
+		t.Errorf("evaluation stopped with %v, want context.Canceled", err)
+	}
+	waitFor(t, "the client to be disconnected", func() bool { return r.Stats().Connections == 0 })
+}
@@ -0,0 +1,237 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// Command is an objective function which runs an external program for every
+// evaluation, for optimizing the inputs of command-line simulators.
+//
+// The location can be given to the program in any combination of four ways.
+// Args and Env are templates (see text/template) executed with a CommandData,
+// so for example
+//
+//	Args: []string{"--alpha={{index .X 0}}", "--beta={{index .X 1}}"}
+//	Env:  []string{"POINT={{.Join \",\"}}"}
+//
+// If Stdin is true, the program's standard input is the JSON request described
+// in the wire package ({"id": 0, "x": [...]}). If InputFile is set, Input is
+// executed as a template and written to that file in the working directory.
+//
+// The objective is read from OutputFile in the working directory if it is set,
+// and from standard output otherwise. If the output starts with '{' it is
+// parsed as the JSON response described in the wire package, otherwise the
+// last non-empty line must be a number.
+//
+// Every evaluation runs in a new temporary directory inside Dir (the system
+// temporary directory if Dir is empty), so concurrent evaluations do not see
+// each other's files. The directory is removed afterwards unless Keep is set.
+// An evaluation that takes longer than Timeout, or whose context is canceled
+// (see ObjCtx), is killed.
+//
+// Only the program itself is killed, not programs it started in the
+// background. Those can keep its output open long after it has gone, so once
+// the program has exited or been killed, its output is only waited for for
+// outputWait.
+type Command struct {
+	Path string   // Program to run
+	Args []string // Argument templates
+	Env  []string // Templates for extra "KEY=value" environment variables
+
+	Stdin     bool   // Send the point as JSON on standard input
+	InputFile string // Name of the input file to write
+	Input     string // Template for the input file contents
+
+	OutputFile string // Name of the file the program writes its result to
+
+	Dir     string        // Where to create the working directories
+	Keep    bool          // Keep the working directories
+	Timeout time.Duration // Maximum time for an evaluation (default none)
+}
+
+// outputWait is how long to wait for a command's output to be closed after
+// it exits
+const outputWait = time.Second
+
+// CommandData is the data given to the templates of a Command
+type CommandData struct {
+	X   []float64 // Location to evaluate
+	Dir string    // Working directory of the evaluation
+}
+
+// Join returns the elements of X separated by sep
+func (d CommandData) Join(sep string) string {
+	s := make([]string, len(d.X))
+	for i, v := range d.X {
+		s[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strings.Join(s, sep)
+}
+
+// Obj runs the command at x. If the command fails, the objective is +Inf.
+// Use ObjErr to find out why.
+func (c Command) Obj(x []float64) float64 {
+	obj, err := c.ObjErr(x)
+	if err != nil {
+		return math.Inf(1)
+	}
+	return obj
+}
+
+// ObjErr runs the command at x and returns the objective, or the reason the
+// command failed
+func (c Command) ObjErr(x []float64) (float64, error) {
+	return c.ObjCtx(context.Background(), x)
+}
+
+// ObjCtx is like ObjErr, but the command is killed if the context is done
+// first. LocalWorker and RemoteReceiver call ObjCtx instead of Obj, so that
+// the command can be canceled and the error ends up in Ans.Err.
+func (c Command) ObjCtx(ctx context.Context, x []float64) (float64, error) {
+	dir, err := ioutil.TempDir(c.Dir, "eval")
+	if err != nil {
+		return math.Inf(1), err
+	}
+	if !c.Keep {
+		defer os.RemoveAll(dir)
+	}
+	data := CommandData{X: x, Dir: dir}
+
+	args, err := expand(c.Args, data)
+	if err != nil {
+		return math.Inf(1), err
+	}
+	env, err := expand(c.Env, data)
+	if err != nil {
+		return math.Inf(1), err
+	}
+	if c.InputFile != "" {
+		input, err := execute(c.Input, data)
+		if err != nil {
+			return math.Inf(1), err
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, c.InputFile), []byte(input), 0644)
+		if err != nil {
+			return math.Inf(1), err
+		}
+	}
+
+	parent := ctx
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, c.Path, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.WaitDelay = outputWait
+	if c.Stdin {
+		b, err := json.Marshal(wire.EvalRequest{X: wire.ToFloats(x)})
+		if err != nil {
+			return math.Inf(1), err
+		}
+		cmd.Stdin = bytes.NewReader(b)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// The program succeeded, but left something running in the
+		// background which kept its output open. Use what it wrote.
+		err = nil
+	}
+	if parent.Err() != nil {
+		return math.Inf(1), fmt.Errorf("command: %v", parent.Err())
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return math.Inf(1), fmt.Errorf("command: timed out after %v", c.Timeout)
+	}
+	if err != nil {
+		return math.Inf(1), fmt.Errorf("command: %v: %s", err, lastLine(stderr.Bytes()))
+	}
+
+	out := stdout.Bytes()
+	if c.OutputFile != "" {
+		out, err = ioutil.ReadFile(filepath.Join(dir, c.OutputFile))
+		if err != nil {
+			return math.Inf(1), err
+		}
+	}
+	return ParseOutput(out)
+}
+
+// ParseOutput reads an objective value written by an external program. If the
+// output starts with '{' it is parsed as a wire.EvalResponse, otherwise the
+// last non-empty line must be a number.
+func ParseOutput(out []byte) (float64, error) {
+	out = bytes.TrimSpace(out)
+	if len(out) > 0 && out[0] == '{' {
+		var r wire.EvalResponse
+		err := wire.UnmarshalResponse(out, &r)
+		if err != nil {
+			return math.Inf(1), fmt.Errorf("command: bad output: %v", err)
+		}
+		if r.Error != "" {
+			return math.Inf(1), errors.New(r.Error)
+		}
+		switch {
+		case r.Obj != nil:
+			return float64(*r.Obj), nil
+		case len(r.Objs) > 0:
+			return float64(r.Objs[0]), nil
+		}
+		return math.Inf(1), errors.New("command: output has no objective value")
+	}
+	line := lastLine(out)
+	obj, err := strconv.ParseFloat(line, 64)
+	if err != nil {
+		return math.Inf(1), fmt.Errorf("command: output %q is not a number", line)
+	}
+	return obj, nil
+}
+
+// lastLine returns the last non-empty line of the output
+func lastLine(b []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// expand executes each of the templates
+func expand(templates []string, data CommandData) ([]string, error) {
+	s := make([]string, len(templates))
+	for i, t := range templates {
+		var err error
+		s[i], err = execute(t, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func execute(text string, data CommandData) (string, error) {
+	t, err := template.New("command").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	err = t.Execute(&b, data)
+	return b.String(), err
+}
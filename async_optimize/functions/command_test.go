@@ -0,0 +1,79 @@
+package functions
+
+import (
+	"context"
+	"math"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shell returns a Command running the script with sh, skipping the test if
+// there is no shell
+func shell(t *testing.T, script string) Command {
+	path, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell")
+	}
+	return Command{Path: path, Args: []string{"-c", script}}
+}
+
+func TestCommand(t *testing.T) {
+	c := shell(t, `echo "x is {{.Join " "}}" >&2; echo $(( {{index .X 0}} + {{index .X 1}} ))`)
+	obj, err := c.ObjErr([]float64{2, 3})
+	if err != nil || obj != 5 {
+		t.Errorf("objective %v, %v, want 5", obj, err)
+	}
+
+	// The JSON request on standard input, and a JSON response
+	c = shell(t, `read req; case "$req" in *'"x":[1,"NaN"]'*) echo '{"obj": "Infinity"}';; *) echo 0;; esac`)
+	c.Stdin = true
+	if obj, err := c.ObjErr([]float64{1, math.NaN()}); err != nil || !math.IsInf(obj, 1) {
+		t.Errorf("objective %v, %v, want +Inf", obj, err)
+	}
+
+	// Failures
+	c = shell(t, `echo "solver diverged" >&2; exit 3`)
+	if _, err := c.ObjErr([]float64{1}); err == nil || !strings.Contains(err.Error(), "solver diverged") {
+		t.Errorf("error %v, want the last line of standard error", err)
+	}
+	c = shell(t, `echo '{"error": "bad point"}'`)
+	if _, err := c.ObjErr([]float64{1}); err == nil || err.Error() != "bad point" {
+		t.Errorf("error %v, want the error in the response", err)
+	}
+}
+
+func TestCommandBackground(t *testing.T) {
+	// The program exits, but leaves something holding its output
+	start := time.Now()
+	c := shell(t, `sleep 10 & echo 4`)
+	obj, err := c.ObjErr(nil)
+	if err != nil || obj != 4 {
+		t.Errorf("objective %v, %v, want 4", obj, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("evaluation took %v", d)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	// The program is killed, but what it started holds its output
+	start := time.Now()
+	c := shell(t, `sleep 10 & sleep 10`)
+	c.Timeout = 50 * time.Millisecond
+	_, err := c.ObjErr(nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("error %v, want a timeout", err)
+	}
+	// Canceled the same way
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.Timeout = 0
+	if _, err := c.ObjCtx(ctx, nil); err == nil {
+		t.Error("no error after the context was canceled")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("evaluations took %v", d)
+	}
+}
@@ -0,0 +1,83 @@
+package functions
+
+import (
+	"context"
+	"errors"
+)
+
+// ObjContexter is an objective function which can stop early when the context
+// is canceled, for example because the client no longer wants the answer. It
+// returns an error if it could not finish. A constrained or multi-objective
+// function is called with ObjConsCtx or ObjsCtx instead, if it has them:
+//
+//	ObjConsCtx(ctx context.Context, x []float64) (float64, []float64, error)
+//	ObjsCtx(ctx context.Context, x []float64) ([]float64, error)
+type ObjContexter interface {
+	ObjCtx(ctx context.Context, x []float64) (float64, error)
+}
+
+// Result is the value of an objective function at a point. Cons holds the
+// values of a constrained function's constraints, and Objs the values of a
+// multi-objective function, whose first one is also Obj.
+type Result struct {
+	Obj  float64
+	Cons []float64
+	Objs []float64
+}
+
+// ErrNoObjectives is the error for a multi-objective function which returned
+// no values
+var ErrNoObjectives = errors.New("functions: objective function returned no objectives")
+
+// Evaluate calls the objective function at x, using the richest interface the
+// function implements. Constrained and multi-objective functions come before
+// ObjContexter, since ObjCtx has no room for their extra values; they get the
+// context if they have a method which takes one. A function with ObjErr is
+// called with it instead of Obj. A point is not started if the context is
+// already done.
+func Evaluate(ctx context.Context, obj Objer, x []float64) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	var r Result
+	var err error
+	multi := false
+	switch f := obj.(type) {
+	case interface {
+		ObjConsCtx(context.Context, []float64) (float64, []float64, error)
+	}:
+		r.Obj, r.Cons, err = f.ObjConsCtx(ctx, x)
+	case interface {
+		ObjsCtx(context.Context, []float64) ([]float64, error)
+	}:
+		r.Objs, err = f.ObjsCtx(ctx, x)
+		multi = true
+	case interface {
+		ObjCons([]float64) (float64, []float64)
+	}:
+		r.Obj, r.Cons = f.ObjCons(x)
+	case interface {
+		Objs([]float64) []float64
+	}:
+		r.Objs = f.Objs(x)
+		multi = true
+	case ObjContexter:
+		r.Obj, err = f.ObjCtx(ctx, x)
+	case interface {
+		ObjErr([]float64) (float64, error)
+	}:
+		r.Obj, err = f.ObjErr(x)
+	default:
+		r.Obj = obj.Obj(x)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	if multi {
+		if len(r.Objs) == 0 {
+			return Result{}, ErrNoObjectives
+		}
+		r.Obj = r.Objs[0]
+	}
+	return r, nil
+}
@@ -0,0 +1,34 @@
+package functions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+func TestReceiverEvalTimeout(t *testing.T) {
+	r := &RemoteReceiver{EvalTimeout: 20 * time.Millisecond}
+	pipe := serve(t, r)
+	conn := dial(t, pipe, blocker{})
+	defer conn.Close()
+	if err := conn.Send(wire.Message{Kind: wire.Evaluate, ID: 1, X: []float64{-1}}); err != nil {
+		t.Fatal(err)
+	}
+	// The client is sent the error the objective function returned
+	m, err := conn.ReceiveMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Kind != wire.Error || m.ID != 1 || m.Err != context.DeadlineExceeded.Error() {
+		t.Errorf("reply %+v, want the timeout", m)
+	}
+	<-blockerStarted
+	if err := <-blockerStopped; err != context.DeadlineExceeded {
+		t.Errorf("evaluation stopped with %v", err)
+	}
+	if stats := r.Stats(); stats.Failures != 1 {
+		t.Errorf("stats %+v, want 1 failure", stats)
+	}
+}
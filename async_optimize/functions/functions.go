@@ -1,13 +1,22 @@
 package functions
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"math"
 	"math/rand"
 	"net"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
 )
 
 func init() {
@@ -54,102 +63,660 @@ type Remote struct {
 	Location string // tcp location of the objective function
 	//BufferSize int
 
+	Transport wire.Transport // How to connect to Location (default TCP)
+	TLSConfig *tls.Config    // If not nil, connect using TLS
+	Secret    []byte         // If not nil, authenticate with the shared secret
+
 	// Function to evaluate.
 	Objer
-	first bool
-	conn  net.Conn
-	enc   *gob.Encoder
-	dec   *gob.Decoder
+	first  bool
+	conn   *wire.Conn
+	lastID uint64
 	//b     []byte
 }
 
 func (r *Remote) Init() error {
-	conn, err := net.Dial("tcp", r.Location)
+	conn, err := wire.Dial(r.Transport, r.Location, r.TLSConfig)
 	if err != nil {
 		return err
 	}
-	r.conn = conn
+	heartbeat, timeout := wire.Liveness(0, 0)
+	r.conn = wire.NewConn(conn, timeout)
+
+	if r.Secret != nil {
+		err = wire.ClientAuth(r.conn, r.Secret)
+		if err != nil {
+			r.conn.Close()
+			return err
+		}
+	}
 
 	// Now that the connection is established, serialize the objective function
 	// and send it over the wire
-	enc := gob.NewEncoder(conn)
-	r.dec = gob.NewDecoder(conn)
-	err = enc.Encode(&r.Objer)
+	_, err = wire.ClientHandshake(r.conn, r.Objer)
 	if err != nil {
+		r.conn.Close()
 		return err
 	}
-	r.enc = enc
+	r.conn.Heartbeat(heartbeat)
 	return nil
 }
 
 func (r *Remote) Obj(x []float64) float64 {
 	// Serialize and send the location
-	err := r.enc.Encode(x)
+	r.lastID++
+	err := r.conn.Send(wire.Message{Kind: wire.Evaluate, ID: r.lastID, X: x})
 	if err != nil {
 		panic(err)
 	}
 
 	// Listen back for the objective value
-	var ans float64
-	err = r.dec.Decode(&ans)
-	if err != nil {
-		panic(err)
+	for {
+		m, err := r.conn.ReceiveMessage()
+		if err != nil {
+			panic(err)
+		}
+		// The server can also say it is going away, or send an error about
+		// the connection, which has ID zero. No answer is coming after
+		// either.
+		if m.Kind == wire.Shutdown {
+			panic(wire.ErrShutdown)
+		}
+		if m.Kind == wire.Error && m.ID == 0 {
+			panic(&wire.RemoteError{Msg: m.Err})
+		}
+		if m.ID != r.lastID {
+			continue
+		}
+		if m.Kind == wire.Error {
+			panic(&wire.RemoteError{Msg: m.Err})
+		}
+		return m.Obj
 	}
-	return ans
 }
 
 func (r *Remote) Result() {
+	r.conn.Send(wire.Message{Kind: wire.Shutdown})
 	r.conn.Close()
 }
 
-// RemoteReceiver is the other end of the Remote objective function
+// RemoteReceiver is the other end of the Remote objective function. Do serves a
+// single connection and then returns. Serve keeps accepting connections, and
+// each client is served in its own goroutine with its own objective function.
 type RemoteReceiver struct {
-	Port string // Where is the request going to
+	Port      string         // Where is the request going to
+	Transport wire.Transport // How to listen on Port and dial in Connect (default TCP)
+
+	// Maximum number of objective function evaluations running at once across
+	// all of the connections in Serve. If zero, the number of CPUs is used.
+	MaxConcurrent int
 
-	obj Objer
+	// Heartbeats are sent to every client each Heartbeat. If nothing, not
+	// even a heartbeat, arrives from a client for Timeout while waiting for
+	// the next location, the client is declared dead and the connection
+	// closed. Zero values use the defaults in the wire package, and negative
+	// values disable the feature.
+	Heartbeat time.Duration
+	Timeout   time.Duration
 
-	conn net.Conn
+	// The server runs whatever objective function it is sent, so on a shared
+	// network it should only talk to clients it trusts. If TLSConfig is set,
+	// connections use TLS; set ClientCAs and ClientAuth in it to require
+	// client certificates. Connect uses the same configuration as a TLS client.
+	// If Secret is set, clients must prove they know it before anything else
+	// is read from them. Without TLS, the secret does not protect the
+	// connection from someone in the middle of it (see the wire package).
+	TLSConfig *tls.Config
+	Secret    []byte
+
+	// If Registry is set, clients can only ask for the objective functions in
+	// it by name (see wire.Named). Objective functions sent by the client are
+	// refused without being decoded, so their types need not be registered
+	// with gob and no GobDecode method of theirs runs. If Registry is nil,
+	// any objective function the client sends is run, and named ones are
+	// refused.
+	Registry *Registry
+
+	// EvalTimeout is the longest an evaluation may take. The objective
+	// function must be an ObjContexter to be interrupted; the client is sent
+	// the error it returns.
+	EvalTimeout time.Duration
+
+	// Tags are sent to clients in the handshake, along with the number of
+	// CPUs, the memory and MaxConcurrent, so that they can choose what to
+	// send to this server (see optimize.Scheduler)
+	Tags []string
+
+	// Log receives a message when a client connects or disconnects, at Info
+	// level, when a connection or an evaluation fails, at Warn level, and for
+	// every evaluation, at Debug level. If nil, slog.Default() is used.
+	Log *slog.Logger
+
+	once   sync.Once
+	sem    chan struct{}      // Holds a value for every running evaluation
+	ctx    context.Context    // Parent of every evaluation's context
+	cancel context.CancelFunc // Cancels every evaluation
+
+	mu        sync.Mutex
+	closing   bool
+	shutdown  chan struct{} // Closed by Shutdown
+	listeners []net.Listener
+	listener  net.Listener   // Opened by Listen and not yet taken by Serve or Do
+	active    sync.WaitGroup // Connections being served
+	conns     int            // Connections being served
+	evals     uint64         // Evaluations finished
+	failures  uint64         // Evaluations which returned an error
+}
+
+// ReceiverStats is a snapshot of what a RemoteReceiver is doing, for example
+// to report from a health check
+type ReceiverStats struct {
+	Connections int    // Clients being served
+	Running     int    // Evaluations running
+	Evaluations uint64 // Evaluations finished
+	Failures    uint64 // Evaluations which returned an error
+	Closing     bool   // Shutdown has been called
+}
+
+// Stats returns the receiver's current activity
+func (r *RemoteReceiver) Stats() ReceiverStats {
+	r.init()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return ReceiverStats{
+		Connections: r.conns,
+		Running:     len(r.sem),
+		Evaluations: r.evals,
+		Failures:    r.failures,
+		Closing:     r.closing,
+	}
+}
+
+// capabilities describes the receiver to clients
+func (r *RemoteReceiver) capabilities() wire.Capabilities {
+	caps := wire.LocalCapabilities(r.Tags...)
+	caps.Slots = cap(r.sem)
+	caps.Batches = true
+	return caps
+}
+
+func (r *RemoteReceiver) log() *slog.Logger {
+	if r.Log != nil {
+		return r.Log
+	}
+	return slog.Default()
 }
 
 func (r *RemoteReceiver) Do() {
 	// Establish the connection and get the objective function
-	l, err := net.Listen("tcp", r.Port)
+	l, err := r.take()
+	if err == ErrClosed {
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
 	// Wait for a connection
 	conn, err := l.Accept()
 	if err != nil {
+		if r.isClosing() {
+			return
+		}
+		panic(err)
+	}
+	l.Close()
+	err = r.serveConn(conn)
+	if err != nil && err != ErrClosed {
 		panic(err)
 	}
-	r.conn = conn
+}
+
+func (r *RemoteReceiver) init() {
+	r.once.Do(func() {
+		n := r.MaxConcurrent
+		if n <= 0 {
+			n = runtime.NumCPU()
+		}
+		r.sem = make(chan struct{}, n)
+		r.ctx, r.cancel = context.WithCancel(context.Background())
+		r.shutdown = make(chan struct{})
+	})
+}
 
-	// Deserialize the objer
-	enc := gob.NewEncoder(conn)
-	dec := gob.NewDecoder(conn)
-	err = dec.Decode(&r.obj)
+// Listen starts listening on Port, so that clients can connect as soon as it
+// returns, before Serve or Do is called. Serve and Do call it themselves if
+// it has not been called.
+func (r *RemoteReceiver) Listen() error {
+	r.init()
+	l, err := wire.Listen(r.Transport, r.Port, r.TLSConfig)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if !r.track(l) {
+		return ErrClosed
+	}
+	r.mu.Lock()
+	r.listener = l
+	r.mu.Unlock()
+	return nil
+}
+
+// take returns the listener opened by Listen, calling it if needed
+func (r *RemoteReceiver) take() (net.Listener, error) {
+	r.init()
+	r.mu.Lock()
+	l := r.listener
+	r.listener = nil
+	r.mu.Unlock()
+	if l != nil {
+		return l, nil
+	}
+	err := r.Listen()
+	if err != nil {
+		return nil, err
+	}
+	return r.take()
+}
+
+// track adds the listener to the ones closed by Shutdown. It returns false,
+// after closing the listener, if Shutdown has already been called.
+func (r *RemoteReceiver) track(l net.Listener) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closing {
+		l.Close()
+		return false
 	}
+	r.listeners = append(r.listeners, l)
+	return true
+}
+
+func (r *RemoteReceiver) isClosing() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closing
+}
 
-	x := make([]float64, 0)
-	// Now, continue waiting to receive new locations
+// Serve accepts connections until the listener fails or Shutdown is called,
+// in which case it returns ErrClosed. A client disconnecting, or sending bad
+// data, only ends that client's connection.
+func (r *RemoteReceiver) Serve() error {
+	l, err := r.take()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
 	for {
-		// Read the new location
-		err = dec.Decode(&x)
-		if err == io.EOF {
+		conn, err := l.Accept()
+		if err != nil {
+			if r.isClosing() {
+				return ErrClosed
+			}
+			return err
+		}
+		go func(conn net.Conn) {
+			err := r.serveConn(conn)
+			if err != nil && err != ErrClosed {
+				r.log().Warn("connection failed", "remote", conn.RemoteAddr().String(), "err", err)
+			}
+		}(conn)
+	}
+}
+
+// Connect dials an optimizer running in coordinator mode (see
+// optimize.Async.Listen) and serves it. MaxConcurrent connections are opened,
+// each of which the optimizer treats as a separate worker. Connect returns
+// once all of the connections have closed, which happens when the
+// optimization finishes or Shutdown is called.
+func (r *RemoteReceiver) Connect(addr string) error {
+	r.init()
+	n := cap(r.sem)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		conn, err := wire.Dial(r.Transport, addr, r.TLSConfig)
+		if err != nil {
+			// Still wait for the connections that did open
+			n = i
+			if n == 0 {
+				return err
+			}
 			break
 		}
+		go func() {
+			errs <- r.serveConn(conn)
+		}()
+	}
+	var err error
+	for i := 0; i < n; i++ {
+		if e := <-errs; e != nil && e != ErrClosed {
+			err = e
+		}
+	}
+	return err
+}
+
+// ErrClosed is returned by the RemoteReceiver and RPCServer methods after
+// Shutdown
+var ErrClosed = errors.New("functions: receiver shut down")
+
+// Shutdown stops the receiver cleanly. It stops accepting connections and new
+// evaluations, waits for the running evaluations to finish and their results
+// to be sent, and then sends every client a Shutdown message and closes the
+// connection. Clients give the points the receiver did not take back to the
+// optimizer. If ctx is done before the evaluations finish, they are canceled
+// (see ObjContexter), the connections are closed, and Shutdown returns the
+// context's error.
+func (r *RemoteReceiver) Shutdown(ctx context.Context) error {
+	r.init()
+	r.mu.Lock()
+	if !r.closing {
+		r.closing = true
+		close(r.shutdown)
+		for _, l := range r.listeners {
+			l.Close()
+		}
+	}
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		r.cancel()
+		return ctx.Err()
+	}
+}
+
+// serveConn evaluates the objective function for a single client until the
+// client closes the connection
+func (r *RemoteReceiver) serveConn(c net.Conn) error {
+	r.mu.Lock()
+	if r.closing {
+		r.mu.Unlock()
+		c.Close()
+		return ErrClosed
+	}
+	r.active.Add(1)
+	r.conns++
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.conns--
+		r.mu.Unlock()
+		r.active.Done()
+	}()
+
+	heartbeat, timeout := wire.Liveness(r.Heartbeat, r.Timeout)
+	conn := wire.NewConn(c, timeout)
+	defer conn.Close()
+
+	if r.Secret != nil {
+		err := wire.ServerAuth(conn, r.Secret)
 		if err != nil {
-			panic(err)
+			return err
+		}
+	}
+
+	// Deserialize the objer. With a registry, the objective function is
+	// looked up by name, and one sent by the client is not even decoded.
+	handshake := wire.ServerHandshake
+	if r.Registry != nil {
+		handshake = wire.ServerNamedHandshake
+	}
+	objective, err := handshake(conn, r.resolve, r.capabilities())
+	if err != nil {
+		return err
+	}
+	conn.Heartbeat(heartbeat)
+	remote := c.RemoteAddr().String()
+	r.log().Info("client connected", "remote", remote, "objective", fmt.Sprintf("%T", objective))
+	defer r.log().Info("client disconnected", "remote", remote)
+
+	// Every evaluation gets a context which is canceled if the client cancels
+	// the request or the connection ends, so that work nobody is waiting for
+	// stops (if the objective function is an ObjContexter).
+	ctx, cancel := context.WithCancel(r.ctx)
+	s := &session{
+		r:       r,
+		conn:    conn,
+		obj:     objective.(Objer),
+		log:     r.log().With("remote", remote),
+		ctx:     ctx,
+		running: make(map[uint64]context.CancelFunc),
+	}
+	// Deferred calls run in the opposite order, so the evaluations are
+	// canceled before waiting for them to finish
+	defer s.wg.Wait()
+	defer cancel()
+
+	go func() {
+		select {
+		case <-r.shutdown:
+			// Let the evaluations that have started finish, then say goodbye
+			s.drain()
+			conn.Send(wire.Message{Kind: wire.Shutdown})
+			conn.Close()
+		case <-ctx.Done():
 		}
+	}()
+	go func() {
+		// The connection has ended, or Shutdown gave up waiting. This also
+		// unblocks a send to a client which has stopped reading.
+		<-ctx.Done()
+		conn.Close()
+	}()
+	return s.serve()
+}
 
-		fmt.Println("received x of ", x)
+// session is the state of a connection being served
+type session struct {
+	r    *RemoteReceiver
+	conn *wire.Conn
+	obj  Objer
+	ctx  context.Context // Canceled when the connection ends
+	log  *slog.Logger
 
-		ans := r.obj.Obj(x)
-		err = enc.Encode(ans)
+	mu      sync.Mutex
+	closing bool                          // No new evaluations are started
+	running map[uint64]context.CancelFunc // Cancels each running request
+	wg      sync.WaitGroup                // Running evaluations
+}
+
+// serve reads requests until the client goes away
+func (s *session) serve() error {
+	// Requests are evaluated concurrently, so the client can have several
+	// outstanding at once. Replies are sent as soon as they are ready, and
+	// the client matches them up by ID.
+	for {
+		// Read the new message
+		m, err := s.conn.ReceiveMessage()
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			panic(err)
+			if s.r.isClosing() {
+				return ErrClosed
+			}
+			return err
+		}
+
+		switch m.Kind {
+		case wire.Evaluate:
+			ctxs := s.begin(m.ID)
+			if ctxs == nil {
+				// Shutting down. The client gets the point back when it is
+				// told.
+				continue
+			}
+			go func(m wire.Message) {
+				defer s.end(m.ID)
+				s.log.Debug("evaluate", "id", m.ID, "x", m.X)
+				reply, ok := s.evaluate(ctxs[0], m)
+				if ok {
+					// If this fails, the next receive will fail too
+					s.conn.Send(reply)
+				}
+			}(m)
+		case wire.EvaluateBatch:
+			ids := make([]uint64, len(m.Batch))
+			for i, req := range m.Batch {
+				ids[i] = req.ID
+			}
+			ctxs := s.begin(ids...)
+			if ctxs == nil {
+				continue
+			}
+			// Evaluate the points in parallel, and answer all of them in
+			// a single message once they are done
+			go func(m wire.Message) {
+				defer s.end(ids...)
+				s.log.Debug("evaluate batch", "points", len(m.Batch))
+				replies := make([]wire.Message, len(m.Batch))
+				answered := make([]bool, len(m.Batch))
+				var batch sync.WaitGroup
+				for i, req := range m.Batch {
+					batch.Add(1)
+					go func(i int, req wire.Message) {
+						defer batch.Done()
+						replies[i], answered[i] = s.evaluate(ctxs[i], req)
+					}(i, req)
+				}
+				batch.Wait()
+				n := 0
+				for i, ok := range answered {
+					if ok {
+						replies[n] = replies[i]
+						n++
+					}
+				}
+				if n > 0 {
+					s.conn.Send(wire.Message{Kind: wire.ResultBatch, Batch: replies[:n]})
+				}
+			}(m)
+		case wire.Cancel:
+			s.mu.Lock()
+			if cancel, ok := s.running[m.ID]; ok {
+				cancel()
+			}
+			s.mu.Unlock()
+		case wire.Shutdown:
+			// The client has no requests outstanding
+			return nil
+		default:
+			err = s.conn.Send(wire.Message{Kind: wire.Error, ID: m.ID, Err: fmt.Sprintf("unexpected %v message", m.Kind)})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// begin registers the requests as running and returns a context for each. It
+// returns nil if the receiver is shutting down.
+func (s *session) begin(ids ...uint64) []context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return nil
+	}
+	s.wg.Add(1)
+	ctxs := make([]context.Context, len(ids))
+	for i, id := range ids {
+		var cancel context.CancelFunc
+		ctxs[i], cancel = context.WithCancel(s.ctx)
+		s.running[id] = cancel
+	}
+	return ctxs
+}
+
+// end removes requests started together by begin
+func (s *session) end(ids ...uint64) {
+	s.mu.Lock()
+	for _, id := range ids {
+		if cancel, ok := s.running[id]; ok {
+			cancel()
+			delete(s.running, id)
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// drain stops new evaluations from starting and waits for the running ones
+func (s *session) drain() {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// evaluate evaluates the request in one of the receiver's slots. It returns
+// false if the request was canceled, in which case there is no reply to send.
+func (s *session) evaluate(ctx context.Context, m wire.Message) (wire.Message, bool) {
+	// Sending on a full buffered channel blocks, so this waits until fewer
+	// than MaxConcurrent evaluations are running
+	select {
+	case s.r.sem <- struct{}{}:
+	case <-ctx.Done():
+		return wire.Message{}, false
+	}
+	evalCtx := ctx
+	if s.r.EvalTimeout > 0 {
+		var cancel context.CancelFunc
+		evalCtx, cancel = context.WithTimeout(ctx, s.r.EvalTimeout)
+		defer cancel()
+	}
+	reply := evaluate(evalCtx, s.obj, m.ID, m.X)
+	<-s.r.sem
+	if ctx.Err() != nil {
+		return reply, false
+	}
+	s.r.mu.Lock()
+	s.r.evals++
+	if reply.Kind == wire.Error {
+		s.r.failures++
+	}
+	s.r.mu.Unlock()
+	if reply.Kind == wire.Error {
+		s.log.Warn("evaluation failed", "id", m.ID, "x", m.X, "err", reply.Err)
+	}
+	return reply, true
+}
+
+// resolve finds the objective function a client asked for in its handshake
+func (r *RemoteReceiver) resolve(m wire.Message) (interface{}, error) {
+	if r.Registry != nil {
+		if m.Name == "" {
+			return nil, fmt.Errorf("functions: server only runs registered objectives (%s)", strings.Join(r.Registry.Names(), ", "))
+		}
+		return r.Registry.New(m.Name, m.Params)
+	}
+	if m.Name != "" {
+		return nil, fmt.Errorf("functions: server has no registry, can not run %q", m.Name)
+	}
+	obj, ok := m.Objective.(Objer)
+	if !ok {
+		return nil, fmt.Errorf("functions: %T is not an objective function", m.Objective)
+	}
+	return obj, nil
+}
+
+// evaluate calls the objective function (see Evaluate) and creates the reply
+// to send. A panic in the objective function is sent back as an error.
+func evaluate(ctx context.Context, obj Objer, id uint64, x []float64) (reply wire.Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			reply = wire.Message{Kind: wire.Error, ID: id, Err: fmt.Sprint(r)}
 		}
+	}()
+	r, err := Evaluate(ctx, obj, x)
+	if err != nil {
+		return wire.Message{Kind: wire.Error, ID: id, Err: err.Error()}
 	}
+	return wire.Message{Kind: wire.Result, ID: id, Obj: r.Obj, Cons: r.Cons, Objs: r.Objs}
 }
@@ -0,0 +1,350 @@
+package functions
+
+import (
+	"context"
+	"encoding/gob"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+func init() {
+	gob.Register(scaled{})
+	gob.Register(slow{})
+	gob.Register(panicky{})
+}
+
+// scaled is Example times K, so that clients can tell their objective from
+// another client's
+type scaled struct{ K float64 }
+
+func (s scaled) Obj(x []float64) float64 {
+	return s.K * Example{}.Obj(x)
+}
+
+// gauge records how many evaluations of slow run at once. The server gets a
+// copy of the objective function, so it is shared through a package variable.
+var gauge struct {
+	sync.Mutex
+	running, max int
+}
+
+// slow takes a few milliseconds
+type slow struct{}
+
+func (slow) Obj(x []float64) float64 {
+	gauge.Lock()
+	gauge.running++
+	if gauge.running > gauge.max {
+		gauge.max = gauge.running
+	}
+	gauge.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	gauge.Lock()
+	gauge.running--
+	gauge.Unlock()
+	return x[0]
+}
+
+// panicky panics at points with a negative first element
+type panicky struct{}
+
+func (panicky) Obj(x []float64) float64 {
+	if x[0] < 0 {
+		panic("negative")
+	}
+	return x[0]
+}
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// serve runs the receiver on a Pipe until the test ends, and checks that Serve
+// returns ErrClosed after Shutdown
+func serve(t *testing.T, r *RemoteReceiver) *wire.Pipe {
+	pipe := &wire.Pipe{}
+	r.Port = t.Name()
+	r.Transport = pipe
+	r.Log = quiet
+	if err := r.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- r.Serve() }()
+	t.Cleanup(func() {
+		if err := r.Shutdown(context.Background()); err != nil {
+			t.Errorf("Shutdown returned %v", err)
+		}
+		if err := <-errc; err != ErrClosed {
+			t.Errorf("Serve returned %v, want ErrClosed", err)
+		}
+	})
+	return pipe
+}
+
+// connect initializes a client
+func connect(t *testing.T, pipe *wire.Pipe, obj Objer) *Remote {
+	r := &Remote{Location: t.Name(), Transport: pipe, Objer: obj}
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestReceiverManyClients(t *testing.T) {
+	r := &RemoteReceiver{MaxConcurrent: 3}
+	pipe := serve(t, r)
+	const clients, points = 5, 20
+	var wg sync.WaitGroup
+	errs := make(chan string, clients*points)
+	for i := 0; i < clients; i++ {
+		// Every client has its own objective function
+		obj := scaled{K: float64(i + 1)}
+		remote := connect(t, pipe, obj)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer remote.Result()
+			for j := 0; j < points; j++ {
+				x := []float64{float64(j), float64(-j)}
+				if got, want := remote.Obj(x), obj.Obj(x); got != want {
+					errs <- "wrong objective value"
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if stats := r.Stats(); stats.Evaluations != clients*points || stats.Failures != 0 {
+		t.Errorf("stats %+v, want %d evaluations", stats, clients*points)
+	}
+}
+
+func TestReceiverMaxConcurrent(t *testing.T) {
+	gauge.Lock()
+	gauge.max = 0
+	gauge.Unlock()
+	r := &RemoteReceiver{MaxConcurrent: 2}
+	pipe := serve(t, r)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		remote := connect(t, pipe, slow{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer remote.Result()
+			for j := 0; j < 5; j++ {
+				remote.Obj([]float64{float64(j)})
+			}
+		}()
+	}
+	wg.Wait()
+	gauge.Lock()
+	defer gauge.Unlock()
+	if gauge.max < 1 || gauge.max > 2 {
+		t.Errorf("%d evaluations ran at once, want at most 2", gauge.max)
+	}
+}
+
+func TestReceiverPanic(t *testing.T) {
+	r := &RemoteReceiver{}
+	pipe := serve(t, r)
+	remote := connect(t, pipe, panicky{})
+	defer remote.Result()
+	func() {
+		defer func() {
+			if _, ok := recover().(*wire.RemoteError); !ok {
+				t.Error("panic in the objective function was not sent back as an error")
+			}
+		}()
+		remote.Obj([]float64{-1})
+	}()
+	// The connection is still usable
+	if obj := remote.Obj([]float64{2}); obj != 2 {
+		t.Errorf("objective %v after a panic, want 2", obj)
+	}
+	if stats := r.Stats(); stats.Evaluations != 2 || stats.Failures != 1 || stats.Connections != 1 {
+		t.Errorf("stats %+v, want 2 evaluations, 1 failure and 1 connection", stats)
+	}
+}
+
+// waitFor polls cond until it is true, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// dial connects a raw client which has sent the handshake
+func dial(t *testing.T, pipe *wire.Pipe, obj Objer) *wire.Conn {
+	c, err := pipe.Dial(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := wire.NewConn(c, 0)
+	if _, err := wire.ClientHandshake(conn, obj); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestReceiverDropsSilentClient(t *testing.T) {
+	r := &RemoteReceiver{Heartbeat: -1, Timeout: 20 * time.Millisecond}
+	pipe := serve(t, r)
+	conn := dial(t, pipe, Example{})
+	defer conn.Close()
+	waitFor(t, "the client to connect", func() bool { return r.Stats().Connections == 1 })
+	// The client sends nothing, not even heartbeats
+	waitFor(t, "the client to be dropped", func() bool { return r.Stats().Connections == 0 })
+}
+
+func TestReceiverKeepsQuietClient(t *testing.T) {
+	r := &RemoteReceiver{Heartbeat: -1, Timeout: 50 * time.Millisecond}
+	pipe := serve(t, r)
+	conn := dial(t, pipe, Example{})
+	defer conn.Close()
+	// Only heartbeats for several timeouts, then a request
+	conn.Heartbeat(5 * time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	if err := conn.Send(wire.Message{Kind: wire.Evaluate, ID: 1, X: []float64{1}}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := conn.ReceiveMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Kind != wire.Result || m.Obj != (Example{}).Obj([]float64{1}) {
+		t.Errorf("reply %+v, want the result", m)
+	}
+}
+
+// obj calls remote.Obj and returns the objective value, or what it panicked
+// with
+func obj(remote *Remote, x []float64) (v interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			v = r
+		}
+	}()
+	return remote.Obj(x)
+}
+
+func TestRemoteConnectionError(t *testing.T) {
+	// A server which answers the first request with an error that is not
+	// about any request
+	pipe := &wire.Pipe{}
+	l, err := pipe.Listen(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn := wire.NewConn(c, 0)
+		defer conn.Close()
+		resolve := func(wire.Message) (interface{}, error) { return Example{}, nil }
+		if _, err := wire.ServerHandshake(conn, resolve, wire.Capabilities{}); err != nil {
+			return
+		}
+		conn.ReceiveMessage()
+		conn.Send(wire.Message{Kind: wire.Error, Err: "out of memory"})
+		conn.ReceiveMessage()
+	}()
+	remote := connect(t, pipe, Example{})
+	defer remote.Result()
+	if e, ok := obj(remote, []float64{1}).(*wire.RemoteError); !ok || e.Msg != "out of memory" {
+		t.Errorf("Obj panicked with %v, want the server's error", e)
+	}
+}
+
+func TestRemoteShutdown(t *testing.T) {
+	r := &RemoteReceiver{}
+	pipe := serve(t, r)
+	remote := connect(t, pipe, Example{})
+	defer remote.Result()
+	if v := obj(remote, []float64{1}); v != (Example{}).Obj([]float64{1}) {
+		t.Fatalf("Obj returned %v", v)
+	}
+	go r.Shutdown(context.Background())
+	waitFor(t, "the receiver to shut down", func() bool { return r.Stats().Closing })
+	if v := obj(remote, []float64{1}); v != wire.ErrShutdown {
+		t.Errorf("Obj after Shutdown panicked with %v, want ErrShutdown", v)
+	}
+}
+
+func TestReceiverSecret(t *testing.T) {
+	r := &RemoteReceiver{Secret: []byte("secret")}
+	pipe := serve(t, r)
+	// Without the secret, or with the wrong one, the client is refused
+	for _, secret := range [][]byte{nil, []byte("wrong")} {
+		remote := &Remote{Location: t.Name(), Transport: pipe, Objer: Example{}, Secret: secret}
+		if err := remote.Init(); err == nil {
+			t.Errorf("client with secret %q accepted", secret)
+		}
+	}
+	remote := &Remote{Location: t.Name(), Transport: pipe, Objer: Example{}, Secret: []byte("secret")}
+	if err := remote.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Result()
+	if obj := remote.Obj([]float64{1}); obj != (Example{}).Obj([]float64{1}) {
+		t.Errorf("objective %v with the secret", obj)
+	}
+}
+
+func TestReceiverBatch(t *testing.T) {
+	r := &RemoteReceiver{MaxConcurrent: 2}
+	pipe := serve(t, r)
+	c, err := pipe.Dial(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := wire.NewConn(c, 0)
+	defer conn.Close()
+	caps, err := wire.ClientHandshake(conn, panicky{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !caps.Batches {
+		t.Error("receiver does not say it understands batches")
+	}
+
+	// More points than slots, one of which fails
+	xs := map[uint64]float64{1: 1, 2: -1, 3: 2, 4: 3}
+	var batch []wire.Message
+	for id, x := range xs {
+		batch = append(batch, wire.Message{Kind: wire.Evaluate, ID: id, X: []float64{x}})
+	}
+	if err := conn.Send(wire.Message{Kind: wire.EvaluateBatch, Batch: batch}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := conn.ReceiveMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Kind != wire.ResultBatch || len(m.Batch) != len(xs) {
+		t.Fatalf("reply %+v, want a batch of %d results", m, len(xs))
+	}
+	for _, reply := range m.Batch {
+		x := xs[reply.ID]
+		switch {
+		case x < 0 && reply.Kind != wire.Error:
+			t.Errorf("reply %+v for %v, want an error", reply, x)
+		case x >= 0 && (reply.Kind != wire.Result || reply.Obj != x):
+			t.Errorf("reply %+v for %v, want the result", reply, x)
+		}
+	}
+}
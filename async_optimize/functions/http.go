@@ -0,0 +1,47 @@
+package functions
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// HTTPHandler serves the objective function over HTTP using the JSON format
+// described in the wire package, for use with optimize.HTTPWorker. Each
+// request is evaluated in the handler's goroutine, so the objective function
+// must be safe to call concurrently. For example
+//
+//	http.Handle("/eval", functions.HTTPHandler{Objer: functions.Example{}})
+//	log.Fatal(http.ListenAndServe(":8080", nil))
+type HTTPHandler struct {
+	Objer
+}
+
+func (h HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "evaluations must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	var r wire.EvalRequest
+	err := json.NewDecoder(req.Body).Decode(&r)
+	if err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Reuse the gob server's evaluation, which also turns panics into errors
+	m := evaluate(req.Context(), h.Objer, r.ID, wire.Floats(r.X))
+	resp := wire.EvalResponse{ID: r.ID}
+	if m.Kind == wire.Error {
+		resp.Error = m.Err
+	} else {
+		obj := wire.Float(m.Obj)
+		resp.Obj = &obj
+		resp.Objs = wire.ToFloats(m.Objs)
+		resp.Cons = wire.ToFloats(m.Cons)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,212 @@
+package functions
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A RemoteReceiver normally runs whatever objective function the client sends,
+// as long as its type is registered with gob. A Registry is an allowlist
+// instead: objective functions are registered on the server under a name,
+// along with the parameters they accept, and clients ask for one by name
+// (see wire.Named). A RemoteReceiver with a Registry refuses everything else.
+
+// ParamType is the type of value a parameter holds
+type ParamType int
+
+const (
+	StringParam ParamType = iota
+	FloatParam
+	IntParam
+	BoolParam
+	DurationParam // Parsed with time.ParseDuration
+)
+
+func (t ParamType) String() string {
+	switch t {
+	case StringParam:
+		return "string"
+	case FloatParam:
+		return "float"
+	case IntParam:
+		return "int"
+	case BoolParam:
+		return "bool"
+	case DurationParam:
+		return "duration"
+	}
+	return fmt.Sprintf("ParamType(%d)", int(t))
+}
+
+// check returns an error if the value can not be parsed as the type
+func (t ParamType) check(v string) error {
+	var err error
+	switch t {
+	case FloatParam:
+		_, err = strconv.ParseFloat(v, 64)
+	case IntParam:
+		_, err = strconv.Atoi(v)
+	case BoolParam:
+		_, err = strconv.ParseBool(v)
+	case DurationParam:
+		_, err = time.ParseDuration(v)
+	}
+	return err
+}
+
+// Param describes a parameter of a registered objective function
+type Param struct {
+	Name     string
+	Type     ParamType
+	Default  string // Value used if the client does not set the parameter
+	Required bool   // If true, the client must set the parameter
+}
+
+// Values are the parameters given to a Factory. Every parameter in the schema
+// is present (unless it has no default and was not set) and has been checked
+// against its type, so the accessors do not return errors.
+type Values map[string]string
+
+// String returns the value of the parameter
+func (v Values) String(name string) string {
+	return v[name]
+}
+
+// Float returns the value of a FloatParam
+func (v Values) Float(name string) float64 {
+	f, _ := strconv.ParseFloat(v[name], 64)
+	return f
+}
+
+// Int returns the value of an IntParam
+func (v Values) Int(name string) int {
+	i, _ := strconv.Atoi(v[name])
+	return i
+}
+
+// Bool returns the value of a BoolParam
+func (v Values) Bool(name string) bool {
+	b, _ := strconv.ParseBool(v[name])
+	return b
+}
+
+// Duration returns the value of a DurationParam
+func (v Values) Duration(name string) time.Duration {
+	d, _ := time.ParseDuration(v[name])
+	return d
+}
+
+// A Factory creates an objective function from checked parameters
+type Factory func(params Values) (Objer, error)
+
+type registryEntry struct {
+	params  []Param
+	factory Factory
+}
+
+// Registry is a set of objective functions that can be asked for by name.
+// The zero value is an empty registry ready to use.
+type Registry struct {
+	mu      sync.RWMutex
+	entries map[string]registryEntry
+}
+
+// Register adds an objective function to the registry. It panics if the name
+// is already registered.
+func (r *Registry) Register(name string, params []Param, factory Factory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.entries == nil {
+		r.entries = make(map[string]registryEntry)
+	}
+	if _, ok := r.entries[name]; ok {
+		panic("functions: objective " + name + " registered twice")
+	}
+	r.entries[name] = registryEntry{params: params, factory: factory}
+}
+
+// Names returns the registered names in sorted order
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.entries))
+	for name := range r.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Params returns the parameters accepted by the named objective function
+func (r *Registry) Params(name string) ([]Param, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entry, ok := r.entries[name]
+	return entry.params, ok
+}
+
+// New creates the named objective function. It returns an error if the name
+// is not registered, or if the parameters do not match the schema: unknown
+// parameters, missing required parameters, and values that do not parse are
+// all refused.
+func (r *Registry) New(name string, params map[string]string) (Objer, error) {
+	r.mu.RLock()
+	entry, ok := r.entries[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("functions: objective %q is not registered", name)
+	}
+
+	values := make(Values)
+	known := make(map[string]bool)
+	for _, p := range entry.params {
+		known[p.Name] = true
+		v, ok := params[p.Name]
+		if !ok {
+			if p.Required {
+				return nil, fmt.Errorf("functions: %s: missing parameter %q", name, p.Name)
+			}
+			if p.Default == "" {
+				continue
+			}
+			v = p.Default
+		}
+		if err := p.Type.check(v); err != nil {
+			return nil, fmt.Errorf("functions: %s: parameter %q is not a %v: %q", name, p.Name, p.Type, v)
+		}
+		values[p.Name] = v
+	}
+	for k := range params {
+		if !known[k] {
+			return nil, fmt.Errorf("functions: %s: unknown parameter %q", name, k)
+		}
+	}
+	return entry.factory(values)
+}
+
+// DefaultRegistry holds the objective functions in this package, and any
+// registered with Register
+var DefaultRegistry = &Registry{}
+
+// Register adds an objective function to DefaultRegistry
+func Register(name string, params []Param, factory Factory) {
+	DefaultRegistry.Register(name, params, factory)
+}
+
+func init() {
+	Register("example", nil, func(Values) (Objer, error) {
+		return Example{}, nil
+	})
+	Register("varied", []Param{
+		{Name: "fixed", Type: DurationParam, Default: "0s"},
+		{Name: "varied", Type: DurationParam, Default: "1ns"},
+	}, func(v Values) (Objer, error) {
+		if v.Duration("fixed") < 0 || v.Duration("varied") <= 0 {
+			return nil, fmt.Errorf("functions: varied: fixed must be non-negative and varied positive")
+		}
+		return Varied{Fixed: v.Duration("fixed"), Varied: v.Duration("varied")}, nil
+	})
+}
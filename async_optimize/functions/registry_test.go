@@ -0,0 +1,100 @@
+package functions
+
+import (
+	"encoding/gob"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// decoded counts the times gob has built a trap
+var decoded int32
+
+// trap is an objective function which records being decoded
+type trap struct{}
+
+func (trap) Obj(x []float64) float64    { return 0 }
+func (trap) GobEncode() ([]byte, error) { return []byte{1}, nil }
+func (*trap) GobDecode([]byte) error {
+	atomic.AddInt32(&decoded, 1)
+	return nil
+}
+
+func init() {
+	gob.Register(trap{})
+}
+
+func TestRegistryNew(t *testing.T) {
+	reg := &Registry{}
+	reg.Register("varied", []Param{
+		{Name: "fixed", Type: DurationParam, Required: true},
+		{Name: "scale", Type: FloatParam, Default: "2"},
+	}, func(v Values) (Objer, error) {
+		return Varied{Fixed: v.Duration("fixed"), Varied: time.Duration(v.Float("scale"))}, nil
+	})
+	obj, err := reg.New("varied", map[string]string{"fixed": "1ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := obj.(Varied); v.Fixed != time.Millisecond || v.Varied != 2 {
+		t.Errorf("created %+v, want the default scale", v)
+	}
+	for _, params := range []map[string]string{
+		nil,                               // Missing required parameter
+		{"fixed": "soon"},                 // Not a duration
+		{"fixed": "1ms", "scale": "big"},  // Not a float
+		{"fixed": "1ms", "color": "blue"}, // Unknown parameter
+	} {
+		if _, err := reg.New("varied", params); err == nil {
+			t.Errorf("parameters %v accepted", params)
+		}
+	}
+	if _, err := reg.New("missing", nil); err == nil {
+		t.Error("unregistered objective created")
+	}
+	if names := reg.Names(); len(names) != 1 || names[0] != "varied" {
+		t.Errorf("names %v", names)
+	}
+}
+
+func TestReceiverRegistry(t *testing.T) {
+	reg := &Registry{}
+	reg.Register("scaled", []Param{{Name: "k", Type: FloatParam, Default: "1"}}, func(v Values) (Objer, error) {
+		return scaled{K: v.Float("k")}, nil
+	})
+	r := &RemoteReceiver{Registry: reg}
+	pipe := serve(t, r)
+
+	remote := connect(t, pipe, wire.Named{Name: "scaled", Params: map[string]string{"k": "3"}})
+	x := []float64{1, 2}
+	if got, want := remote.Obj(x), (scaled{K: 3}).Obj(x); got != want {
+		t.Errorf("objective %v, want %v", got, want)
+	}
+	remote.Result()
+
+	// Anything else is refused
+	for _, obj := range []Objer{
+		wire.Named{Name: "missing"},
+		wire.Named{Name: "scaled", Params: map[string]string{"k": "x"}},
+		Example{},
+	} {
+		remote := &Remote{Location: t.Name(), Transport: pipe, Objer: obj}
+		if err := remote.Init(); err == nil {
+			remote.Result()
+			t.Errorf("objective %#v accepted", obj)
+		}
+	}
+
+	// An objective function sent anyway is not decoded
+	atomic.StoreInt32(&decoded, 0)
+	remote = &Remote{Location: t.Name(), Transport: pipe, Objer: trap{}}
+	if err := remote.Init(); err == nil {
+		remote.Result()
+		t.Error("objective sent to a registry accepted")
+	}
+	if n := atomic.LoadInt32(&decoded); n != 0 {
+		t.Errorf("objective decoded %d times by a server with a registry", n)
+	}
+}
@@ -0,0 +1,279 @@
+package functions
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// The protocol used by Remote and RemoteReceiver is specific to this package.
+// RPCServer offers the same evaluations as a net/rpc service instead, so they
+// can be called by any net/rpc client, or with JSON-RPC (version 1.0, see
+// net/rpc/jsonrpc) from other languages and ordinary tools. The service is
+// named "Objective" and has the methods
+//
+//	Objective.Evaluate(wire.EvalRequest) wire.EvalResponse
+//	Objective.EvaluateBatch(BatchRequest) BatchResponse
+//	Objective.Info(struct{}) RPCInfo
+//	Objective.Shutdown(struct{}) struct{}
+//
+// For example, with the server running with JSON-RPC on port 3000,
+//
+//	echo '{"method": "Objective.Evaluate", "params": [{"x": [1, 2]}], "id": 1}' | nc localhost 3000
+//
+// An objective function failing at a point is not an RPC error; the message
+// is in the Error field of the response. A point the server does not evaluate
+// because it is shutting down, or whose evaluation Shutdown cancels, is not
+// the point's fault, so the call fails with the RPC error ErrClosed instead
+// and the client can send the point elsewhere. gob does not send zero values,
+// so to a gob client a response with a nil Obj and no Error or Objs means the
+// objective was zero. Unlike RemoteReceiver, the server evaluates a fixed
+// objective function, so clients can not send code.
+
+// RPCService is the name of the service registered by RPCServer
+const RPCService = "Objective"
+
+// BatchRequest is the argument of EvaluateBatch
+type BatchRequest struct {
+	X [][]wire.Float `json:"x"`
+}
+
+// BatchResponse is the reply of EvaluateBatch. Results are in the same order
+// as the points in the request.
+type BatchResponse struct {
+	Results []wire.EvalResponse `json:"results"`
+}
+
+// RPCInfo is the reply of Info
+type RPCInfo struct {
+	Objective     string `json:"objective"`      // Name of the objective function
+	Version       int    `json:"version"`        // Version of the wire package
+	MaxConcurrent int    `json:"max_concurrent"` // Evaluations run at once
+	NumCPU        int    `json:"num_cpu"`
+}
+
+// RPCServer serves an objective function over net/rpc. Evaluations from all
+// clients share MaxConcurrent slots (default the number of CPUs), so the
+// objective function must be safe to call concurrently.
+type RPCServer struct {
+	Objer
+	Name          string // Name reported by Info
+	MaxConcurrent int
+	JSON          bool // Use JSON-RPC instead of gob
+	AllowShutdown bool // If false, the Shutdown RPC returns an error
+
+	// EvalTimeout is the longest an evaluation may take. The objective
+	// function must be an ObjContexter to be interrupted; the client is sent
+	// the error it returns.
+	EvalTimeout time.Duration
+
+	once     sync.Once
+	sem      chan struct{}
+	ctx      context.Context // Canceled when Shutdown gives up waiting
+	cancel   context.CancelFunc
+	running  sync.WaitGroup
+	mu       sync.Mutex
+	listener net.Listener
+	closing  bool
+}
+
+func (s *RPCServer) init() {
+	s.once.Do(func() {
+		n := s.MaxConcurrent
+		if n <= 0 {
+			n = runtime.NumCPU()
+		}
+		s.sem = make(chan struct{}, n)
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	})
+}
+
+// Serve accepts connections on the listener until it is closed or a client
+// calls Shutdown. After Shutdown, Serve returns ErrClosed. Evaluations may
+// still be running when a client shuts the server down, so call Shutdown to
+// wait for them.
+func (s *RPCServer) Serve(l net.Listener) error {
+	s.init()
+	server := rpc.NewServer()
+	err := server.RegisterName(RPCService, &rpcService{s})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		l.Close()
+		return ErrClosed
+	}
+	s.listener = l
+	s.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return ErrClosed
+			}
+			return err
+		}
+		if s.JSON {
+			go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+		} else {
+			go server.ServeConn(conn)
+		}
+	}
+}
+
+// ListenAndServe listens on the TCP address and calls Serve
+func (s *RPCServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Shutdown stops the server cleanly. It stops accepting connections and new
+// evaluations, and waits for the running evaluations to finish. Connections
+// are left open so that the answers can be sent. If ctx is done before the
+// evaluations finish, they are canceled (see ObjContexter) and Shutdown
+// returns the context's error.
+func (s *RPCServer) Shutdown(ctx context.Context) error {
+	s.init()
+	s.close()
+
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		return ctx.Err()
+	}
+}
+
+// close stops accepting connections and new evaluations
+func (s *RPCServer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closing {
+		s.closing = true
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	}
+}
+
+func (s *RPCServer) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// evaluate evaluates a single point in one of the slots. It returns ErrClosed
+// if the point was not evaluated because of Shutdown.
+func (s *RPCServer) evaluate(id uint64, x []float64) (wire.EvalResponse, error) {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return wire.EvalResponse{}, ErrClosed
+	}
+	s.running.Add(1)
+	s.mu.Unlock()
+	defer s.running.Done()
+
+	select {
+	case s.sem <- struct{}{}:
+	case <-s.ctx.Done():
+		return wire.EvalResponse{}, ErrClosed
+	}
+	ctx := s.ctx
+	if s.EvalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.EvalTimeout)
+		defer cancel()
+	}
+	m := evaluate(ctx, s.Objer, id, x)
+	<-s.sem
+	resp := wire.EvalResponse{ID: id}
+	if m.Kind == wire.Error {
+		if s.ctx.Err() != nil {
+			// Canceled by Shutdown
+			return wire.EvalResponse{}, ErrClosed
+		}
+		resp.Error = m.Err
+		return resp, nil
+	}
+	obj := wire.Float(m.Obj)
+	resp.Obj = &obj
+	resp.Objs = wire.ToFloats(m.Objs)
+	resp.Cons = wire.ToFloats(m.Cons)
+	return resp, nil
+}
+
+// rpcService holds the methods of the service. net/rpc logs a complaint about
+// every exported method that does not have the RPC form, so they are kept
+// separate from RPCServer.
+type rpcService struct {
+	s *RPCServer
+}
+
+// Evaluate evaluates the objective function at a point
+func (r *rpcService) Evaluate(req wire.EvalRequest, resp *wire.EvalResponse) error {
+	var err error
+	*resp, err = r.s.evaluate(req.ID, wire.Floats(req.X))
+	return err
+}
+
+// EvaluateBatch evaluates the objective function at several points at once.
+// If any of the points is stopped by Shutdown, the whole call fails.
+func (r *rpcService) EvaluateBatch(req BatchRequest, resp *BatchResponse) error {
+	resp.Results = make([]wire.EvalResponse, len(req.X))
+	errs := make([]error, len(req.X))
+	var wg sync.WaitGroup
+	for i, x := range req.X {
+		wg.Add(1)
+		go func(i int, x []wire.Float) {
+			defer wg.Done()
+			resp.Results[i], errs[i] = r.s.evaluate(uint64(i), wire.Floats(x))
+		}(i, x)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Info describes the server
+func (r *rpcService) Info(req struct{}, info *RPCInfo) error {
+	*info = RPCInfo{
+		Objective:     r.s.Name,
+		Version:       wire.Version,
+		MaxConcurrent: cap(r.s.sem),
+		NumCPU:        runtime.NumCPU(),
+	}
+	return nil
+}
+
+// Shutdown stops the server from accepting new connections and evaluations,
+// as RPCServer.Shutdown does, but does not wait for the running evaluations
+func (r *rpcService) Shutdown(req struct{}, resp *struct{}) error {
+	if !r.s.AllowShutdown {
+		return errors.New("shutdown not allowed")
+	}
+	r.s.close()
+	return nil
+}
@@ -0,0 +1,154 @@
+package functions
+
+import (
+	"context"
+	"math"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"testing"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// serveRPC runs the server on a Pipe and returns a client for it, and the
+// channel Serve's error arrives on
+func serveRPC(t *testing.T, s *RPCServer) (*rpc.Client, <-chan error) {
+	pipe := &wire.Pipe{}
+	l, err := pipe.Listen("rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+	conn, err := pipe.Dial("rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var client *rpc.Client
+	if s.JSON {
+		client = jsonrpc.NewClient(conn)
+	} else {
+		client = rpc.NewClient(conn)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		l.Close()
+	})
+	return client, done
+}
+
+func TestRPCServer(t *testing.T) {
+	for _, json := range []bool{false, true} {
+		s := &RPCServer{Objer: panicky{}, Name: "panicky", JSON: json, MaxConcurrent: 2}
+		client, _ := serveRPC(t, s)
+
+		var resp wire.EvalResponse
+		if err := client.Call("Objective.Evaluate", wire.EvalRequest{ID: 4, X: wire.ToFloats([]float64{2})}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ID != 4 || resp.Obj == nil || *resp.Obj != 2 {
+			t.Errorf("json %v: response %+v, want 2", json, resp)
+		}
+		// A point which is not finite gets there, and a failure is not an
+		// RPC error
+		resp = wire.EvalResponse{}
+		if err := client.Call("Objective.Evaluate", wire.EvalRequest{X: wire.ToFloats([]float64{math.Inf(-1)})}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error == "" {
+			t.Errorf("json %v: response %+v, want the panic as an error", json, resp)
+		}
+
+		var batch BatchResponse
+		req := BatchRequest{X: [][]wire.Float{{1}, {-1}, {3}}}
+		if err := client.Call("Objective.EvaluateBatch", req, &batch); err != nil {
+			t.Fatal(err)
+		}
+		if len(batch.Results) != 3 || *batch.Results[0].Obj != 1 || batch.Results[1].Error == "" || *batch.Results[2].Obj != 3 {
+			t.Errorf("json %v: batch %+v", json, batch.Results)
+		}
+
+		var info RPCInfo
+		if err := client.Call("Objective.Info", struct{}{}, &info); err != nil {
+			t.Fatal(err)
+		}
+		if info.Objective != "panicky" || info.MaxConcurrent != 2 || info.Version != wire.Version {
+			t.Errorf("json %v: info %+v", json, info)
+		}
+	}
+}
+
+func TestRPCShutdown(t *testing.T) {
+	s := &RPCServer{Objer: Example{}}
+	client, done := serveRPC(t, s)
+	if err := client.Call("Objective.Shutdown", struct{}{}, &struct{}{}); err == nil {
+		t.Error("shutdown allowed")
+	}
+
+	s = &RPCServer{Objer: Example{}, AllowShutdown: true}
+	client, done = serveRPC(t, s)
+	if err := client.Call("Objective.Shutdown", struct{}{}, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrClosed {
+		t.Errorf("Serve returned %v, want ErrClosed", err)
+	}
+	// The connection is still open, but nothing new is started
+	var resp wire.EvalResponse
+	if err := client.Call("Objective.Evaluate", wire.EvalRequest{X: wire.ToFloats([]float64{1})}, &resp); err == nil || err.Error() != ErrClosed.Error() {
+		t.Errorf("response %+v, %v after Shutdown, want ErrClosed", resp, err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown after a client's Shutdown returned %v", err)
+	}
+}
+
+func TestRPCServerShutdown(t *testing.T) {
+	s := &RPCServer{Objer: blocker{}, EvalTimeout: time.Hour}
+	client, done := serveRPC(t, s)
+	call := client.Go("Objective.Evaluate", wire.EvalRequest{ID: 1, X: wire.ToFloats([]float64{-1})}, &wire.EvalResponse{}, nil)
+	await(t, "the evaluation to start", blockerStarted)
+
+	// The evaluation never finishes by itself, so it is canceled when the
+	// context given to Shutdown expires, and the call fails
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned %v, want DeadlineExceeded", err)
+	}
+	if err := await(t, "Serve to return", done); err != ErrClosed {
+		t.Errorf("Serve returned %v, want ErrClosed", err)
+	}
+	if err := await(t, "the evaluation to stop", blockerStopped); err != context.Canceled {
+		t.Errorf("evaluation stopped with %v", err)
+	}
+	<-call.Done
+	if call.Error == nil || call.Error.Error() != ErrClosed.Error() {
+		t.Errorf("response %+v, %v, want ErrClosed", call.Reply, call.Error)
+	}
+
+	// Nothing new is started
+	var resp wire.EvalResponse
+	if err := client.Call("Objective.Evaluate", wire.EvalRequest{X: wire.ToFloats([]float64{1})}, &resp); err == nil || err.Error() != ErrClosed.Error() {
+		t.Errorf("response %+v, %v after Shutdown, want ErrClosed", resp, err)
+	}
+}
+
+func TestRPCServerEvalTimeout(t *testing.T) {
+	s := &RPCServer{Objer: blocker{}, EvalTimeout: 20 * time.Millisecond}
+	client, _ := serveRPC(t, s)
+	var resp wire.EvalResponse
+	if err := client.Call("Objective.Evaluate", wire.EvalRequest{X: wire.ToFloats([]float64{-1})}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != context.DeadlineExceeded.Error() {
+		t.Errorf("response %+v, want the timeout", resp)
+	}
+	<-blockerStarted
+	<-blockerStopped
+	// Shutdown has nothing to wait for
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+}
@@ -1,11 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
 	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/btracey/goexamples/async_optimize/functions"
+	"github.com/btracey/goexamples/async_optimize/wire"
 )
 
 func init() {
@@ -13,10 +26,354 @@ func init() {
 }
 
 func main() {
-	var port string
-	flag.StringVar(&port, "port", "", "tcp port on which to listen")
+	var listen, port string
+	var unix bool
+	var concurrent int
+	var single bool
+	var connect string
+	var certFile, keyFile, caFile, secretFile string
+	var allowlist bool
+	var rpcAddr, objective, params string
+	var jsonRPC, allowShutdown bool
+	var logLevel, logFormat string
+	var quiet bool
+	var health, tags string
+	var grace, evalTimeout time.Duration
+	flag.StringVar(&listen, "listen", "", "address on which to listen, as host:port")
+	flag.StringVar(&port, "port", "", "tcp port on which to listen (same as -listen :port)")
+	flag.BoolVar(&unix, "unix", false, "-listen and -connect are unix socket paths")
+	flag.StringVar(&connect, "connect", "", "address of an optimizer to connect to instead of listening")
+	flag.IntVar(&concurrent, "concurrent", 0, "maximum concurrent evaluations (default number of CPUs)")
+	flag.BoolVar(&single, "single", false, "serve a single connection and exit")
+	flag.StringVar(&certFile, "cert", "", "PEM certificate file; enables TLS")
+	flag.StringVar(&keyFile, "key", "", "PEM private key file for -cert")
+	flag.StringVar(&caFile, "ca", "", "PEM file of authorities trusted to sign client certificates (or the optimizer's, with -connect)")
+	flag.StringVar(&secretFile, "secret", "", "file containing a shared secret clients must know")
+	flag.BoolVar(&allowlist, "allowlist", false, "only run objectives registered by name, not ones sent by clients")
+	flag.StringVar(&rpcAddr, "rpc", "", "serve -objective as a net/rpc service on this address instead")
+	flag.BoolVar(&jsonRPC, "jsonrpc", false, "with -rpc, use JSON-RPC instead of gob")
+	flag.BoolVar(&allowShutdown, "allow-shutdown", false, "with -rpc, let clients shut the server down")
+	flag.StringVar(&objective, "objective", "example", "registered objective for -rpc")
+	flag.StringVar(&params, "params", "", "parameters of -objective, as name=value,name=value")
+	flag.StringVar(&logLevel, "log-level", "info", "least important messages to log: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", "text", "log format: text or json")
+	flag.BoolVar(&quiet, "quiet", false, "only log warnings and errors")
+	flag.StringVar(&tags, "tags", "", "labels sent to clients so they can choose what to send here, as tag,tag")
+	flag.StringVar(&health, "health", "", "address on which to serve an HTTP health check at /healthz")
+	flag.DurationVar(&grace, "grace", 30*time.Second, "how long to let running evaluations finish after SIGINT, SIGTERM or a client's Shutdown")
+	flag.DurationVar(&evalTimeout, "eval-timeout", 0, "longest a single evaluation may take (default no limit)")
 	flag.Parse()
-	receive := &functions.RemoteReceiver{Port: port}
 
-	receive.Do()
+	logger, err := newLogger(logLevel, logFormat, quiet)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	if err := checkFlags(flag.CommandLine, rpcAddr != ""); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if rpcAddr != "" {
+		values, err := parseParams(params)
+		if err != nil {
+			fatal(logger, err)
+		}
+		obj, err := functions.DefaultRegistry.New(objective, values)
+		if err != nil {
+			fatal(logger, err)
+		}
+		server := &functions.RPCServer{
+			Objer:         obj,
+			Name:          objective,
+			MaxConcurrent: concurrent,
+			JSON:          jsonRPC,
+			AllowShutdown: allowShutdown,
+			EvalTimeout:   evalTimeout,
+		}
+		var transport wire.Transport
+		if unix {
+			transport = wire.Unix{}
+		}
+		var config *tls.Config
+		if certFile != "" || caFile != "" {
+			config, err = tlsConfig(certFile, keyFile, caFile, false)
+			if err != nil {
+				fatal(logger, err)
+			}
+		}
+		l, err := wire.Listen(transport, rpcAddr, config)
+		if err != nil {
+			fatal(logger, err)
+		}
+		stopped, stop := shutdownOnSignal(server, grace, logger)
+		logger.Info("serving rpc", "addr", rpcAddr, "objective", objective, "json", jsonRPC)
+		err = server.Serve(l)
+		if err == functions.ErrClosed {
+			// Either a signal or a client shut the server down. In the
+			// second case nothing is waiting for the running evaluations
+			// yet.
+			stop()
+			<-stopped
+			return
+		}
+		fatal(logger, err)
+	}
+
+	listen = listenAddr(listen, port)
+	receive := &functions.RemoteReceiver{
+		Port:          listen,
+		MaxConcurrent: concurrent,
+		EvalTimeout:   evalTimeout,
+		Log:           logger,
+	}
+	if tags != "" {
+		receive.Tags = strings.Split(tags, ",")
+	}
+	if unix {
+		receive.Transport = wire.Unix{}
+	}
+	if allowlist {
+		receive.Registry = functions.DefaultRegistry
+	}
+
+	if certFile != "" || caFile != "" {
+		config, err := tlsConfig(certFile, keyFile, caFile, connect != "")
+		if err != nil {
+			fatal(logger, err)
+		}
+		receive.TLSConfig = config
+	}
+	if secretFile != "" {
+		secret, err := readSecret(secretFile)
+		if err != nil {
+			fatal(logger, err)
+		}
+		receive.Secret = secret
+	}
+
+	if health != "" {
+		go func() {
+			err := serveHealth(health, receive)
+			fatal(logger, err)
+		}()
+	}
+	stopped, _ := shutdownOnSignal(receive, grace, logger)
+
+	switch {
+	case connect != "":
+		logger.Info("connecting", "addr", connect)
+		err = receive.Connect(connect)
+	case single:
+		logger.Info("listening for a single client", "addr", listen)
+		receive.Do()
+	default:
+		logger.Info("listening", "addr", listen)
+		err = receive.Serve()
+	}
+	if receive.Stats().Closing {
+		// Serve returns as soon as the listener is closed, but the running
+		// evaluations may still be finishing. Being told to stop is not a
+		// failure of the server.
+		<-stopped
+		return
+	}
+	if err != nil {
+		fatal(logger, err)
+	}
+}
+
+// receiverFlags only apply to the RemoteReceiver, and rpcFlags only to -rpc
+var (
+	receiverFlags = []string{"listen", "port", "connect", "single", "secret", "allowlist", "tags", "health"}
+	rpcFlags      = []string{"jsonrpc", "objective", "params", "allow-shutdown"}
+)
+
+// checkFlags returns an error if a flag was set which does not apply to the
+// kind of server being run, rather than ignoring it
+func checkFlags(fs *flag.FlagSet, rpc bool) error {
+	unused := rpcFlags
+	mode := "without -rpc"
+	if rpc {
+		unused = receiverFlags
+		mode = "with -rpc"
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, name := range unused {
+			if f.Name == name && err == nil {
+				err = fmt.Errorf("-%s can not be used %s", name, mode)
+			}
+		}
+	})
+	return err
+}
+
+// listenAddr returns the address to listen on. -port used to be the only way
+// to say where to listen, and was passed straight through, so both "2000" and
+// ":2000" are accepted.
+func listenAddr(listen, port string) string {
+	if listen != "" || port == "" {
+		return listen
+	}
+	if !strings.Contains(port, ":") {
+		return ":" + port
+	}
+	return port
+}
+
+// newLogger creates the logger described by the flags
+func newLogger(level, format string, quiet bool) (*slog.Logger, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("bad -log-level %q", level)
+	}
+	if quiet && l < slog.LevelWarn {
+		l = slog.LevelWarn
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("bad -log-format %q", format)
+}
+
+func fatal(logger *slog.Logger, err error) {
+	logger.Error(err.Error())
+	os.Exit(1)
+}
+
+// A shutdowner is a RemoteReceiver or an RPCServer
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// shutdownOnSignal shuts the server down when the process is sent SIGINT or
+// SIGTERM, or when the returned function is called, giving the running
+// evaluations up to grace to finish. A second signal gives up waiting straight
+// away. The returned channel is closed once the server has shut down.
+func shutdownOnSignal(server shutdowner, grace time.Duration, logger *slog.Logger) (<-chan struct{}, func()) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	requested := make(chan struct{}, 1)
+	go func() {
+		defer close(stopped)
+		var args []interface{}
+		select {
+		case sig := <-sigs:
+			args = []interface{}{"signal", sig.String()}
+		case <-requested:
+			args = []interface{}{"requested", "client"}
+		}
+		if receive, ok := server.(*functions.RemoteReceiver); ok {
+			stats := receive.Stats()
+			args = append(args, "connections", stats.Connections, "running", stats.Running)
+		}
+		logger.Info("shutting down", args...)
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		go func() {
+			select {
+			case sig := <-sigs:
+				logger.Warn("canceling running evaluations", "signal", sig.String())
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			logger.Warn("running evaluations canceled", "err", err)
+		} else {
+			logger.Info("shut down")
+		}
+	}()
+	stop := func() {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+	}
+	return stopped, stop
+}
+
+// serveHealth serves the receiver's statistics as JSON at /healthz. The status
+// is 503 once the receiver is shutting down, so load balancers stop sending it
+// clients.
+func serveHealth(addr string, receive *functions.RemoteReceiver) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		stats := receive.Stats()
+		w.Header().Set("Content-Type", "application/json")
+		if stats.Closing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(stats)
+	})
+	return http.ListenAndServe(addr, mux)
+}
+
+// tlsConfig reads the files and creates the TLS configuration. When connecting
+// to an optimizer, the server is the TLS client.
+func tlsConfig(certFile, keyFile, caFile string, client bool) (*tls.Config, error) {
+	var certPEM, keyPEM, caPEM []byte
+	var err error
+	if certFile != "" {
+		certPEM, err = ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err = ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if caFile != "" {
+		caPEM, err = ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if client {
+		return wire.ClientTLS(caPEM, certPEM, keyPEM)
+	}
+	return wire.ServerTLS(certPEM, keyPEM, caPEM)
+}
+
+// readSecret reads the shared secret from the file. Surrounding white space,
+// like the newline an editor adds, is not part of it.
+func readSecret(file string) ([]byte, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(b)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret file %s is empty", file)
+	}
+	return secret, nil
+}
+
+// parseParams parses the parameters of -objective, given as
+// name=value,name=value
+func parseParams(params string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, kv := range strings.Split(params, ",") {
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("parameter %q is not name=value", kv)
+		}
+		values[kv[:i]] = kv[i+1:]
+	}
+	return values, nil
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenAddr(t *testing.T) {
+	for _, test := range []struct {
+		listen, port, want string
+	}{
+		{"", "2000", ":2000"},
+		{"", ":2000", ":2000"},
+		{"", "localhost:2000", "localhost:2000"},
+		{"host:3000", "2000", "host:3000"},
+		{"", "", ""},
+	} {
+		if got := listenAddr(test.listen, test.port); got != test.want {
+			t.Errorf("listenAddr(%q, %q) = %q, want %q", test.listen, test.port, got, test.want)
+		}
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		level, format string
+		quiet         bool
+		want          slog.Level // Least important level logged
+	}{
+		{"info", "text", false, slog.LevelInfo},
+		{"debug", "json", false, slog.LevelDebug},
+		{"DEBUG", "text", true, slog.LevelWarn},
+		{"error", "text", true, slog.LevelError},
+	} {
+		l, err := newLogger(test.level, test.format, test.quiet)
+		if err != nil {
+			t.Errorf("%+v: %v", test, err)
+			continue
+		}
+		if !l.Enabled(ctx, test.want) || l.Enabled(ctx, test.want-1) {
+			t.Errorf("%+v: wrong level", test)
+		}
+	}
+	if _, err := newLogger("loud", "text", false); err == nil {
+		t.Error("bad level accepted")
+	}
+	if _, err := newLogger("info", "xml", false); err == nil {
+		t.Error("bad format accepted")
+	}
+}
+
+func TestCheckFlags(t *testing.T) {
+	for _, test := range []struct {
+		args []string
+		rpc  bool
+		ok   bool
+	}{
+		{[]string{"-listen", ":2000", "-unix"}, false, true},
+		{[]string{"-objective", "example"}, false, false},
+		{[]string{"-rpc", ":2000", "-objective", "example", "-jsonrpc", "-unix"}, true, true},
+		{[]string{"-rpc", ":2000", "-listen", ":3000"}, true, false},
+		{[]string{"-rpc", ":2000", "-health", ":8080"}, true, false},
+		{[]string{"-rpc", ":2000", "-secret", "file"}, true, false},
+		{[]string{"-rpc", ":2000", "-allow-shutdown"}, true, true},
+		{[]string{"-listen", ":2000", "-allow-shutdown"}, false, false},
+	} {
+		fs := flag.NewFlagSet("server", flag.ContinueOnError)
+		for _, name := range []string{"rpc", "listen", "objective", "health", "secret"} {
+			fs.String(name, "", "")
+		}
+		fs.Bool("unix", false, "")
+		fs.Bool("jsonrpc", false, "")
+		fs.Bool("allow-shutdown", false, "")
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		err := checkFlags(fs, test.rpc)
+		if (err == nil) != test.ok {
+			t.Errorf("%v: error %v", test.args, err)
+		}
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	values, err := parseParams("a=1,b=x=y,,c=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || values["a"] != "1" || values["b"] != "x=y" || values["c"] != "" {
+		t.Errorf("parameters %v", values)
+	}
+	if _, err := parseParams("a"); err == nil {
+		t.Error("parameter without a value accepted")
+	}
+}
+
+func TestReadSecret(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secret")
+	for _, test := range []struct {
+		contents, want string
+	}{
+		{"hunter2", "hunter2"},
+		{"hunter2\n", "hunter2"},
+		{" hunter2\r\n", "hunter2"},
+		{"\n", ""},
+		{"", ""},
+	} {
+		if err := os.WriteFile(file, []byte(test.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		secret, err := readSecret(file)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q: empty secret accepted", test.contents)
+			}
+			continue
+		}
+		if err != nil || string(secret) != test.want {
+			t.Errorf("%q: secret %q, error %v, want %q", test.contents, secret, err, test.want)
+		}
+	}
+	if _, err := readSecret(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing file accepted")
+	}
+}
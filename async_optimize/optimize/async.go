@@ -1,11 +1,18 @@
 package optimize
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"math"
+	"net"
+	"sync"
+	"time"
 
+	"github.com/btracey/goexamples/async_optimize/functions"
 	"github.com/btracey/goexamples/async_optimize/optimize/controller"
+	"github.com/btracey/goexamples/async_optimize/wire"
 )
 
 // Instead of evaluating in batches, let's instead evaluate them asyncronously
@@ -44,17 +51,52 @@ type LocalWorker struct {
 
 	Output bool
 	quit   <-chan bool // Channel to signal closure of the goroutine upon completion
+
+	// Timeout is the longest an evaluation may take. Only an ObjContexter
+	// can be interrupted, other objective functions always run to the end.
+	Timeout time.Duration
+
+	Tags []string // Labels for the Scheduler, see Capabilities
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // Cancels the context of every evaluation
+	ctx    context.Context
+	caps   wire.Capabilities
 }
 
-func (l *LocalWorker) Init(read <-chan []float64, write chan<- Ans, fun Objer, quit <-chan bool) {
+func (l *LocalWorker) Init(read <-chan []float64, write chan<- Ans, fun Objer, quit <-chan bool) error {
 	l.read = read
 	l.write = write
 	l.fun = fun
 	l.quit = quit
+	l.mu.Lock()
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	l.caps = wire.LocalCapabilities(l.Tags...)
+	l.caps.Slots = 1
+	l.mu.Unlock()
+	return nil
+}
+
+// Cancel interrupts the evaluation in progress if the objective function is an
+// ObjContexter
+func (l *LocalWorker) Cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cancel != nil {
+		l.cancel()
+	}
+}
+
+// Capabilities describes the local machine, as found by Init. A LocalWorker
+// evaluates one point at a time.
+func (l *LocalWorker) Capabilities() wire.Capabilities {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.caps
 }
 
 // Run runs the worker
-func (w *LocalWorker) Run() {
+func (w *LocalWorker) Run() error {
 	if w.Output {
 		fmt.Printf("worker %d launched\n", w.Id)
 	}
@@ -72,8 +114,7 @@ OuterLoop:
 		case x := <-w.read:
 			// If it gets a case to run, evaluate the objective function and then
 			// send the answer back
-			obj := w.fun.Obj(x)
-			w.write <- Ans{Loc: x, Obj: obj}
+			w.write <- w.evaluate(x)
 			if w.Output {
 				fmt.Printf("worker %d finished running\n", w.Id)
 			}
@@ -85,65 +126,248 @@ OuterLoop:
 	if w.Output {
 		fmt.Printf("worker %d quit\n", w.Id)
 	}
+	return nil
+}
+
+// evaluate evaluates the point, with the timeout if there is one
+func (w *LocalWorker) evaluate(x []float64) Ans {
+	w.mu.Lock()
+	parent := w.ctx
+	w.mu.Unlock()
+	ctx := parent
+	if w.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, w.Timeout)
+		defer cancel()
+	}
+	ans := evaluate(ctx, w.fun, x)
+	if ans.Err != nil && parent.Err() != nil {
+		// Interrupted by Cancel, which is not the point's fault
+		ans.Err = &WorkerError{Id: w.Id, Err: parent.Err()}
+	}
+	return ans
+}
+
+// ObjContexter is an objective function which can be interrupted. It is the
+// same interface as functions.ObjContexter, so one objective function can be
+// interrupted both locally and on a server. The evaluation should stop and
+// return an error soon after the context is done, which happens if the
+// evaluation takes longer than the worker's timeout or Async stops waiting for
+// it (see Async.OptimizeContext). LocalWorker calls ObjCtx instead of Obj. A
+// constrained or multi-objective function is called with ObjConsCtx or ObjsCtx
+// instead, if it has them:
+//
+//	ObjConsCtx(ctx context.Context, x []float64) (float64, []float64, error)
+//	ObjsCtx(ctx context.Context, x []float64) ([]float64, error)
+type ObjContexter = functions.ObjContexter
+
+// ErrObjer is an objective function which can report that it failed at a
+// point, for example because a simulation did not converge. LocalWorker calls
+// ObjErr instead of Obj, and a non-nil error is passed to Async in Ans.Err.
+type ErrObjer interface {
+	Objer
+	ObjErr([]float64) (float64, error)
 }
 
-// A Worker is control device for the concurrent evaluation of an objective function
+// evaluate calls the objective function at x (see functions.Evaluate)
+func evaluate(ctx context.Context, fun Objer, x []float64) Ans {
+	r, err := functions.Evaluate(ctx, fun, x)
+	if err != nil {
+		return Ans{Loc: x, Err: err}
+	}
+	return Ans{Loc: x, Obj: r.Obj, Cons: r.Cons, Objs: r.Objs}
+}
+
+// A Worker is control device for the concurrent evaluation of an objective function.
+//
+// If Init returns an error, the worker is not used. If the worker can no longer
+// evaluate points, Run should return the reason. A worker that stops in the
+// middle of an evaluation should first send back the point with a
+// *WorkerError in Ans.Err, so that Async can give it to another worker (see
+// Async.MaxResends).
 type Worker interface {
-	Init(read <-chan []float64, write chan<- Ans, fun Objer, quit <-chan bool)
-	Run() // Launches the process
+	Init(read <-chan []float64, write chan<- Ans, fun Objer, quit <-chan bool) error
+	Run() error // Launches the process
+}
+
+// WorkerError is the error in Ans.Err when a worker could not finish an
+// evaluation because of a problem with the worker itself (for example, a
+// broken connection) rather than with the point
+type WorkerError struct {
+	Id  int // ID of the worker
+	Err error
+}
+
+func (w *WorkerError) Error() string {
+	return fmt.Sprintf("worker %d: %v", w.Id, w.Err)
 }
 
 // Async is an optimizer which makes concurrent calls to the objective function
 // Assumes the objective function is parallelizable
 type Async struct {
-	MaxFunEvals   int // Maximum number of allowed function evaluations
-	NumDim        int // Dimension of the problem
-	numConcurrent int // How many to evaluate concurrently
-	PrintReturns  bool
+	MaxFunEvals  int // Maximum number of allowed function evaluations
+	NumDim       int // Dimension of the problem
+	PrintReturns bool
 
 	Controller controller.C // Controller for the next function location to evaluate
 
 	Workers []Worker
 
-	bestObj float64
-	bestLoc []float64
-
-	toWorker   chan<- []float64
-	fromWorker <-chan Ans
-	quitWorker chan bool
+	// MaxResends is the number of times a point is given to another worker
+	// after a worker failed while evaluating it (default 3, negative for
+	// none). A point which keeps breaking workers may be the cause, so after
+	// that it is treated as a point the objective failed at.
+	MaxResends int
+
+	// Scheduler chooses which worker each point is sent to (default Fastest)
+	Scheduler Scheduler
+
+	// If Listen is set, Async listens on the address for remote evaluators
+	// (see functions.RemoteReceiver.Connect) and adds each one that connects
+	// as a worker. Workers may then be empty.
+	Listen string
+
+	// ListenTransport is how to listen on Listen (default TCP). ListenTLS and
+	// ListenSecret secure the connections made to Listen. See
+	// RemoteWorker.TLSConfig and RemoteWorker.Secret.
+	ListenTransport wire.Transport
+	ListenTLS       *tls.Config
+	ListenSecret    []byte
+
+	bestObj  float64
+	bestLoc  []float64
+	bestCons []float64
+	found    bool           // Whether there is a best point yet
+	lastErr  error          // Error of the last point the objective function failed at
+	pareto   *ParetoArchive // Non-dominated set for multi-objective functions
+	nObjs    int            // Number of objectives, once a MultiObjer has answered
+
+	mu      sync.Mutex // Protects running and Workers
+	running bool
+
+	pool       map[*poolEntry]bool // Workers which have not yet stopped
+	started    []*poolEntry        // Every worker started, in order
+	nSlots     int                 // Number of points the ready workers which are not draining can take
+	candidates []*poolEntry        // Workers passed to the Scheduler
+	infos      []WorkerInfo        // What the Scheduler is told about them
+	workerErrs []error             // Errors from workers that stopped
+	live       sync.WaitGroup      // Worker goroutines, which can outlive a canceled run
+
+	fromWorker   chan workerAns
+	workerReady  chan workerReady
+	workerDone   chan workerDone
+	addWorker    chan Worker
+	removeWorker chan Worker
+	quitWorker   chan bool // Closed when Optimize finishes
+	listener     net.Listener
 
 	fun Objer
 }
 
 func (async *Async) init() {
-	async.numConcurrent = len(async.Workers)
+	async.pool = make(map[*poolEntry]bool)
+	async.started = nil
+	async.nSlots = 0
+	async.workerErrs = nil
 	// Allocate memory
 	async.bestObj = math.Inf(1)
 	async.bestLoc = make([]float64, async.NumDim)
-
-	// Create the communication channels
-	toWorker := make(chan []float64)
-	fromWorker := make(chan Ans)
+	async.bestCons = nil
+	async.found = false
+	async.lastErr = nil
+	async.pareto = &ParetoArchive{}
+	async.nObjs = 0
+
+	// Create the communication channels. Each worker also gets its own
+	// channel of points when it is started.
+	fromWorker := make(chan workerAns)
 	quit := make(chan bool)
 
-	async.toWorker = toWorker
 	async.fromWorker = fromWorker
+	async.workerReady = make(chan workerReady)
+	async.workerDone = make(chan workerDone)
+	async.addWorker = make(chan Worker)
+	async.removeWorker = make(chan Worker)
 	async.quitWorker = quit
 
 	for _, worker := range async.Workers {
-		go func(worker Worker) {
-			worker.Init(toWorker, fromWorker, async.fun, quit)
-
-			worker.Run()
-		}(worker)
+		async.startWorker(worker)
 	}
 }
 
 func (async *Async) updateBest(ans Ans) {
-	if ans.Obj < async.bestObj {
+	// The first point is the best so far whatever it is. Otherwise an
+	// infeasible point could never replace the starting value, which
+	// looks feasible.
+	best := Ans{Obj: async.bestObj, Cons: async.bestCons}
+	if !async.found || ans.better(best) {
+		async.found = true
 		async.bestObj = ans.Obj
 		copy(async.bestLoc, ans.Loc)
+		async.bestCons = append(async.bestCons[:0], ans.Cons...)
+	}
+	if ans.Objs != nil {
+		async.nObjs = len(ans.Objs)
+		async.pareto.Add(ans)
+	}
+}
+
+// addToController gives the result to the controller
+func (async *Async) addToController(ans Ans) {
+	if c, ok := async.Controller.(ConstrainedAdder); ok && ans.Cons != nil {
+		c.AddConstrained(ans.Loc, ans.Obj, ans.Cons)
+		return
+	}
+	if m, ok := async.Controller.(MultiAdder); ok && ans.Objs != nil {
+		m.AddMulti(ans.Loc, ans.Objs)
+		return
+	}
+	async.Controller.Add(ans.Loc, ans.Obj)
+}
+
+// addFailed tells the controller that the objective could not be evaluated at
+// loc, by giving it a result which is as bad as possible in the form the
+// controller uses. A MultiAdder is given an infinite value in every objective,
+// or through Add if no point has been evaluated yet to say how many objectives
+// there are.
+func (async *Async) addFailed(loc []float64) {
+	if c, ok := async.Controller.(ConstrainedAdder); ok {
+		c.AddConstrained(loc, math.Inf(1), []float64{math.Inf(1)})
+		return
+	}
+	if m, ok := async.Controller.(MultiAdder); ok && async.nObjs > 0 {
+		objs := make([]float64, async.nObjs)
+		for i := range objs {
+			objs[i] = math.Inf(1)
+		}
+		m.AddMulti(loc, objs)
+		return
+	}
+	async.Controller.Add(loc, math.Inf(1))
+}
+
+// WorkerErrors returns the errors of the workers that stopped during the last
+// call to Optimize
+func (async *Async) WorkerErrors() []error {
+	return async.workerErrs
+}
+
+// WorkerStats returns what is known about each worker used during the last
+// call to Optimize, in the order they were started
+func (async *Async) WorkerStats() []WorkerInfo {
+	infos := make([]WorkerInfo, len(async.started))
+	for i, entry := range async.started {
+		infos[i] = entry.info()
 	}
+	return infos
+}
+
+// Pareto returns the archive of non-dominated points found during the last
+// call to Optimize. The archive is only filled if the objective function is a
+// MultiObjer, in which case the answer returned by Optimize is the best point
+// in the first objective.
+func (async *Async) Pareto() *ParetoArchive {
+	return async.pareto
 }
 
 // Initer is a controller that can requires initialization
@@ -151,19 +375,54 @@ type Initer interface {
 	Init(nDim int)
 }
 
+// Optimize runs the optimization until MaxFunEvals evaluations are done. If
+// the objective function failed at every point, the error wraps the last
+// point's error.
 func (async *Async) Optimize(fun Objer) (Ans, error) {
+	return async.OptimizeContext(context.Background(), fun)
+}
+
+// OptimizeContext runs the optimization until MaxFunEvals evaluations are done
+// or the context is done. In the second case the evaluations that are running
+// are canceled (see Canceler and ObjContexter), and the best point found so far
+// is returned along with the context's error. OptimizeContext returns without
+// waiting for the workers to stop, but the next call waits for them.
+func (async *Async) OptimizeContext(ctx context.Context, fun Objer) (Ans, error) {
 	if async.NumDim <= 0 {
 		return Ans{}, errors.New("async: NumDim non-positive")
 	}
 	if async.MaxFunEvals <= 0 {
 		return Ans{}, errors.New("async: MaxFunEvals non-positive")
 	}
-	if len(async.Workers) == 0 {
-		return Ans{}, errors.New("async: Length of workers is zero")
-	}
+
+	// Workers from a canceled run may still be finishing an evaluation
+	// which could not be interrupted. They can't be started again until
+	// they are done.
+	async.live.Wait()
 
 	async.fun = fun
+	async.mu.Lock()
+	if len(async.Workers) == 0 && async.Listen == "" {
+		async.mu.Unlock()
+		return Ans{}, errors.New("async: Length of workers is zero")
+	}
 	async.init()
+	async.running = true
+	async.mu.Unlock()
+	defer func() {
+		async.mu.Lock()
+		async.running = false
+		async.mu.Unlock()
+	}()
+
+	if async.Listen != "" {
+		err := async.listen()
+		if err != nil {
+			async.stopWorkers()
+			return Ans{}, err
+		}
+		defer async.listener.Close()
+	}
 
 	// Check if the controller is an initer
 	initer, ok := async.Controller.(Initer)
@@ -173,41 +432,151 @@ func (async *Async) Optimize(fun Objer) (Ans, error) {
 
 	nDim := async.NumDim
 
-	// Give an initial function to each worker
-	for i := 0; i < async.numConcurrent; i++ {
-		xnext := make([]float64, nDim)
-		async.Controller.Next(xnext)
-		async.toWorker <- xnext // The workers are executing concurrently and will read from the channel
+	// Workers can fail, so instead of assuming every point sent out comes back
+	// with an answer, keep track of what is happening. Points whose worker
+	// failed go on the retry list and are sent to one of the remaining workers.
+	var (
+		nFunEvals int         // Number of evaluations started
+		inFlight  int         // Number of points currently with a worker
+		retry     [][]float64 // Points which need to be sent again
+		xnext     []float64   // Point waiting to be sent
+		spare     []float64   // Memory from a returned point which can be reused
+
+		// Times each point has been given to another worker after a worker
+		// failed at it, keyed by the point's memory
+		resends = make(map[*float64]int)
+	)
+	maxResends := async.MaxResends
+	if maxResends == 0 {
+		maxResends = 3
 	}
-	// That's it!
-	nFunEvals := async.numConcurrent
-	for nFunEvals < async.MaxFunEvals {
-		// Wait to read from a solution
-		ans := <-async.fromWorker
+	for {
+		if xnext == nil {
+			switch {
+			case len(retry) > 0:
+				xnext = retry[len(retry)-1]
+				retry = retry[:len(retry)-1]
+			case nFunEvals < async.MaxFunEvals && inFlight < async.nSlots:
+				// Get the next location to evaluate (reuse the memory to avoid allocations)
+				xnext = spare
+				spare = nil
+				if xnext == nil {
+					xnext = make([]float64, nDim)
+				}
+				async.Controller.Next(xnext)
+				nFunEvals++
+			}
+		}
+		if xnext == nil && inFlight == 0 && nFunEvals >= async.MaxFunEvals {
+			// All of the evaluations are done
+			break
+		}
+		if len(async.pool) == 0 && async.Listen == "" {
+			async.stopWorkers()
+			if len(async.workerErrs) == 0 {
+				return async.result(), errors.New("async: no workers left")
+			}
+			return async.result(), fmt.Errorf("async: all workers failed: %v", async.workerErrs[len(async.workerErrs)-1])
+		}
 
-		async.updateBest(ans)
+		if xnext != nil {
+			if entry := async.schedule(xnext); entry != nil {
+				// The workers are executing concurrently and will read from
+				// their channels. The worker has a free slot, so there is
+				// room in its channel and this does not block.
+				entry.in <- xnext
+				entry.sent()
+				inFlight++
+				xnext = nil
+				continue
+			}
+			if inFlight == 0 && async.Listen == "" && async.settled() {
+				// Nothing is going to change the Scheduler's mind
+				async.stopWorkers()
+				return async.result(), errors.New("async: scheduler sends the point to none of the workers")
+			}
+		}
 
-		// Add the answer to the nexter
-		async.Controller.Add(ans.Loc, ans.Obj)
-		// Get the next location to evaluate (reuse the memory to avoid allocations)
-		xnext := ans.Loc
-		async.Controller.Next(xnext)
+		// Wait for something to happen
+		select {
+		case wa := <-async.fromWorker:
+			inFlight--
+			if n := len(wa.ans.Objs); wa.ans.Err == nil && n > 0 && async.nObjs > 0 && n != async.nObjs {
+				// Can't be compared with the points so far
+				wa.ans.Err = fmt.Errorf("async: objective function returned %d objectives, not %d", n, async.nObjs)
+			}
+			wa.entry.received(wa)
+			ans := wa.ans
+			if wa.returned {
+				// The worker stopped before reading the point
+				retry = append(retry, ans.Loc)
+				continue
+			}
+			if _, ok := ans.Err.(*WorkerError); ok {
+				// Probably not the point's fault, so try it again
+				// elsewhere. If it keeps happening the point may be the
+				// problem after all.
+				key := &ans.Loc[0]
+				if resends[key] < maxResends {
+					resends[key]++
+					retry = append(retry, ans.Loc)
+					continue
+				}
+			}
+			// The point is finished with, and its memory may be reused
+			delete(resends, &ans.Loc[0])
+			if ans.Err != nil {
+				// The objective could not be evaluated at this point. Tell
+				// the controller that it is as bad as possible.
+				async.lastErr = ans.Err
+				async.addFailed(ans.Loc)
+				spare = ans.Loc
+				continue
+			}
+			async.updateBest(ans)
+			// Add the answer to the nexter
+			async.addToController(ans)
+			spare = ans.Loc
+		case ready := <-async.workerReady:
+			async.workerInitialized(ready)
+		case done := <-async.workerDone:
+			for _, x := range async.workerStopped(done) {
+				inFlight--
+				retry = append(retry, x)
+			}
+		case worker := <-async.addWorker:
+			async.startWorker(worker)
+		case worker := <-async.removeWorker:
+			async.drainWorker(worker)
+		case <-ctx.Done():
+			async.stopWorkers()
+			// Every point a worker has read comes back, even if it was
+			// canceled, and the workers wait until it is received. Nobody
+			// here wants the answers any more, so throw them away.
+			go func(fromWorker <-chan workerAns, n int) {
+				for i := 0; i < n; i++ {
+					<-fromWorker
+				}
+			}(async.fromWorker, inFlight)
+			return async.result(), ctx.Err()
+		}
+	}
+	// The worker goroutines are all still running, so shut them all down.
+	async.stopWorkers()
 
-		// Send the new location to a free worker
-		async.toWorker <- xnext
-		nFunEvals++
+	best := async.result()
+	if !async.found {
+		return best, fmt.Errorf("async: objective function failed at every point: %w", async.lastErr)
 	}
-	// Read the final returns from the workers
-	for i := 0; i < async.numConcurrent; i++ {
-		ans := <-async.fromWorker
-		async.Controller.Add(ans.Loc, ans.Obj)
-		async.updateBest(ans)
+	if !best.Feasible() {
+		return best, errors.New("async: no feasible point found")
 	}
-	// The worker goroutines are all still running, so shut them all down.
-	// In select, can always read from a closed channel, so this is enough
-	close(async.quitWorker)
+	return best, nil
+}
 
+// result returns the best point found
+func (async *Async) result() Ans {
 	xbest := make([]float64, async.NumDim)
 	copy(xbest, async.bestLoc)
-	return Ans{Loc: xbest, Obj: async.bestObj}, nil
+	return Ans{Loc: xbest, Obj: async.bestObj, Cons: async.bestCons}
 }
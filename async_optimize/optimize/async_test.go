@@ -0,0 +1,399 @@
+package optimize
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/btracey/goexamples/async_optimize/optimize/controller"
+)
+
+// sphere is the sum of squares
+type sphere struct{}
+
+func (sphere) Obj(x []float64) float64 {
+	var sum float64
+	for _, v := range x {
+		sum += v * v
+	}
+	return sum
+}
+
+// counter samples from a normal distribution and remembers every result
+type counter struct {
+	locs [][]float64
+	objs []float64
+}
+
+func (c *counter) Next(x []float64) {
+	for i := range x {
+		x[i] = rand.NormFloat64()
+	}
+}
+
+func (c *counter) Add(x []float64, obj float64) {
+	c.locs = append(c.locs, append([]float64(nil), x...))
+	c.objs = append(c.objs, obj)
+}
+
+// flaky evaluates n points and then breaks in the middle of the next one
+type flaky struct {
+	n     int
+	read  <-chan []float64
+	write chan<- Ans
+	fun   Objer
+	quit  <-chan bool
+}
+
+var errBroken = errors.New("broken")
+
+func (f *flaky) Init(read <-chan []float64, write chan<- Ans, fun Objer, quit <-chan bool) error {
+	f.read, f.write, f.fun, f.quit = read, write, fun, quit
+	return nil
+}
+
+func (f *flaky) Run() error {
+	for i := 0; ; i++ {
+		select {
+		case x := <-f.read:
+			if i == f.n {
+				f.write <- Ans{Loc: x, Err: &WorkerError{Err: errBroken}}
+				return errBroken
+			}
+			f.write <- Ans{Loc: x, Obj: f.fun.Obj(x)}
+		case <-f.quit:
+			return nil
+		}
+	}
+}
+
+// badInit can't be initialized
+type badInit struct{}
+
+func (badInit) Init(read <-chan []float64, write chan<- Ans, fun Objer, quit <-chan bool) error {
+	return errBroken
+}
+
+func (badInit) Run() error {
+	panic("run after Init failed")
+}
+
+// firstFree sends every point to the first free worker
+type firstFree struct{}
+
+func (firstFree) Schedule(x []float64, workers []WorkerInfo) int {
+	for i, w := range workers {
+		if w.Free() {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestWorkerFailureRetried(t *testing.T) {
+	c := &counter{}
+	flaky := &flaky{n: 5}
+	async := &Async{
+		MaxFunEvals: 100,
+		NumDim:      2,
+		Workers:     []Worker{flaky, &LocalWorker{}, badInit{}},
+		Controller:  c,
+		Scheduler:   firstFree{},
+	}
+	ans, err := async.Optimize(sphere{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The point the flaky worker broke on was evaluated by the other worker,
+	// so nothing is lost or counted twice
+	if len(c.objs) != 100 {
+		t.Errorf("controller got %d results, want 100", len(c.objs))
+	}
+	for i, obj := range c.objs {
+		if obj != (sphere{}).Obj(c.locs[i]) {
+			t.Errorf("result %v at %v is not the objective", obj, c.locs[i])
+		}
+	}
+	if ans.Obj != (sphere{}).Obj(ans.Loc) {
+		t.Errorf("best answer %v is not the objective", ans)
+	}
+	errs := async.WorkerErrors()
+	if len(errs) != 2 || errs[0] != errBroken || errs[1] != errBroken {
+		t.Errorf("worker errors %v, want the two broken workers", errs)
+	}
+	stats := async.WorkerStats()
+	if stats[0].Evaluations+stats[1].Evaluations != 100 || stats[0].Evaluations != flaky.n {
+		t.Errorf("worker stats %+v, want 5 evaluations from the flaky worker", stats)
+	}
+}
+
+// poisoned breaks in the middle of any point with x0 > 2
+type poisoned struct {
+	flaky
+	broken bool
+}
+
+func (p *poisoned) Run() error {
+	for {
+		select {
+		case x := <-p.read:
+			if x[0] > 2 {
+				p.broken = true
+				p.write <- Ans{Loc: x, Err: &WorkerError{Err: errBroken}}
+				return errBroken
+			}
+			p.write <- Ans{Loc: x, Obj: p.fun.Obj(x)}
+		case <-p.quit:
+			return nil
+		}
+	}
+}
+
+// oncePoisoned proposes one point which breaks poisoned workers, and then
+// points which don't
+type oncePoisoned struct {
+	counter
+	sent bool
+}
+
+func (o *oncePoisoned) Next(x []float64) {
+	for i := range x {
+		x[i] = 2*rand.Float64() - 1
+	}
+	if !o.sent {
+		x[0] = 3
+		o.sent = true
+	}
+}
+
+func TestMaxResends(t *testing.T) {
+	c := &oncePoisoned{}
+	workers := make([]Worker, 4)
+	for i := range workers {
+		workers[i] = &poisoned{}
+	}
+	async := &Async{
+		MaxFunEvals: 50,
+		NumDim:      2,
+		MaxResends:  2,
+		Workers:     workers,
+		Controller:  c,
+	}
+	_, err := async.Optimize(sphere{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The point is tried on three workers, and then given up on
+	var broken int
+	for _, w := range workers {
+		if w.(*poisoned).broken {
+			broken++
+		}
+	}
+	if broken != 3 {
+		t.Errorf("%d workers broken, want 3", broken)
+	}
+	if len(c.objs) != 50 {
+		t.Errorf("controller got %d results, want 50", len(c.objs))
+	}
+	for i, obj := range c.objs {
+		if (c.locs[i][0] > 2) != math.IsInf(obj, 1) {
+			t.Errorf("result %v at %v", obj, c.locs[i])
+		}
+	}
+}
+
+func TestAllWorkersFailed(t *testing.T) {
+	async := &Async{
+		MaxFunEvals: 100,
+		NumDim:      2,
+		Workers:     []Worker{&flaky{n: 3}, &flaky{n: 4}},
+		Controller:  &counter{},
+	}
+	_, err := async.Optimize(sphere{})
+	if err == nil || !strings.Contains(err.Error(), "all workers failed") {
+		t.Errorf("error %v, want all workers failed", err)
+	}
+}
+
+// halfBroken fails at points with a negative first element
+type halfBroken struct{}
+
+func (halfBroken) Obj(x []float64) float64 {
+	return (sphere{}).Obj(x)
+}
+
+func (halfBroken) ObjErr(x []float64) (float64, error) {
+	if x[0] < 0 {
+		return 0, errBroken
+	}
+	return (sphere{}).Obj(x), nil
+}
+
+// brokenObjer fails at every point
+type brokenObjer struct{}
+
+func (brokenObjer) Obj(x []float64) float64 { return 0 }
+
+func (brokenObjer) ObjErr(x []float64) (float64, error) { return 0, errBroken }
+
+func TestObjectiveErrors(t *testing.T) {
+	c := &counter{}
+	async := &Async{
+		MaxFunEvals: 200,
+		NumDim:      2,
+		Workers:     localWorkers(2),
+		Controller:  c,
+	}
+	ans, err := async.Optimize(halfBroken{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A failed point is not the worker's fault, so it is not tried again,
+	// and the controller is told it is as bad as possible
+	if len(c.objs) != 200 {
+		t.Errorf("controller got %d results, want 200", len(c.objs))
+	}
+	for i, obj := range c.objs {
+		if (c.locs[i][0] < 0) != math.IsInf(obj, 1) {
+			t.Errorf("result %v at %v", obj, c.locs[i])
+		}
+	}
+	if ans.Loc[0] < 0 || math.IsInf(ans.Obj, 0) {
+		t.Errorf("best answer %v is a failed point", ans)
+	}
+	var failures int
+	for _, w := range async.WorkerStats() {
+		failures += w.Failures
+	}
+	if failures == 0 || failures == 200 {
+		t.Errorf("%d failures counted", failures)
+	}
+	if len(async.WorkerErrors()) != 0 {
+		t.Errorf("workers stopped because the objective failed: %v", async.WorkerErrors())
+	}
+}
+
+func TestEveryPointFails(t *testing.T) {
+	async := &Async{
+		MaxFunEvals: 20,
+		NumDim:      2,
+		Workers:     localWorkers(2),
+		Controller:  &counter{},
+	}
+	_, err := async.Optimize(brokenObjer{})
+	if !errors.Is(err, errBroken) {
+		t.Errorf("error %v, want the objective's error", err)
+	}
+}
+
+// brokenObjectives is twoObjectives, but fails at points with x0 > 1
+type brokenObjectives struct{ twoObjectives }
+
+func (b brokenObjectives) ObjsCtx(ctx context.Context, x []float64) ([]float64, error) {
+	if x[0] > 1 {
+		return nil, errBroken
+	}
+	return b.Objs(x), nil
+}
+
+// brokenPlane is halfPlane, but fails at points with x0 > 1
+type brokenPlane struct{ halfPlane }
+
+func (b brokenPlane) ObjConsCtx(ctx context.Context, x []float64) (float64, []float64, error) {
+	if x[0] > 1 {
+		return 0, nil, errBroken
+	}
+	obj, cons := b.ObjCons(x)
+	return obj, cons, nil
+}
+
+// nsgaRecorder checks how results reach NSGA2
+type nsgaRecorder struct {
+	*controller.NSGA2
+	multi    bool // Whether AddMulti has been called
+	lateAdds int  // Calls to Add after AddMulti
+	badLens  int  // Calls to AddMulti with other than two objectives
+}
+
+func (n *nsgaRecorder) Add(x []float64, obj float64) {
+	if n.multi {
+		n.lateAdds++
+	}
+	n.NSGA2.Add(x, obj)
+}
+
+func (n *nsgaRecorder) AddMulti(x []float64, objs []float64) {
+	n.multi = true
+	if len(objs) != 2 {
+		n.badLens++
+	}
+	n.NSGA2.AddMulti(x, objs)
+}
+
+// consRecorder remembers the constraints of every result
+type consRecorder struct {
+	counter
+	adds int
+	cons [][]float64
+}
+
+func (c *consRecorder) Add(x []float64, obj float64) {
+	c.adds++
+}
+
+func (c *consRecorder) AddConstrained(x []float64, obj float64, cons []float64) {
+	c.counter.Add(x, obj)
+	c.cons = append(c.cons, cons)
+}
+
+func TestObjectiveErrorsMultiConstrained(t *testing.T) {
+	// Failed points reach a multi-objective controller as a vector, once
+	// the number of objectives is known
+	n := &nsgaRecorder{NSGA2: &controller.NSGA2{PopSize: 10}}
+	async := &Async{
+		MaxFunEvals: 400,
+		NumDim:      2,
+		Workers:     localWorkers(1),
+		Controller:  n,
+	}
+	if _, err := async.Optimize(brokenObjectives{}); err != nil {
+		t.Fatal(err)
+	}
+	if n.lateAdds != 0 || n.badLens != 0 {
+		t.Errorf("%d failed points given to Add and %d given the wrong number of objectives", n.lateAdds, n.badLens)
+	}
+	for _, a := range async.Pareto().Front() {
+		if a.Loc[0] > 1 {
+			t.Errorf("failed point %v is in the front", a.Loc)
+		}
+	}
+
+	// A failed point is infeasible as well as infinitely bad
+	c := &consRecorder{}
+	async = &Async{
+		MaxFunEvals: 200,
+		NumDim:      2,
+		Workers:     localWorkers(2),
+		Controller:  c,
+	}
+	ans, err := async.Optimize(brokenPlane{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.objs) != 200 || c.adds != 0 {
+		t.Errorf("controller got %d results by AddConstrained and %d by Add, want all 200 by AddConstrained", len(c.objs), c.adds)
+	}
+	for i, obj := range c.objs {
+		failed := c.locs[i][0] > 1
+		if failed != math.IsInf(obj, 1) || failed != math.IsInf(Ans{Cons: c.cons[i]}.Violation(), 1) {
+			t.Errorf("result %v with constraints %v at %v", obj, c.cons[i], c.locs[i])
+		}
+	}
+	if ans.Loc[0] > 1 || !ans.Feasible() {
+		t.Errorf("best answer %v is a failed point", ans)
+	}
+}
@@ -0,0 +1,52 @@
+package optimize
+
+import "math"
+
+// Often the simulation that computes the objective also computes quantities
+// that must stay within limits, like the maximum stress in a part. These are
+// inequality constraints. By convention, a constraint value c is satisfied
+// when c <= 0, so a limit like stress <= maxStress is written as
+// stress - maxStress.
+
+// ConstrainedObjer is an objective function with inequality constraints. Workers
+// call ObjCons instead of Obj. A point is feasible if all of the constraint
+// values are less than or equal to zero.
+type ConstrainedObjer interface {
+	Objer
+	ObjCons([]float64) (obj float64, cons []float64)
+}
+
+// ConstrainedAdder is a controller that can use the constraint values. If the
+// controller is a ConstrainedAdder, Async calls AddConstrained instead of Add
+// for constrained results. A point where the objective failed is given to
+// AddConstrained with an infinite objective and constraint violation. Any
+// controller can be made into a ConstrainedAdder with controller.Constrained.
+type ConstrainedAdder interface {
+	AddConstrained(loc []float64, obj float64, cons []float64)
+}
+
+// Violation returns the total amount by which the constraints are violated
+func (a Ans) Violation() float64 {
+	var v float64
+	for _, c := range a.Cons {
+		v += math.Max(0, c)
+	}
+	return v
+}
+
+// Feasible returns true if none of the constraints are violated
+func (a Ans) Feasible() bool {
+	return a.Violation() == 0
+}
+
+// better returns true if a is better than b. Feasible points are always better
+// than infeasible points, infeasible points are compared by the size of
+// their constraint violation, and feasible points by their objective value.
+func (a Ans) better(b Ans) bool {
+	va := a.Violation()
+	vb := b.Violation()
+	if va != vb {
+		return va < vb
+	}
+	return a.Obj < b.Obj
+}
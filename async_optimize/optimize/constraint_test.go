@@ -0,0 +1,99 @@
+package optimize
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestAnsBetter(t *testing.T) {
+	// From best to worst
+	answers := []Ans{
+		{Obj: -1},
+		{Obj: 0, Cons: []float64{-1, 0}},
+		{Obj: 10},
+		{Obj: -100, Cons: []float64{0.5}},
+		{Obj: -100, Cons: []float64{0.5, 0.5}},
+	}
+	for i, a := range answers {
+		for j, b := range answers {
+			if got := a.better(b); got != (i < j) {
+				t.Errorf("%v better than %v is %v", a, b, got)
+			}
+		}
+	}
+	if !answers[1].Feasible() || answers[3].Feasible() {
+		t.Error("feasibility wrong")
+	}
+	if v := answers[4].Violation(); v != 1 {
+		t.Errorf("violation %v, want 1", v)
+	}
+}
+
+// halfPlane is the distance squared from (1, 1), subject to x0 + x1 <= 0
+type halfPlane struct{}
+
+func (halfPlane) Obj(x []float64) float64 {
+	obj, _ := halfPlane{}.ObjCons(x)
+	return obj
+}
+
+func (halfPlane) ObjCons(x []float64) (float64, []float64) {
+	d0, d1 := x[0]-1, x[1]-1
+	return d0*d0 + d1*d1, []float64{x[0] + x[1]}
+}
+
+// constrainedRecorder samples uniformly and checks that the constraints
+// arrive with their point
+type constrainedRecorder struct {
+	adds, constrained int
+	lo, hi            float64
+}
+
+func (c *constrainedRecorder) Next(x []float64) {
+	for i := range x {
+		x[i] = c.lo + (c.hi-c.lo)*rand.Float64()
+	}
+}
+
+func (c *constrainedRecorder) Add(x []float64, obj float64) {
+	c.adds++
+}
+
+func (c *constrainedRecorder) AddConstrained(x []float64, obj float64, cons []float64) {
+	c.constrained++
+	if len(cons) != 1 || cons[0] != x[0]+x[1] {
+		panic("constraints do not belong to the location")
+	}
+}
+
+func TestAsyncConstrained(t *testing.T) {
+	rec := &constrainedRecorder{lo: -2, hi: 2}
+	async := &Async{
+		MaxFunEvals: 300,
+		NumDim:      2,
+		Workers:     localWorkers(3),
+		Controller:  rec,
+	}
+	ans, err := async.Optimize(halfPlane{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.constrained != 300 || rec.adds != 0 {
+		t.Errorf("controller got %d results by AddConstrained and %d by Add, want all 300 by AddConstrained", rec.constrained, rec.adds)
+	}
+	// Infeasible points are closer to (1, 1), but the best is feasible
+	if !ans.Feasible() || len(ans.Cons) != 1 {
+		t.Errorf("best answer %v is not feasible", ans)
+	}
+
+	// With no feasible point there is still a best point, but also an error
+	rec = &constrainedRecorder{lo: 1, hi: 2}
+	async.Controller = rec
+	ans, err = async.Optimize(halfPlane{})
+	if err == nil {
+		t.Error("no error when no feasible point was found")
+	}
+	if len(ans.Loc) != 2 || ans.Violation() <= 0 {
+		t.Errorf("answer %v, want the least infeasible point", ans)
+	}
+}
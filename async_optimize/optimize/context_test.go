@@ -0,0 +1,160 @@
+package optimize
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/functions"
+)
+
+// waiter waits for its context at points with a negative first element, and
+// is the sphere elsewhere
+type waiter struct{}
+
+func (waiter) Obj(x []float64) float64 {
+	panic("waiter needs a context")
+}
+
+func (waiter) ObjCtx(ctx context.Context, x []float64) (float64, error) {
+	if x[0] >= 0 {
+		return sphere{}.Obj(x), nil
+	}
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+// localWorker runs a LocalWorker outside of Async
+func localWorker(t *testing.T, w *LocalWorker, fun Objer) (chan<- []float64, <-chan Ans) {
+	read := make(chan []float64)
+	write := make(chan Ans)
+	quit := make(chan bool)
+	if err := w.Init(read, write, fun, quit); err != nil {
+		t.Fatal(err)
+	}
+	go w.Run()
+	t.Cleanup(func() { close(quit) })
+	return read, write
+}
+
+func TestLocalWorkerTimeout(t *testing.T) {
+	w := &LocalWorker{Timeout: 20 * time.Millisecond}
+	read, write := localWorker(t, w, waiter{})
+	read <- []float64{-1}
+	// Taking too long is the point's fault
+	if ans := <-write; ans.Err != context.DeadlineExceeded {
+		t.Errorf("answer %+v, want DeadlineExceeded", ans)
+	}
+	// The timeout is for each evaluation
+	read <- []float64{1, 2}
+	if ans := <-write; ans.Err != nil || ans.Obj != 5 {
+		t.Errorf("answer %+v after a timeout", ans)
+	}
+}
+
+func TestLocalWorkerCancel(t *testing.T) {
+	w := &LocalWorker{}
+	read, write := localWorker(t, w, waiter{})
+	read <- []float64{-1}
+	w.Cancel()
+	// Being canceled is not the point's fault, so it is given back
+	var werr *WorkerError
+	if ans := <-write; !errors.As(ans.Err, &werr) || werr.Err != context.Canceled {
+		t.Errorf("answer %+v, want a WorkerError", ans)
+	}
+}
+
+type ctxKey struct{}
+
+// constrainedWaiter has ObjCtx as well as ObjCons
+type constrainedWaiter struct {
+	halfPlane
+	waiter
+}
+
+func (c constrainedWaiter) Obj(x []float64) float64 { return c.halfPlane.Obj(x) }
+
+// constrainedCtx checks that it is given the context in ObjConsCtx
+type constrainedCtx struct{ constrainedWaiter }
+
+func (c constrainedCtx) ObjConsCtx(ctx context.Context, x []float64) (float64, []float64, error) {
+	if ctx.Value(ctxKey{}) == nil {
+		return 0, nil, errors.New("not given the context")
+	}
+	obj, cons := c.ObjCons(x)
+	return obj, cons, nil
+}
+
+// multiWaiter has ObjCtx as well as Objs
+type multiWaiter struct {
+	twoObjectives
+	waiter
+}
+
+func (m multiWaiter) Obj(x []float64) float64 { return m.twoObjectives.Obj(x) }
+
+// noObjectives returns no objectives
+type noObjectives struct{ twoObjectives }
+
+func (noObjectives) Objs(x []float64) []float64 { return nil }
+
+type noObjectivesCtx struct{ noObjectives }
+
+func (noObjectivesCtx) ObjsCtx(ctx context.Context, x []float64) ([]float64, error) {
+	return []float64{}, nil
+}
+
+func TestEvaluateContext(t *testing.T) {
+	ctx := context.WithValue(context.Background(), ctxKey{}, true)
+	x := []float64{1, 2}
+	obj, cons := halfPlane{}.ObjCons(x)
+	for _, fun := range []Objer{constrainedWaiter{}, constrainedCtx{}} {
+		ans := evaluate(ctx, fun, x)
+		if ans.Err != nil || ans.Obj != obj || len(ans.Cons) != len(cons) {
+			t.Errorf("%T: answer %+v, want the constraints", fun, ans)
+		}
+	}
+	objs := twoObjectives{}.Objs(x)
+	if ans := evaluate(ctx, multiWaiter{}, x); ans.Err != nil || len(ans.Objs) != len(objs) || ans.Obj != objs[0] {
+		t.Errorf("answer %+v, want the objectives", ans)
+	}
+
+	// A function which returns no objectives failed at the point
+	for _, fun := range []Objer{noObjectives{}, noObjectivesCtx{}} {
+		if ans := evaluate(ctx, fun, x); ans.Err != functions.ErrNoObjectives {
+			t.Errorf("%T: answer %+v, want an error", fun, ans)
+		}
+	}
+
+	// A point is not started once the context is done
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if ans := evaluate(canceled, waiter{}, []float64{1}); ans.Err != context.Canceled {
+		t.Errorf("answer %+v with a canceled context", ans)
+	}
+}
+
+func TestOptimizeContext(t *testing.T) {
+	c := &counter{}
+	async := &Async{
+		MaxFunEvals: 1000,
+		NumDim:      2,
+		Workers:     localWorkers(2),
+		Controller:  c,
+	}
+	// About half the points wait forever, so the workers soon all hang
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := async.OptimizeContext(ctx, waiter{})
+	if err != context.DeadlineExceeded {
+		t.Errorf("OptimizeContext returned %v, want DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("OptimizeContext took %v to stop", d)
+	}
+	if len(c.objs) >= async.MaxFunEvals {
+		t.Errorf("controller got all %d results", len(c.objs))
+	}
+}
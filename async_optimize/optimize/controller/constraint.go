@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"math"
+)
+
+// None of the controllers know about constraints, they only see a single value
+// through Add. A ConstraintHandler turns an objective value and a set of
+// constraint values (satisfied when less than or equal to zero) into a single
+// merit value, and Constrained wraps any controller so that it is given the
+// merit instead of the raw objective.
+
+// ConstraintHandler combines an objective and constraint values into a single
+// merit value, where smaller is better
+type ConstraintHandler interface {
+	Merit(obj float64, cons []float64) float64
+}
+
+func violation(cons []float64) float64 {
+	var v float64
+	for _, c := range cons {
+		v += math.Max(0, c)
+	}
+	return v
+}
+
+// Constrained wraps a controller so it can be used on constrained problems.
+// Results from a constrained objective are converted with the Handler before
+// being passed to the wrapped controller.
+type Constrained struct {
+	C       C
+	Handler ConstraintHandler
+}
+
+// Init initializes the wrapped controller if it needs initialization
+func (c Constrained) Init(nDim int) {
+	if initer, ok := c.C.(interface {
+		Init(nDim int)
+	}); ok {
+		initer.Init(nDim)
+	}
+}
+
+func (c Constrained) Next(x []float64) {
+	c.C.Next(x)
+}
+
+func (c Constrained) Add(loc []float64, obj float64) {
+	c.C.Add(loc, obj)
+}
+
+// AddConstrained adds the merit of the result to the wrapped controller
+func (c Constrained) AddConstrained(loc []float64, obj float64, cons []float64) {
+	c.C.Add(loc, c.Handler.Merit(obj, cons))
+}
+
+// Penalty adds a quadratic penalty for constraint violation to the objective.
+// If Weight is zero, a weight of 1000 is used.
+type Penalty struct {
+	Weight float64
+}
+
+func (p Penalty) Merit(obj float64, cons []float64) float64 {
+	w := p.Weight
+	if w == 0 {
+		w = 1000
+	}
+	var pen float64
+	for _, c := range cons {
+		if c > 0 {
+			pen += c * c
+		}
+	}
+	return obj + w*pen
+}
+
+// FeasibilityFirst ranks every feasible point ahead of every infeasible point.
+// Feasible points are ranked by objective, and infeasible points by the size
+// of their constraint violation. The merit of a point can't depend on what is
+// found later, since the controller keeps the merits it was given, so the
+// two levels are kept apart by the sign. The merit of a feasible point is
+// its objective mapped into the negative numbers by an increasing function,
+// and the merit of an infeasible point is its violation, which is positive.
+// Only the order of the merits means anything, so FeasibilityFirst is best
+// used with controllers that only compare values, not ones like Roulette
+// which use their size.
+type FeasibilityFirst struct{}
+
+func (FeasibilityFirst) Merit(obj float64, cons []float64) float64 {
+	v := violation(cons)
+	if v > 0 {
+		return v
+	}
+	// Both pieces are -1 at zero. Dividing keeps the relative precision of
+	// large objectives, which squashing with something like Atan would
+	// lose.
+	if obj < 0 {
+		return obj - 1
+	}
+	return -1 / (1 + obj)
+}
+
+// Filter keeps a set of (objective, violation) pairs, none of which is better
+// than another in both. A new point is acceptable if no pair in the filter is
+// at least as good in both objective and violation. Acceptable points are
+// given their objective as merit and added to the filter. An unacceptable
+// point is given a merit just above its own objective or the worst merit given
+// to an acceptable point, whichever is larger, plus its violation, so it ranks
+// behind every acceptable point and never ahead of its own objective. Filter
+// keeps state, so it must be used as a pointer.
+type Filter struct {
+	entries   []filterEntry
+	worst     float64 // Largest finite merit given to an acceptable point
+	haveWorst bool
+}
+
+type filterEntry struct {
+	obj float64
+	v   float64
+}
+
+func (f *Filter) Merit(obj float64, cons []float64) float64 {
+	v := violation(cons)
+	for _, e := range f.entries {
+		if e.obj <= obj && e.v <= v {
+			base := obj
+			if f.haveWorst {
+				base = math.Max(f.worst, obj)
+			}
+			return math.Nextafter(base+v, math.Inf(1))
+		}
+	}
+	// A point where the objective failed is infinite, which would make every
+	// unacceptable point the same
+	if !math.IsInf(obj, 1) && (!f.haveWorst || obj > f.worst) {
+		f.worst = obj
+		f.haveWorst = true
+	}
+	// Remove the entries the new point is better than
+	n := 0
+	for _, e := range f.entries {
+		if !(obj <= e.obj && v <= e.v) {
+			f.entries[n] = e
+			n++
+		}
+	}
+	f.entries = append(f.entries[:n], filterEntry{obj: obj, v: v})
+	return obj
+}
@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestFeasibilityFirst(t *testing.T) {
+	// From best to worst. Infeasible points found before any feasible one
+	// must still end up behind all of them.
+	results := []struct {
+		obj  float64
+		cons []float64
+	}{
+		{-1e12, []float64{-1}},
+		{-3, nil},
+		{-1e-3, []float64{0}},
+		{0, []float64{-2, -1}},
+		{1e-3, nil},
+		{2, []float64{-1}},
+		{1e12, nil},
+		{1e12 + 1, nil},
+		{math.Inf(1), nil},
+		{-100, []float64{1e-9}},
+		{-100, []float64{0.5, -1}},
+		{-1000, []float64{0.5, 0.5}},
+		{5, []float64{1e12}},
+	}
+	h := FeasibilityFirst{}
+	merits := make([]float64, len(results))
+	order := rand.Perm(len(results))
+	for _, i := range order {
+		merits[i] = h.Merit(results[i].obj, results[i].cons)
+	}
+	if !sort.Float64sAreSorted(merits) {
+		t.Errorf("merits %v are not in order from best to worst", merits)
+	}
+	for i := 1; i < len(merits); i++ {
+		if merits[i] == merits[i-1] {
+			t.Errorf("results %d and %d have the same merit %v", i-1, i, merits[i])
+		}
+	}
+}
+
+func TestPenalty(t *testing.T) {
+	if m := (Penalty{}).Merit(3, []float64{-1, 0}); m != 3 {
+		t.Errorf("feasible merit %v, want the objective", m)
+	}
+	if m := (Penalty{}).Merit(3, []float64{0.1, -1}); math.Abs(m-13) > 1e-9 {
+		t.Errorf("merit %v with the default weight, want 13", m)
+	}
+	if m := (Penalty{Weight: 2}).Merit(3, []float64{1, 2}); m != 13 {
+		t.Errorf("merit %v, want 13", m)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f := &Filter{}
+	if m := f.Merit(5, []float64{1}); m != 5 {
+		t.Errorf("first point merit %v, want its objective", m)
+	}
+	// Better objective but worse violation is acceptable
+	if m := f.Merit(3, []float64{2}); m != 3 {
+		t.Errorf("acceptable point merit %v, want its objective", m)
+	}
+	// Worse in both is not, and is ranked behind its own objective plus
+	// its violation
+	if m := f.Merit(6, []float64{3}); m <= 6+3 {
+		t.Errorf("unacceptable point merit %v, want more than 9", m)
+	}
+	// Better in both replaces the entries it beats
+	f.Merit(1, []float64{0})
+	if len(f.entries) != 1 {
+		t.Errorf("filter entries %v, want only the dominating one", f.entries)
+	}
+	// A feasible point the filter dominates is behind every acceptable
+	// point, including the ones since removed, and behind its own objective
+	if m := f.Merit(2, []float64{0}); m <= 5 {
+		t.Errorf("dominated feasible point merit %v, want more than 5", m)
+	}
+	if m := f.Merit(100, []float64{0}); m <= 100 {
+		t.Errorf("dominated feasible point merit %v, want more than 100", m)
+	}
+	// Even one equal to the best point
+	if m := f.Merit(1, []float64{0}); m <= 5 {
+		t.Errorf("point equal to the filter's merit %v, want more than 5", m)
+	}
+}
+
+// recorder is a controller which remembers what it was given
+type recorder struct {
+	nDim int
+	objs []float64
+}
+
+func (r *recorder) Init(nDim int)                { r.nDim = nDim }
+func (r *recorder) Next(x []float64)             {}
+func (r *recorder) Add(x []float64, obj float64) { r.objs = append(r.objs, obj) }
+
+func TestConstrained(t *testing.T) {
+	r := &recorder{}
+	c := Constrained{C: r, Handler: Penalty{Weight: 1}}
+	c.Init(3)
+	if r.nDim != 3 {
+		t.Error("Init not passed to the wrapped controller")
+	}
+	c.Add(nil, 1)
+	c.AddConstrained(nil, 1, []float64{2})
+	if len(r.objs) != 2 || r.objs[0] != 1 || r.objs[1] != 5 {
+		t.Errorf("wrapped controller given %v, want 1 and the merit 5", r.objs)
+	}
+}
+
+func TestConstrainedConverges(t *testing.T) {
+	// The unconstrained optimum of shifted is at x0 = 1, so the constraint
+	// x0 <= 0 is active and the constrained optimum is at x0 = 0
+	c := Constrained{C: &CrossEntropy{InitSigma: 5, PopSize: 100, Smoothing: 0.5}, Handler: FeasibilityFirst{}}
+	c.Init(3)
+	x := make([]float64, 3)
+	for i := 0; i < 4000; i++ {
+		c.Next(x)
+		c.AddConstrained(x, shifted(x), []float64{x[0]})
+	}
+	// Only feasible points make the elite once there are enough of them, so
+	// the distribution shrinks before quite reaching the constraint
+	mean := c.C.(*CrossEntropy).Mean()
+	if mean[0] > 1e-3 || mean[0] < -0.5 || math.Abs(mean[1]+2) > 0.05 || math.Abs(mean[2]-0.5) > 0.05 {
+		t.Errorf("mean %v, want near (0, -2, 0.5) on the feasible side", mean)
+	}
+}
@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"math"
+	"math/rand"
+)
+
+// CrossEntropy is the cross-entropy method. Points are sampled from a normal
+// distribution with independent dimensions. Once PopSize results of a
+// generation are in, the distribution is refit to the best (elite) fraction of
+// them, and the new parameters are smoothed with the old ones.
+//
+// Results that come back after their generation has been used for an update
+// are still reasonable samples near the current distribution, so results up
+// to MaxAge generations old are added to the current generation. Older
+// results are ignored.
+type CrossEntropy struct {
+	PopSize   int     // Number of samples in each generation (default 50)
+	Elite     float64 // Fraction of the samples used to refit (default 0.2)
+	Smoothing float64 // Weight of the new parameters in the update (default 0.7)
+	MaxAge    int     // How many generations late a result may arrive and still be used
+	InitSigma float64 // Initial standard deviation of each dimension (default 1)
+
+	mean  []float64
+	sigma []float64
+
+	gens  generations
+	batch []Individual
+}
+
+// Init sets the defaults and the initial distribution
+func (c *CrossEntropy) Init(nDim int) {
+	if c.PopSize <= 0 {
+		c.PopSize = 50
+	}
+	if c.Elite <= 0 || c.Elite > 1 {
+		c.Elite = 0.2
+	}
+	if c.Smoothing <= 0 || c.Smoothing > 1 {
+		c.Smoothing = 0.7
+	}
+	if c.InitSigma <= 0 {
+		c.InitSigma = 1
+	}
+	c.mean = make([]float64, nDim)
+	c.sigma = make([]float64, nDim)
+	for i := range c.sigma {
+		c.sigma[i] = c.InitSigma
+	}
+	c.gens = generations{}
+	c.batch = c.batch[:0]
+}
+
+// Next samples from the current distribution
+func (c *CrossEntropy) Next(x []float64) {
+	for i := range x {
+		x[i] = c.mean[i] + c.sigma[i]*rand.NormFloat64()
+	}
+	c.gens.issue(x, c.MaxAge)
+}
+
+// Add adds the result to the current generation, and updates the distribution
+// if the generation is complete
+func (c *CrossEntropy) Add(loc []float64, obj float64) {
+	age, ok := c.gens.match(loc)
+	if !ok || age > c.MaxAge {
+		return
+	}
+	c.batch = append(c.batch, Individual{Loc: copyLoc(loc), Obj: obj})
+	if len(c.batch) < c.PopSize {
+		return
+	}
+	c.update()
+	c.batch = c.batch[:0]
+	c.gens.next()
+}
+
+func (c *CrossEntropy) update() {
+	sortIndividuals(c.batch)
+	nElite := int(math.Ceil(c.Elite * float64(len(c.batch))))
+	if nElite < 1 {
+		nElite = 1
+	}
+	elite := c.batch[:nElite]
+
+	alpha := c.Smoothing
+	for i := range c.mean {
+		var mean float64
+		for _, ind := range elite {
+			mean += ind.Loc[i]
+		}
+		mean /= float64(nElite)
+
+		var variance float64
+		for _, ind := range elite {
+			d := ind.Loc[i] - mean
+			variance += d * d
+		}
+		variance /= float64(nElite)
+
+		c.mean[i] = alpha*mean + (1-alpha)*c.mean[i]
+		c.sigma[i] = alpha*math.Sqrt(variance) + (1-alpha)*c.sigma[i]
+	}
+}
+
+// Mean returns the mean of the current sampling distribution
+func (c *CrossEntropy) Mean() []float64 {
+	return copyLoc(c.mean)
+}
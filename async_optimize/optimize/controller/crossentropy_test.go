@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"math"
+	"testing"
+)
+
+// meaner is a controller with a search distribution
+type meaner interface {
+	C
+	Mean() []float64
+}
+
+// checkMean checks that the mean of the distribution is near the optimum of
+// shifted
+func checkMean(t *testing.T, name string, c meaner, tol float64) {
+	t.Helper()
+	for i, v := range c.Mean() {
+		if math.Abs(v-optimum(i)) > tol {
+			t.Errorf("%s: mean %v, want near the optimum", name, c.Mean())
+			return
+		}
+	}
+}
+
+func TestCrossEntropyConverges(t *testing.T) {
+	// The elite shrink the distribution quickly, so start wide enough to
+	// reach the optimum before it collapses
+	c := &CrossEntropy{MaxAge: 1, InitSigma: 5}
+	best := run(c, 3, 4000, 8, shifted)
+	if best > 1e-3 {
+		t.Errorf("best objective %v, want near 0", best)
+	}
+	checkMean(t, "cross entropy", c, 0.05)
+}
+
+func TestCrossEntropyIgnoresUnknownPoints(t *testing.T) {
+	c := &CrossEntropy{PopSize: 2}
+	c.Init(1)
+	// Points that were never handed out by Next must not move the
+	// distribution, however good they look
+	for i := 0; i < 10; i++ {
+		c.Add([]float64{100}, -1000)
+	}
+	if m := c.Mean(); m[0] != 0 {
+		t.Errorf("mean moved to %v from results for points never sampled", m)
+	}
+}
+
+func TestGenerationsMaxAge(t *testing.T) {
+	var g generations
+	old := []float64{1}
+	g.issue(old, 1)
+	g.next()
+	g.next()
+	g.issue([]float64{2}, 1)
+	if _, ok := g.match(old); ok {
+		t.Error("point two generations old is still pending with MaxAge 1")
+	}
+	age, ok := g.match([]float64{2})
+	if !ok || age != 0 {
+		t.Errorf("current point: age %d, found %v", age, ok)
+	}
+	if _, ok := g.match([]float64{2}); ok {
+		t.Error("point matched twice")
+	}
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"math"
+	"sort"
+)
+
+// Population-based controllers like CrossEntropy and the natural evolution
+// strategies sample a generation of points from a distribution, and then
+// use the results to update the distribution. With Async, the results come
+// back in the order the evaluations finish, not the order they were
+// generated. Next is also called whenever a worker is free, so points
+// from the next generation are handed out before the current generation has
+// finished. The generations type keeps track of which generation each
+// outstanding point belongs to, so the controllers can decide what to do
+// with results that arrive late.
+
+type sample struct {
+	loc []float64
+	gen int
+}
+
+type generations struct {
+	gen     int      // Current generation
+	pending []sample // Points handed out by Next and not yet returned by Add
+}
+
+// issue records that x was sampled from the current generation
+func (g *generations) issue(x []float64, maxAge int) {
+	// Forget about points that are too old to ever be used. This can happen
+	// if an evaluation is lost.
+	n := 0
+	for _, s := range g.pending {
+		if g.gen-s.gen <= maxAge {
+			g.pending[n] = s
+			n++
+		}
+	}
+	g.pending = g.pending[:n]
+	g.pending = append(g.pending, sample{loc: copyLoc(x), gen: g.gen})
+}
+
+// match finds x in the list of pending points and removes it. It returns
+// how many generations ago x was sampled, and false if x was never handed
+// out.
+func (g *generations) match(x []float64) (age int, ok bool) {
+	for i, s := range g.pending {
+		if equalLoc(s.loc, x) {
+			g.pending = append(g.pending[:i], g.pending[i+1:]...)
+			return g.gen - s.gen, true
+		}
+	}
+	return 0, false
+}
+
+// next moves on to the next generation
+func (g *generations) next() {
+	g.gen++
+}
+
+func equalLoc(x, y []float64) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i, v := range x {
+		if v != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sortIndividuals sorts the individuals from best to worst
+func sortIndividuals(pop []Individual) {
+	sort.Slice(pop, func(i, j int) bool { return pop[i].Obj < pop[j].Obj })
+}
+
+// rankUtilities returns the fitness shaping weights used by the natural
+// evolution strategies. The weights only depend on the rank of the
+// sample, which makes the update invariant to monotonic transformations of
+// the objective. utilities[0] is the weight of the best sample.
+func rankUtilities(n int) []float64 {
+	u := make([]float64, n)
+	var sum float64
+	for k := range u {
+		u[k] = math.Max(0, math.Log(float64(n)/2+1)-math.Log(float64(k+1)))
+		sum += u[k]
+	}
+	for k := range u {
+		u[k] = u[k]/sum - 1/float64(n)
+	}
+	return u
+}
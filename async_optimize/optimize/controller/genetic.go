@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"math/rand"
+)
+
+// A genetic algorithm keeps a population of good points, and creates new
+// points by combining ("crossing over") two parents and randomly perturbing
+// ("mutating") the result. Each of those steps has many variants, so instead
+// of hardcoding them, Genetic is built from small interfaces. Any type with
+// the right method can be plugged in, which makes it easy to write
+// domain-specific operators without touching the rest of the algorithm.
+
+// Individual is a member of a population
+type Individual struct {
+	Loc []float64
+	Obj float64
+}
+
+// Selector chooses a parent from the population. It returns the index of the
+// chosen individual.
+type Selector interface {
+	Select(pop []Individual) int
+}
+
+// Crossoverer combines the two parents a and b into a child. The child is
+// stored in-place into the first argument.
+type Crossoverer interface {
+	Crossover(child, a, b []float64)
+}
+
+// Mutator randomly perturbs x in place
+type Mutator interface {
+	Mutate(x []float64)
+}
+
+// Genetic is a steady-state genetic algorithm. Instead of replacing the whole
+// population each generation, every returned evaluation is immediately
+// considered for the population, replacing the worst member if it is better.
+// This fits well with Async, where evaluations come back one at a time.
+//
+// If any of the operators are nil, Init sets them to Tournament{Size: 2},
+// SBX{Eta: 15} and Polynomial{Eta: 20} respectively.
+type Genetic struct {
+	PopSize int // Size of the population (default 50)
+
+	Selection Selector
+	Crossover Crossoverer
+	Mutation  Mutator
+
+	pop []Individual
+}
+
+// Init sets the default operators and allocates memory for the population
+func (g *Genetic) Init(nDim int) {
+	if g.PopSize <= 0 {
+		g.PopSize = 50
+	}
+	if g.Selection == nil {
+		g.Selection = Tournament{Size: 2}
+	}
+	if g.Crossover == nil {
+		g.Crossover = SBX{Eta: 15}
+	}
+	if g.Mutation == nil {
+		g.Mutation = Polynomial{Eta: 20}
+	}
+	g.pop = make([]Individual, 0, g.PopSize)
+}
+
+// Next generates a new point. Until the population is full, random points
+// are generated. Afterwards, two parents are selected and combined.
+func (g *Genetic) Next(x []float64) {
+	if len(g.pop) < g.PopSize {
+		for i := range x {
+			x[i] = rand.NormFloat64()
+		}
+		return
+	}
+	a := g.pop[g.Selection.Select(g.pop)].Loc
+	b := g.pop[g.Selection.Select(g.pop)].Loc
+	g.Crossover.Crossover(x, a, b)
+	g.Mutation.Mutate(x)
+}
+
+// Add considers the point for membership in the population
+func (g *Genetic) Add(loc []float64, obj float64) {
+	if len(g.pop) < g.PopSize {
+		g.pop = append(g.pop, Individual{Loc: copyLoc(loc), Obj: obj})
+		return
+	}
+	worst := 0
+	for i, ind := range g.pop {
+		if ind.Obj > g.pop[worst].Obj {
+			worst = i
+		}
+	}
+	if obj < g.pop[worst].Obj {
+		// Reuse the memory of the individual being replaced
+		copy(g.pop[worst].Loc, loc)
+		g.pop[worst].Obj = obj
+	}
+}
+
+// Population returns the current population. The returned slice should not
+// be modified.
+func (g *Genetic) Population() []Individual {
+	return g.pop
+}
+
+func copyLoc(loc []float64) []float64 {
+	x := make([]float64, len(loc))
+	copy(x, loc)
+	return x
+}
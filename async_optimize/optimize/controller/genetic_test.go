@@ -0,0 +1,196 @@
+package controller
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// shifted is a quadratic bowl with its minimum of zero at (1, -2, 0.5, ...)
+func shifted(x []float64) float64 {
+	var sum float64
+	for i, v := range x {
+		d := v - optimum(i)
+		sum += d * d
+	}
+	return sum
+}
+
+func optimum(i int) float64 {
+	switch i % 3 {
+	case 0:
+		return 1
+	case 1:
+		return -2
+	}
+	return 0.5
+}
+
+// run drives the controller like Async does, with up to inFlight points out
+// at once and the results coming back in a random order. It returns the best
+// objective value seen.
+func run(c C, nDim, evals, inFlight int, f func([]float64) float64) float64 {
+	if initer, ok := c.(interface{ Init(int) }); ok {
+		initer.Init(nDim)
+	}
+	best := math.Inf(1)
+	var out [][]float64
+	for n := 0; n < evals || len(out) > 0; {
+		if n < evals && len(out) < inFlight {
+			x := make([]float64, nDim)
+			c.Next(x)
+			out = append(out, x)
+			n++
+			continue
+		}
+		i := rand.Intn(len(out))
+		x := out[i]
+		out = append(out[:i], out[i+1:]...)
+		obj := f(x)
+		best = math.Min(best, obj)
+		c.Add(x, obj)
+	}
+	return best
+}
+
+func TestGeneticConverges(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		g    *Genetic
+	}{
+		{"default", &Genetic{}},
+		{"roulette blend gaussian", &Genetic{Selection: Roulette{}, Crossover: Blend{Alpha: 0.5}, Mutation: Gaussian{Sigma: 0.1}}},
+		{"uniform", &Genetic{Crossover: Uniform{}, Mutation: Gaussian{Sigma: 0.1, Rate: 1}}},
+	} {
+		best := run(test.g, 3, 3000, 4, shifted)
+		if best > 0.05 {
+			t.Errorf("%s: best objective %v, want near 0", test.name, best)
+		}
+		pop := test.g.Population()
+		if len(pop) != 50 {
+			t.Errorf("%s: population size %d, want the default of 50", test.name, len(pop))
+		}
+	}
+}
+
+func TestGeneticReplacesWorst(t *testing.T) {
+	g := &Genetic{PopSize: 3}
+	g.Init(1)
+	for _, obj := range []float64{3, 1, 2} {
+		g.Add([]float64{obj}, obj)
+	}
+	g.Add([]float64{0}, 0)
+	g.Add([]float64{5}, 5) // Worse than everything, so not kept
+	var got []float64
+	for _, ind := range g.Population() {
+		got = append(got, ind.Obj)
+		if ind.Loc[0] != ind.Obj {
+			t.Errorf("individual with objective %v has location %v", ind.Obj, ind.Loc)
+		}
+	}
+	want := map[float64]bool{0: true, 1: true, 2: true}
+	for _, obj := range got {
+		if !want[obj] {
+			t.Errorf("population %v, want 0, 1 and 2", got)
+			break
+		}
+	}
+}
+
+func TestGeneticCopiesLocations(t *testing.T) {
+	g := &Genetic{PopSize: 2}
+	g.Init(1)
+	x := []float64{1}
+	g.Add(x, 1)
+	x[0] = 7
+	if g.Population()[0].Loc[0] != 1 {
+		t.Error("population shares memory with the location passed to Add")
+	}
+}
+
+func TestTournament(t *testing.T) {
+	pop := []Individual{{Obj: 3}, {Obj: 1}, {Obj: 2}}
+	// A tournament as large as the population almost always finds the best
+	counts := make([]int, len(pop))
+	for i := 0; i < 1000; i++ {
+		counts[Tournament{Size: 20}.Select(pop)]++
+	}
+	if counts[1] < 990 {
+		t.Errorf("large tournament picked the best %d times out of 1000", counts[1])
+	}
+	// Size one is uniform
+	counts = make([]int, len(pop))
+	for i := 0; i < 3000; i++ {
+		counts[Tournament{Size: 1}.Select(pop)]++
+	}
+	for i, c := range counts {
+		if c < 800 {
+			t.Errorf("tournament of one picked individual %d %d times out of 3000", i, c)
+		}
+	}
+}
+
+func TestRoulette(t *testing.T) {
+	pop := []Individual{{Obj: 10}, {Obj: 0}, {Obj: 5}}
+	counts := make([]int, len(pop))
+	for i := 0; i < 3000; i++ {
+		counts[Roulette{}.Select(pop)]++
+	}
+	if !(counts[1] > counts[2] && counts[2] > counts[0]) {
+		t.Errorf("roulette counts %v, want better individuals picked more", counts)
+	}
+	if counts[0] == 0 {
+		t.Error("worst individual was never picked")
+	}
+	// Infinite objectives fall back to uniform selection instead of NaN
+	pop[0].Obj = math.Inf(1)
+	for i := 0; i < 100; i++ {
+		if j := (Roulette{}).Select(pop); j < 0 || j >= len(pop) {
+			t.Fatalf("roulette returned index %d", j)
+		}
+	}
+}
+
+func TestCrossovers(t *testing.T) {
+	a := []float64{0, 10, -1}
+	b := []float64{1, 10, 3}
+	child := make([]float64, 3)
+	for i := 0; i < 100; i++ {
+		Uniform{}.Crossover(child, a, b)
+		for j := range child {
+			if child[j] != a[j] && child[j] != b[j] {
+				t.Fatalf("uniform child %v is not made of parents %v and %v", child, a, b)
+			}
+		}
+		Blend{Alpha: 0.5}.Crossover(child, a, b)
+		for j := range child {
+			lo, hi := math.Min(a[j], b[j]), math.Max(a[j], b[j])
+			d := hi - lo
+			if child[j] < lo-0.5*d || child[j] > hi+0.5*d {
+				t.Fatalf("blend child %v outside the extended interval of %v and %v", child, a, b)
+			}
+		}
+		SBX{Eta: 15}.Crossover(child, a, b)
+		if math.Abs(child[1]-10) > 1e-9 {
+			t.Fatalf("SBX changed an element where the parents agree: %v", child)
+		}
+	}
+}
+
+func TestMutations(t *testing.T) {
+	x := make([]float64, 4)
+	Polynomial{Eta: 20, Rate: 1, Scale: 0.5}.Mutate(x)
+	for _, v := range x {
+		if math.Abs(v) > 0.5 {
+			t.Errorf("polynomial mutation moved an element by %v, more than Scale", v)
+		}
+	}
+	y := []float64{1, 2, 3, 4}
+	Gaussian{Sigma: 1, Rate: -1}.Mutate(y)
+	for i, v := range y {
+		if v != float64(i+1) {
+			t.Errorf("mutation with a negative rate changed %v", y)
+			break
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package controller
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Natural evolution strategies also sample a generation from a normal
+// distribution, but instead of refitting the distribution they take a
+// gradient step on the expected objective value. Each sample x is
+// represented by the standard normal z used to create it, and the gradient
+// is a weighted sum over the z values.
+//
+// A result that arrives after the distribution has been updated was not
+// sampled from the current distribution. As long as it is at most MaxAge
+// generations old, it is still used, and z is recomputed from x relative to
+// the current distribution. Late results are only used to move the mean.
+
+// nesSample is a result in the current generation. A late sample came from
+// an older distribution, which was usually wider than the current one, so
+// relative to the current distribution its z is far too large. Used in the
+// gradient for the step sizes, it would swamp the other samples and blow the
+// distribution up or squeeze it flat, so late samples only move the mean.
+type nesSample struct {
+	Individual
+	late bool
+}
+
+// sortSamples sorts the samples from best to worst
+func sortSamples(batch []nesSample) {
+	sort.Slice(batch, func(i, j int) bool { return batch[i].Obj < batch[j].Obj })
+}
+
+// SNES is the separable natural evolution strategy. Every dimension has its
+// own step size, but correlations between dimensions are not learned, so
+// the cost of an update is linear in the dimension.
+//
+// If PopSize or the learning rates are zero, Init sets them to the values
+// recommended by Wierstra et al.
+type SNES struct {
+	PopSize   int     // Number of samples in each generation
+	EtaMean   float64 // Learning rate for the mean
+	EtaSigma  float64 // Learning rate for the step sizes
+	MaxAge    int     // How many generations late a result may arrive and still be used
+	InitSigma float64 // Initial step size (default 1)
+
+	mean  []float64
+	sigma []float64
+
+	gens      generations
+	batch     []nesSample
+	utilities []float64
+	gradMean  []float64
+	gradSigma []float64
+}
+
+// Init sets the defaults and the initial distribution
+func (s *SNES) Init(nDim int) {
+	d := float64(nDim)
+	if s.PopSize <= 0 {
+		s.PopSize = 4 + int(3*math.Log(d))
+	}
+	if s.EtaMean <= 0 {
+		s.EtaMean = 1
+	}
+	if s.EtaSigma <= 0 {
+		s.EtaSigma = (3 + math.Log(d)) / (5 * math.Sqrt(d))
+	}
+	if s.InitSigma <= 0 {
+		s.InitSigma = 1
+	}
+	s.mean = make([]float64, nDim)
+	s.sigma = make([]float64, nDim)
+	for i := range s.sigma {
+		s.sigma[i] = s.InitSigma
+	}
+	s.gradMean = make([]float64, nDim)
+	s.gradSigma = make([]float64, nDim)
+	s.utilities = rankUtilities(s.PopSize)
+	s.gens = generations{}
+	s.batch = s.batch[:0]
+}
+
+// Next samples from the current distribution
+func (s *SNES) Next(x []float64) {
+	for i := range x {
+		x[i] = s.mean[i] + s.sigma[i]*rand.NormFloat64()
+	}
+	s.gens.issue(x, s.MaxAge)
+}
+
+// Add adds the result to the current generation, and updates the distribution
+// if the generation is complete
+func (s *SNES) Add(loc []float64, obj float64) {
+	age, ok := s.gens.match(loc)
+	if !ok || age > s.MaxAge {
+		return
+	}
+	s.batch = append(s.batch, nesSample{
+		Individual: Individual{Loc: copyLoc(loc), Obj: obj},
+		late:       age > 0,
+	})
+	if len(s.batch) < s.PopSize {
+		return
+	}
+	s.update()
+	s.batch = s.batch[:0]
+	s.gens.next()
+}
+
+func (s *SNES) update() {
+	sortSamples(s.batch)
+	for i := range s.gradMean {
+		s.gradMean[i] = 0
+		s.gradSigma[i] = 0
+	}
+	for k, ind := range s.batch {
+		u := s.utilities[k]
+		for i := range s.mean {
+			z := (ind.Loc[i] - s.mean[i]) / s.sigma[i]
+			s.gradMean[i] += u * z
+			if !ind.late {
+				s.gradSigma[i] += u * (z*z - 1)
+			}
+		}
+	}
+	mean := make([]float64, len(s.mean))
+	sigma := make([]float64, len(s.sigma))
+	for i := range mean {
+		mean[i] = s.mean[i] + s.EtaMean*s.sigma[i]*s.gradMean[i]
+		sigma[i] = s.sigma[i] * math.Exp(s.EtaSigma/2*s.gradSigma[i])
+	}
+
+	// An update that overflows would leave the distribution unusable, so
+	// keep the old one instead
+	if !finite(mean) || !finite(sigma) {
+		return
+	}
+	for _, v := range sigma {
+		if !(v > 0) {
+			return
+		}
+	}
+	s.mean, s.sigma = mean, sigma
+}
+
+// Mean returns the mean of the current sampling distribution
+func (s *SNES) Mean() []float64 {
+	return copyLoc(s.mean)
+}
+
+// XNES is the exponential natural evolution strategy. It learns the full
+// covariance matrix of the search distribution, written as A = sigma * B
+// with det(B) = 1, and updates B through the matrix exponential so it stays
+// positive definite. The cost of an update is cubic in the dimension.
+//
+// If PopSize or the learning rates are zero, Init sets them to the values
+// recommended by Glasmachers et al.
+type XNES struct {
+	PopSize   int     // Number of samples in each generation
+	EtaMean   float64 // Learning rate for the mean
+	EtaSigma  float64 // Learning rate for the global step size
+	EtaB      float64 // Learning rate for the shape matrix
+	MaxAge    int     // How many generations late a result may arrive and still be used
+	InitSigma float64 // Initial step size (default 1)
+
+	nDim  int
+	mean  []float64
+	sigma float64
+	b     []float64 // Shape matrix, row major
+	bInv  []float64 // Inverse of the shape matrix, row major
+
+	gens      generations
+	batch     []nesSample
+	utilities []float64
+	z         []float64
+	tmp       []float64
+}
+
+// Init sets the defaults and the initial distribution
+func (xn *XNES) Init(nDim int) {
+	d := float64(nDim)
+	if xn.PopSize <= 0 {
+		xn.PopSize = 4 + int(3*math.Log(d))
+	}
+	if xn.EtaMean <= 0 {
+		xn.EtaMean = 1
+	}
+	if xn.EtaSigma <= 0 {
+		xn.EtaSigma = (9 + 3*math.Log(d)) / (5 * d * math.Sqrt(d))
+	}
+	if xn.EtaB <= 0 {
+		xn.EtaB = xn.EtaSigma
+	}
+	if xn.InitSigma <= 0 {
+		xn.InitSigma = 1
+	}
+	xn.nDim = nDim
+	xn.mean = make([]float64, nDim)
+	xn.sigma = xn.InitSigma
+	xn.b = identity(nDim)
+	xn.bInv = identity(nDim)
+	xn.z = make([]float64, nDim)
+	xn.tmp = make([]float64, nDim)
+	xn.utilities = rankUtilities(xn.PopSize)
+	xn.gens = generations{}
+	xn.batch = xn.batch[:0]
+}
+
+// Next samples from the current distribution
+func (xn *XNES) Next(x []float64) {
+	for i := range xn.z {
+		xn.z[i] = rand.NormFloat64()
+	}
+	matVec(xn.tmp, xn.b, xn.z)
+	for i := range x {
+		x[i] = xn.mean[i] + xn.sigma*xn.tmp[i]
+	}
+	xn.gens.issue(x, xn.MaxAge)
+}
+
+// Add adds the result to the current generation, and updates the distribution
+// if the generation is complete
+func (xn *XNES) Add(loc []float64, obj float64) {
+	age, ok := xn.gens.match(loc)
+	if !ok || age > xn.MaxAge {
+		return
+	}
+	xn.batch = append(xn.batch, nesSample{
+		Individual: Individual{Loc: copyLoc(loc), Obj: obj},
+		late:       age > 0,
+	})
+	if len(xn.batch) < xn.PopSize {
+		return
+	}
+	xn.update()
+	xn.batch = xn.batch[:0]
+	xn.gens.next()
+}
+
+func (xn *XNES) update() {
+	n := xn.nDim
+	if xn.converged() {
+		return
+	}
+	sortSamples(xn.batch)
+
+	gradMean := make([]float64, n)
+	gradM := make([]float64, n*n)
+	for k, ind := range xn.batch {
+		u := xn.utilities[k]
+		// z = B^-1 (x - mean) / sigma
+		for i := range xn.tmp {
+			xn.tmp[i] = (ind.Loc[i] - xn.mean[i]) / xn.sigma
+		}
+		matVec(xn.z, xn.bInv, xn.tmp)
+		for i := 0; i < n; i++ {
+			gradMean[i] += u * xn.z[i]
+		}
+		if ind.late {
+			continue
+		}
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				gradM[i*n+j] += u * xn.z[i] * xn.z[j]
+			}
+			gradM[i*n+i] -= u
+		}
+	}
+	var trace float64
+	for i := 0; i < n; i++ {
+		trace += gradM[i*n+i]
+	}
+	gradSigma := trace / float64(n)
+	for i := 0; i < n; i++ {
+		gradM[i*n+i] -= gradSigma
+	}
+
+	// mean += eta * sigma * B * gradMean
+	matVec(xn.tmp, xn.b, gradMean)
+	mean := make([]float64, n)
+	for i := range mean {
+		mean[i] = xn.mean[i] + xn.EtaMean*xn.sigma*xn.tmp[i]
+	}
+	sigma := xn.sigma * math.Exp(xn.EtaSigma/2*gradSigma)
+
+	// B = B * expm(eta/2 * G_B) and B^-1 = expm(-eta/2 * G_B) * B^-1
+	step := make([]float64, n*n)
+	for i, v := range gradM {
+		step[i] = xn.EtaB / 2 * v
+	}
+	b := matMul(xn.b, expm(step, n), n)
+	for i := range step {
+		step[i] = -step[i]
+	}
+	bInv := matMul(expm(step, n), xn.bInv, n)
+
+	// An update that overflows would leave the distribution unusable, so
+	// keep the old one instead
+	if !finite(mean) || !finite(b) || !finite(bInv) || !(sigma > 0) || math.IsInf(sigma, 0) {
+		return
+	}
+	xn.mean, xn.sigma, xn.b, xn.bInv = mean, sigma, b, bInv
+}
+
+// converged returns whether the samples are so close to the mean that they
+// only differ from it by rounding. The gradient is then noise, and following
+// it makes B blow up, so the distribution is no longer updated. The shortest
+// step in any direction is about sigma / |B^-1|.
+func (xn *XNES) converged() bool {
+	n := xn.nDim
+	var invNorm, scale float64
+	for i := 0; i < n; i++ {
+		var row float64
+		for j := 0; j < n; j++ {
+			row += math.Abs(xn.bInv[i*n+j])
+		}
+		invNorm = math.Max(invNorm, row)
+		scale = math.Max(scale, math.Abs(xn.mean[i]))
+	}
+	return xn.sigma/invNorm < 1e-10*(1+scale)
+}
+
+func finite(x []float64) bool {
+	for _, v := range x {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Mean returns the mean of the current sampling distribution
+func (xn *XNES) Mean() []float64 {
+	return copyLoc(xn.mean)
+}
+
+// Small dense matrix helpers for XNES. Matrices are n×n and stored row major.
+
+func identity(n int) []float64 {
+	m := make([]float64, n*n)
+	for i := 0; i < n; i++ {
+		m[i*n+i] = 1
+	}
+	return m
+}
+
+// matVec computes dst = m * v
+func matVec(dst, m, v []float64) {
+	n := len(v)
+	for i := 0; i < n; i++ {
+		var sum float64
+		for j := 0; j < n; j++ {
+			sum += m[i*n+j] * v[j]
+		}
+		dst[i] = sum
+	}
+}
+
+// matMul returns a * b
+func matMul(a, b []float64, n int) []float64 {
+	c := make([]float64, n*n)
+	for i := 0; i < n; i++ {
+		for k := 0; k < n; k++ {
+			aik := a[i*n+k]
+			for j := 0; j < n; j++ {
+				c[i*n+j] += aik * b[k*n+j]
+			}
+		}
+	}
+	return c
+}
+
+// expm returns the matrix exponential of m using scaling and squaring with a
+// truncated Taylor series
+func expm(m []float64, n int) []float64 {
+	var norm float64
+	for i := 0; i < n; i++ {
+		var row float64
+		for j := 0; j < n; j++ {
+			row += math.Abs(m[i*n+j])
+		}
+		norm = math.Max(norm, row)
+	}
+	// Scale so the norm is at most 1/2, where the series converges quickly
+	var squarings int
+	if norm > 0.5 {
+		squarings = int(math.Ceil(math.Log2(norm / 0.5)))
+	}
+	scale := math.Pow(2, -float64(squarings))
+	a := make([]float64, n*n)
+	for i, v := range m {
+		a[i] = v * scale
+	}
+
+	result := identity(n)
+	term := identity(n)
+	for k := 1; k <= 12; k++ {
+		term = matMul(term, a, n)
+		for i := range term {
+			term[i] /= float64(k)
+			result[i] += term[i]
+		}
+	}
+	for i := 0; i < squarings; i++ {
+		result = matMul(result, result, n)
+	}
+	return result
+}
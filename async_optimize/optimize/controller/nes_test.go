@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSNESConverges(t *testing.T) {
+	// With four points in flight, most generations include late results
+	for r := 0; r < 20; r++ {
+		s := &SNES{MaxAge: 1}
+		best := run(s, 3, 3000, 4, shifted)
+		if best > 1e-3 {
+			t.Fatalf("best objective %v, want near 0", best)
+		}
+		checkMean(t, "SNES", s, 0.05)
+	}
+}
+
+func TestSNESStaysFinite(t *testing.T) {
+	// Steps this large overflow
+	s := &SNES{InitSigma: 1e308}
+	run(s, 3, 1000, 1, shifted)
+	if !finite(s.mean) || !finite(s.sigma) {
+		t.Errorf("mean %v and step sizes %v, want finite", s.mean, s.sigma)
+	}
+}
+
+// rotated is an ill-conditioned quadratic whose axes are not aligned with the
+// coordinates, which needs the full covariance matrix learned by XNES
+func rotated(x []float64) float64 {
+	u := (x[0] - 1) + (x[1] + 2)
+	v := (x[0] - 1) - (x[1] + 2)
+	return 100*u*u + v*v
+}
+
+func TestXNESConverges(t *testing.T) {
+	// With four points in flight, most generations include late results
+	xn := &XNES{MaxAge: 1, PopSize: 10}
+	best := run(xn, 2, 3000, 4, rotated)
+	if best > 1e-3 {
+		t.Errorf("best objective %v, want near 0", best)
+	}
+	checkMean(t, "XNES", xn, 0.05)
+}
+
+func TestRankUtilities(t *testing.T) {
+	u := rankUtilities(10)
+	var sum float64
+	for k, v := range u {
+		sum += v
+		if k > 0 && v > u[k-1] {
+			t.Errorf("utilities %v are not decreasing with rank", u)
+		}
+	}
+	if math.Abs(sum) > 1e-12 {
+		t.Errorf("utilities sum to %v, want 0", sum)
+	}
+}
+
+func TestExpm(t *testing.T) {
+	// The exponential of a diagonal matrix is the exponential of the diagonal
+	m := []float64{2, 0, 0, -3}
+	e := expm(m, 2)
+	want := []float64{math.Exp(2), 0, 0, math.Exp(-3)}
+	for i := range e {
+		if math.Abs(e[i]-want[i]) > 1e-9*math.Max(1, want[i]) {
+			t.Fatalf("expm(%v) = %v, want %v", m, e, want)
+		}
+	}
+	// expm(A) expm(-A) is the identity
+	a := []float64{0.3, 1.5, -0.7, 0.2}
+	neg := make([]float64, len(a))
+	for i, v := range a {
+		neg[i] = -v
+	}
+	id := matMul(expm(a, 2), expm(neg, 2), 2)
+	for i, v := range identity(2) {
+		if math.Abs(id[i]-v) > 1e-9 {
+			t.Fatalf("expm(A) expm(-A) = %v, want the identity", id)
+		}
+	}
+}
+
+func TestXNESStaysFiniteAfterConverging(t *testing.T) {
+	// Long after the distribution has shrunk to the precision of the
+	// numbers, it must not blow up
+	for r := 0; r < 20; r++ {
+		xn := &XNES{PopSize: 10}
+		run(xn, 2, 10000, 1, rotated)
+		if m := xn.Mean(); !finite(m) || rotated(m) > 1e-6 {
+			t.Fatalf("mean %v after converging, want near the optimum", m)
+		}
+	}
+}
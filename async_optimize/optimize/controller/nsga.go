@@ -0,0 +1,256 @@
+package controller
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// NSGA2 is the non-dominated sorting genetic algorithm for multi-objective
+// problems. The population is ranked into fronts, where the first front is
+// the points no other point dominates, the second front is the points only
+// dominated by the first front, and so on. Within a front, points in less
+// crowded regions are preferred so the population spreads out along the
+// Pareto front.
+//
+// The algorithm is generational, but adapted to Async. Next creates offspring
+// from the current parents whenever a worker is free, and once PopSize
+// offspring results have come back through AddMulti, the parents and
+// offspring are combined and the best PopSize become the new parents. Results
+// are used in the order they arrive, so a slow evaluation simply joins a later
+// generation.
+//
+// The number of objectives is set by the first result given to AddMulti. A
+// later result with a different number of objectives, or one given to Add, is
+// treated as infinitely bad in every objective, which is how Async reports a
+// point that could not be evaluated. If AddMulti is never called, the values
+// given to Add are a single objective.
+//
+// If the operators are nil, Init sets them to SBX{Eta: 15} and
+// Polynomial{Eta: 20}.
+type NSGA2 struct {
+	PopSize int // Size of the population (default 40)
+
+	Crossover Crossoverer
+	Mutation  Mutator
+
+	nObj      int // Number of objectives, zero until AddMulti is called
+	parents   []member
+	offspring []member
+}
+
+// member is an individual in a multi-objective population
+type member struct {
+	loc   []float64
+	objs  []float64
+	rank  int     // Index of the non-dominated front, zero is best
+	crowd float64 // Crowding distance, larger is less crowded
+}
+
+// Init sets the default operators and clears the population
+func (n *NSGA2) Init(nDim int) {
+	if n.PopSize <= 0 {
+		n.PopSize = 40
+	}
+	if n.Crossover == nil {
+		n.Crossover = SBX{Eta: 15}
+	}
+	if n.Mutation == nil {
+		n.Mutation = Polynomial{Eta: 20}
+	}
+	n.nObj = 0
+	n.parents = nil
+	n.offspring = nil
+}
+
+// Next generates an offspring from two parents chosen by binary tournament.
+// Until the initial population has been evaluated, random points are
+// generated.
+func (n *NSGA2) Next(x []float64) {
+	if len(n.parents) == 0 {
+		for i := range x {
+			x[i] = rand.NormFloat64()
+		}
+		return
+	}
+	a := n.parents[n.tournament()].loc
+	b := n.parents[n.tournament()].loc
+	n.Crossover.Crossover(x, a, b)
+	n.Mutation.Mutate(x)
+}
+
+// tournament returns the better of two random parents, comparing first by
+// rank and then by crowding distance
+func (n *NSGA2) tournament() int {
+	i := rand.Intn(len(n.parents))
+	j := rand.Intn(len(n.parents))
+	if crowdedLess(n.parents[j], n.parents[i]) {
+		return j
+	}
+	return i
+}
+
+func crowdedLess(a, b member) bool {
+	if a.rank != b.rank {
+		return a.rank < b.rank
+	}
+	return a.crowd > b.crowd
+}
+
+// Add treats the objective as a problem with a single objective. Once AddMulti
+// has been called, the point is instead given an infinite value in every
+// objective, since a single value can't be compared with the rest of the
+// population.
+func (n *NSGA2) Add(loc []float64, obj float64) {
+	if n.nObj == 0 {
+		n.addMember(loc, []float64{obj})
+		return
+	}
+	n.addMember(loc, infObjs(n.nObj))
+}
+
+// AddMulti adds the result to the offspring, and selects new parents once a
+// full generation of offspring has been evaluated
+func (n *NSGA2) AddMulti(loc []float64, objs []float64) {
+	if len(objs) == 0 {
+		n.Add(loc, math.Inf(1))
+		return
+	}
+	if n.nObj == 0 {
+		n.nObj = len(objs)
+		// The points given to Add so far can't be compared with this one
+		for _, pop := range [][]member{n.parents, n.offspring} {
+			for i := range pop {
+				pop[i].objs = infObjs(n.nObj)
+			}
+		}
+	}
+	if len(objs) != n.nObj {
+		n.addMember(loc, infObjs(n.nObj))
+		return
+	}
+	objsCopy := make([]float64, len(objs))
+	copy(objsCopy, objs)
+	n.addMember(loc, objsCopy)
+}
+
+// addMember adds a new offspring, which keeps objs
+func (n *NSGA2) addMember(loc []float64, objs []float64) {
+	n.offspring = append(n.offspring, member{loc: copyLoc(loc), objs: objs})
+	if len(n.offspring) < n.PopSize {
+		return
+	}
+	combined := append(n.parents, n.offspring...)
+	n.parents = selectSurvivors(combined, n.PopSize)
+	n.offspring = nil
+}
+
+func infObjs(nObj int) []float64 {
+	objs := make([]float64, nObj)
+	for i := range objs {
+		objs[i] = math.Inf(1)
+	}
+	return objs
+}
+
+// selectSurvivors returns the best size members, filling in front by front and
+// breaking ties in the last front by crowding distance
+func selectSurvivors(pop []member, size int) []member {
+	fronts := nonDominatedSort(pop)
+	survivors := make([]member, 0, size)
+	for _, front := range fronts {
+		setCrowding(pop, front)
+		if len(survivors)+len(front) > size {
+			sort.Slice(front, func(i, j int) bool { return pop[front[i]].crowd > pop[front[j]].crowd })
+			front = front[:size-len(survivors)]
+		}
+		for _, idx := range front {
+			survivors = append(survivors, pop[idx])
+		}
+		if len(survivors) == size {
+			break
+		}
+	}
+	return survivors
+}
+
+// nonDominatedSort sets the rank of every member and returns the indices of
+// the members of each front
+func nonDominatedSort(pop []member) [][]int {
+	dominatedBy := make([]int, len(pop)) // Number of members dominating i
+	dominates := make([][]int, len(pop)) // Members dominated by i
+	var front []int
+	for i := range pop {
+		for j := range pop {
+			if i == j {
+				continue
+			}
+			if dominatesObjs(pop[i].objs, pop[j].objs) {
+				dominates[i] = append(dominates[i], j)
+			} else if dominatesObjs(pop[j].objs, pop[i].objs) {
+				dominatedBy[i]++
+			}
+		}
+		if dominatedBy[i] == 0 {
+			front = append(front, i)
+		}
+	}
+	var fronts [][]int
+	for rank := 0; len(front) > 0; rank++ {
+		fronts = append(fronts, front)
+		var next []int
+		for _, i := range front {
+			pop[i].rank = rank
+			for _, j := range dominates[i] {
+				dominatedBy[j]--
+				if dominatedBy[j] == 0 {
+					next = append(next, j)
+				}
+			}
+		}
+		front = next
+	}
+	return fronts
+}
+
+// setCrowding sets the crowding distance of the members of a front. The
+// distance is the sum over the objectives of the normalized gap between each
+// member's neighbors. The extreme members have infinite distance so they are
+// always kept.
+func setCrowding(pop []member, front []int) {
+	for _, i := range front {
+		pop[i].crowd = 0
+	}
+	if len(front) == 0 {
+		return
+	}
+	idx := make([]int, len(front))
+	copy(idx, front)
+	nObj := len(pop[front[0]].objs)
+	for m := 0; m < nObj; m++ {
+		sort.Slice(idx, func(i, j int) bool { return pop[idx[i]].objs[m] < pop[idx[j]].objs[m] })
+		lo := pop[idx[0]].objs[m]
+		hi := pop[idx[len(idx)-1]].objs[m]
+		pop[idx[0]].crowd = math.Inf(1)
+		pop[idx[len(idx)-1]].crowd = math.Inf(1)
+		if hi == lo {
+			continue
+		}
+		for k := 1; k < len(idx)-1; k++ {
+			pop[idx[k]].crowd += (pop[idx[k+1]].objs[m] - pop[idx[k-1]].objs[m]) / (hi - lo)
+		}
+	}
+}
+
+func dominatesObjs(a, b []float64) bool {
+	var better bool
+	for i, v := range a {
+		if v > b[i] {
+			return false
+		}
+		if v < b[i] {
+			better = true
+		}
+	}
+	return better
+}
@@ -0,0 +1,178 @@
+package controller
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func members(objs ...[]float64) []member {
+	pop := make([]member, len(objs))
+	for i, o := range objs {
+		pop[i] = member{loc: []float64{float64(i)}, objs: o}
+	}
+	return pop
+}
+
+func TestNonDominatedSort(t *testing.T) {
+	pop := members(
+		[]float64{1, 4}, // front 0
+		[]float64{2, 2}, // front 0
+		[]float64{4, 1}, // front 0
+		[]float64{3, 3}, // dominated by (2, 2)
+		[]float64{4, 4}, // dominated by (3, 3)
+		[]float64{2, 5}, // dominated by (1, 4)
+	)
+	fronts := nonDominatedSort(pop)
+	want := []int{0, 0, 0, 1, 2, 1}
+	for i, m := range pop {
+		if m.rank != want[i] {
+			t.Errorf("member %v has rank %d, want %d", m.objs, m.rank, want[i])
+		}
+	}
+	if len(fronts) != 3 || len(fronts[0]) != 3 || len(fronts[1]) != 2 || len(fronts[2]) != 1 {
+		t.Errorf("fronts %v, want sizes 3, 2 and 1", fronts)
+	}
+}
+
+func TestSetCrowding(t *testing.T) {
+	pop := members(
+		[]float64{0, 4},
+		[]float64{1, 3},
+		[]float64{3, 1},
+		[]float64{4, 0},
+	)
+	setCrowding(pop, []int{0, 1, 2, 3})
+	if !math.IsInf(pop[0].crowd, 1) || !math.IsInf(pop[3].crowd, 1) {
+		t.Errorf("extreme members have crowding %v and %v, want infinite", pop[0].crowd, pop[3].crowd)
+	}
+	// The neighbors of (1, 3) are 3 apart in each objective, out of a range
+	// of 4
+	if math.Abs(pop[1].crowd-1.5) > 1e-12 || math.Abs(pop[2].crowd-1.5) > 1e-12 {
+		t.Errorf("inner crowding %v and %v, want 1.5", pop[1].crowd, pop[2].crowd)
+	}
+}
+
+func TestSelectSurvivors(t *testing.T) {
+	pop := members(
+		[]float64{0, 4},
+		[]float64{1, 3},
+		[]float64{1.1, 2.9}, // Right next to (1, 3)
+		[]float64{4, 0},
+		[]float64{5, 5},
+	)
+	survivors := selectSurvivors(pop, 3)
+	if len(survivors) != 3 {
+		t.Fatalf("%d survivors, want 3", len(survivors))
+	}
+	for _, m := range survivors {
+		if m.rank != 0 {
+			t.Errorf("dominated member %v survived", m.objs)
+		}
+	}
+	// Both extremes are kept, and one of the crowded pair
+	var extremes int
+	for _, m := range survivors {
+		if m.objs[0] == 0 || m.objs[0] == 4 {
+			extremes++
+		}
+	}
+	if extremes != 2 {
+		t.Errorf("survivors %v, want both extremes", survivors)
+	}
+}
+
+// schaffer has the Pareto set 0 <= x0 <= 2 with every other element zero
+func schaffer(x []float64) []float64 {
+	var rest float64
+	for _, v := range x[1:] {
+		rest += v * v
+	}
+	return []float64{x[0]*x[0] + rest, (x[0]-2)*(x[0]-2) + rest}
+}
+
+func TestNSGA2Converges(t *testing.T) {
+	n := &NSGA2{}
+	n.Init(3)
+	var out [][]float64
+	for evals := 0; evals < 4000 || len(out) > 0; {
+		if evals < 4000 && len(out) < 4 {
+			x := make([]float64, 3)
+			n.Next(x)
+			out = append(out, x)
+			evals++
+			continue
+		}
+		i := rand.Intn(len(out))
+		x := out[i]
+		out = append(out[:i], out[i+1:]...)
+		n.AddMulti(x, schaffer(x))
+	}
+	if len(n.parents) != 40 {
+		t.Fatalf("%d parents, want the default of 40", len(n.parents))
+	}
+	// Points off the Pareto set are only dominated by points closer to it,
+	// so the population approaches it slowly, but it starts out about 1.4
+	// away
+	var mean float64
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, m := range n.parents {
+		if m.rank != 0 {
+			t.Errorf("parent %v is dominated", m.objs)
+		}
+		dist := math.Hypot(m.loc[1], m.loc[2])
+		if dist > 0.5 {
+			t.Errorf("parent %v is far from the Pareto set", m.loc)
+		}
+		mean += dist / float64(len(n.parents))
+		lo = math.Min(lo, m.loc[0])
+		hi = math.Max(hi, m.loc[0])
+	}
+	if mean > 0.15 {
+		t.Errorf("average distance to the Pareto set %v", mean)
+	}
+	// The population spreads out along the whole front
+	if lo > 0.1 || hi < 1.9 {
+		t.Errorf("population covers %v <= x0 <= %v, want most of 0 to 2", lo, hi)
+	}
+}
+
+func TestNSGA2Add(t *testing.T) {
+	// Add is the single objective case, where the population converges to
+	// one point
+	n := &NSGA2{PopSize: 20}
+	best := run(n, 3, 3000, 4, shifted)
+	if best > 0.01 {
+		t.Errorf("best objective %v, want near 0", best)
+	}
+}
+
+func TestNSGA2Mixed(t *testing.T) {
+	// Failed points come through Add, or with the wrong number of
+	// objectives, and must not break the sort
+	n := &NSGA2{PopSize: 10}
+	n.Init(2)
+	for i := 0; i < 200; i++ {
+		x := make([]float64, 2)
+		n.Next(x)
+		switch {
+		case i < 3 || i%7 == 0:
+			n.Add(x, float64(i))
+		case i%11 == 0:
+			n.AddMulti(x, []float64{1})
+		default:
+			n.AddMulti(x, schaffer(x))
+		}
+	}
+	if len(n.parents) != 10 {
+		t.Fatalf("%d parents, want 10", len(n.parents))
+	}
+	for _, m := range n.parents {
+		if len(m.objs) != 2 {
+			t.Errorf("parent has objectives %v, want 2", m.objs)
+		}
+		if math.IsInf(m.objs[0], 1) {
+			t.Errorf("failed point %v kept over evaluated ones", m.loc)
+		}
+	}
+}
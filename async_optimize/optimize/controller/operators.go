@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Selection operators
+
+// Tournament selection picks Size random members of the population and
+// returns the best one. Larger tournaments put more pressure on the search
+// to use the best points.
+type Tournament struct {
+	Size int // Number of individuals in the tournament (minimum 1)
+}
+
+func (t Tournament) Select(pop []Individual) int {
+	best := rand.Intn(len(pop))
+	for i := 1; i < t.Size; i++ {
+		idx := rand.Intn(len(pop))
+		if pop[idx].Obj < pop[best].Obj {
+			best = idx
+		}
+	}
+	return best
+}
+
+// Roulette selection picks an individual with probability proportional to
+// how much better it is than the worst member of the population. The worst
+// member keeps a small chance of being selected.
+type Roulette struct{}
+
+func (Roulette) Select(pop []Individual) int {
+	best := math.Inf(1)
+	worst := math.Inf(-1)
+	for _, ind := range pop {
+		best = math.Min(best, ind.Obj)
+		worst = math.Max(worst, ind.Obj)
+	}
+	span := worst - best
+	if span == 0 || math.IsInf(span, 0) || math.IsNaN(span) {
+		return rand.Intn(len(pop))
+	}
+	floor := span / float64(len(pop))
+	var total float64
+	for _, ind := range pop {
+		total += worst - ind.Obj + floor
+	}
+	r := rand.Float64() * total
+	for i, ind := range pop {
+		r -= worst - ind.Obj + floor
+		if r <= 0 {
+			return i
+		}
+	}
+	return len(pop) - 1
+}
+
+// Crossover operators
+
+// SBX is simulated binary crossover. Children are spread around the parents
+// with a distribution controlled by Eta; large values of Eta keep the child
+// close to the parents.
+type SBX struct {
+	Eta float64
+}
+
+func (s SBX) Crossover(child, a, b []float64) {
+	for i := range child {
+		u := rand.Float64()
+		var beta float64
+		if u <= 0.5 {
+			beta = math.Pow(2*u, 1/(s.Eta+1))
+		} else {
+			beta = math.Pow(1/(2*(1-u)), 1/(s.Eta+1))
+		}
+		// Randomly pick which of the two possible children to produce
+		if rand.Intn(2) == 0 {
+			beta = -beta
+		}
+		child[i] = 0.5 * ((1+beta)*a[i] + (1-beta)*b[i])
+	}
+}
+
+// Blend is blend crossover (BLX-alpha). Each element of the child is chosen
+// uniformly from the interval spanned by the parents, extended by Alpha
+// times its width on each side.
+type Blend struct {
+	Alpha float64
+}
+
+func (bl Blend) Crossover(child, a, b []float64) {
+	for i := range child {
+		lo := math.Min(a[i], b[i])
+		hi := math.Max(a[i], b[i])
+		d := hi - lo
+		lo -= bl.Alpha * d
+		hi += bl.Alpha * d
+		child[i] = lo + rand.Float64()*(hi-lo)
+	}
+}
+
+// Uniform crossover takes each element from one of the two parents with
+// equal probability
+type Uniform struct{}
+
+func (Uniform) Crossover(child, a, b []float64) {
+	for i := range child {
+		if rand.Intn(2) == 0 {
+			child[i] = a[i]
+		} else {
+			child[i] = b[i]
+		}
+	}
+}
+
+// Mutation operators
+
+// Polynomial mutation perturbs elements with a polynomial distribution
+// controlled by Eta. The problems here are unbounded, so the perturbation
+// is at most Scale in magnitude. Each element is mutated with probability
+// Rate. If Rate is zero, one over the dimension is used, and if Scale is
+// zero it is set to one.
+type Polynomial struct {
+	Eta   float64
+	Rate  float64
+	Scale float64
+}
+
+func (p Polynomial) Mutate(x []float64) {
+	rate := p.Rate
+	if rate == 0 {
+		rate = 1 / float64(len(x))
+	}
+	scale := p.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	for i := range x {
+		if rand.Float64() >= rate {
+			continue
+		}
+		u := rand.Float64()
+		var delta float64
+		if u < 0.5 {
+			delta = math.Pow(2*u, 1/(p.Eta+1)) - 1
+		} else {
+			delta = 1 - math.Pow(2*(1-u), 1/(p.Eta+1))
+		}
+		x[i] += scale * delta
+	}
+}
+
+// Gaussian mutation adds normally distributed noise with standard deviation
+// Sigma. Each element is mutated with probability Rate. If Rate is zero,
+// one over the dimension is used.
+type Gaussian struct {
+	Sigma float64
+	Rate  float64
+}
+
+func (g Gaussian) Mutate(x []float64) {
+	rate := g.Rate
+	if rate == 0 {
+		rate = 1 / float64(len(x))
+	}
+	for i := range x {
+		if rand.Float64() < rate {
+			x[i] += g.Sigma * rand.NormFloat64()
+		}
+	}
+}
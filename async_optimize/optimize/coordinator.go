@@ -0,0 +1,58 @@
+package optimize
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// Normally the optimizer dials out to the evaluation servers, which means it
+// has to know where they all are before the run starts. In coordinator mode the
+// direction is reversed: Async listens on an address, and evaluation processes
+// dial in whenever they start up. Once the connection is made, everything
+// works the same as with a RemoteWorker. An evaluator that disconnects is
+// simply removed from the pool.
+
+// listen starts accepting remote evaluators
+func (async *Async) listen() error {
+	l, err := wire.Listen(async.ListenTransport, async.Listen, async.ListenTLS)
+	if err != nil {
+		return err
+	}
+	async.listener = l
+	// Number the evaluators after the workers given up front
+	async.mu.Lock()
+	id := len(async.Workers)
+	async.mu.Unlock()
+	go async.accept(l, id)
+	return nil
+}
+
+// accept turns every incoming connection into a worker until the listener is
+// closed
+func (async *Async) accept(l net.Listener, id int) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		worker := &RemoteWorker{
+			Id:         id,
+			Output:     async.PrintReturns,
+			MaxRetries: -1, // There is no address to reconnect to
+			Secret:     async.ListenSecret,
+			accepted:   conn,
+		}
+		if async.PrintReturns {
+			fmt.Printf("worker %d connected from %v\n", id, conn.RemoteAddr())
+		}
+		id++
+		select {
+		case async.addWorker <- worker:
+		case <-async.quitWorker:
+			conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package optimize
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/functions"
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// evaluator returns a receiver which dials in to the test's optimizer
+func evaluator(pipe *wire.Pipe, slots int) *functions.RemoteReceiver {
+	return &functions.RemoteReceiver{
+		Transport:     pipe,
+		MaxConcurrent: slots,
+		Log:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+// connect runs r.Connect, retrying until the optimizer is listening
+func connect(t *testing.T, r *functions.RemoteReceiver) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			err := r.Connect(t.Name())
+			if err == nil || time.Now().After(deadline) {
+				done <- err
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	return done
+}
+
+// coordinator starts an optimization of sphere which waits for evaluators
+func coordinator(t *testing.T, c *counter) (*Async, *wire.Pipe, <-chan error) {
+	pipe := &wire.Pipe{}
+	async := &Async{
+		MaxFunEvals:     100,
+		NumDim:          2,
+		Listen:          t.Name(),
+		ListenTransport: pipe,
+		Controller:      c,
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := async.Optimize(sphere{})
+		done <- err
+	}()
+	return async, pipe, done
+}
+
+func checkResults(t *testing.T, c *counter, n int) {
+	if len(c.objs) != n {
+		t.Errorf("controller got %d results, want %d", len(c.objs), n)
+	}
+	for i, obj := range c.objs {
+		if obj != (sphere{}).Obj(c.locs[i]) {
+			t.Errorf("result %v at %v is not the objective", obj, c.locs[i])
+		}
+	}
+}
+
+func TestCoordinator(t *testing.T) {
+	c := &counter{}
+	async, pipe, done := coordinator(t, c)
+	// Each of the evaluator's connections is a worker
+	connected := connect(t, evaluator(pipe, 2))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-connected; err != nil {
+		t.Errorf("Connect returned %v", err)
+	}
+	checkResults(t, c, 100)
+	if n := len(async.WorkerStats()); n != 2 {
+		t.Errorf("%d workers, want 2", n)
+	}
+}
+
+func TestCoordinatorEvaluatorLeaves(t *testing.T) {
+	c := &counter{}
+	_, pipe, done := coordinator(t, c)
+	first := evaluator(pipe, 2)
+	connected := connect(t, first)
+	// Shut the first evaluator down part of the way through
+	deadline := time.Now().Add(5 * time.Second)
+	for first.Stats().Evaluations < 20 {
+		if time.Now().After(deadline) {
+			t.Fatal("evaluator did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := first.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-connected; err != nil {
+		t.Errorf("Connect returned %v", err)
+	}
+	// The optimizer keeps waiting until another evaluator connects
+	select {
+	case err := <-done:
+		t.Fatalf("Optimize returned %v with no evaluators", err)
+	default:
+	}
+	connected = connect(t, evaluator(pipe, 1))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	<-connected
+	checkResults(t, c, 100)
+}
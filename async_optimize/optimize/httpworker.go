@@ -0,0 +1,146 @@
+package optimize
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// An HTTPWorker is a worker which evaluates the objective function by POSTing
+// each point to URL as JSON. The server can be written in any language; the
+// format is described in the wire package, and functions.HTTPHandler serves it
+// for a Go objective function. The objective function passed to Optimize is
+// not used, the server decides what to evaluate.
+//
+// Up to Concurrency requests are made at once. If a request fails or the
+// server answers with something other than an evaluation, the point is given
+// back to Async and the worker stops. An error reported by the objective is
+// passed to Async in Ans.Err, as is a request which takes longer than Timeout,
+// since a slow point would be just as slow on another server.
+type HTTPWorker struct {
+	read  <-chan []float64 // channel for reading in values to evaluate
+	write chan<- Ans       // channel for returning the evaulated objectives
+	quit  <-chan bool      // Channel to signal closure of the goroutine upon completion
+
+	Id     int // ID of the worker
+	Output bool
+
+	URL         string
+	Concurrency int           // Number of requests made at once (default 1)
+	Timeout     time.Duration // Time allowed for each request (default none)
+	Client      *http.Client  // Client for the requests (default http.DefaultClient)
+
+	lastID uint64 // ID of the last request, updated atomically
+
+	mu     sync.Mutex
+	ctx    context.Context // Context of every request
+	cancel context.CancelFunc
+}
+
+func (h *HTTPWorker) Init(read <-chan []float64, write chan<- Ans, fun Objer, quit <-chan bool) error {
+	if h.URL == "" {
+		return errors.New("httpworker: no URL")
+	}
+	h.read = read
+	h.write = write
+	h.quit = quit
+	h.mu.Lock()
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	h.mu.Unlock()
+	return nil
+}
+
+// Cancel aborts the requests in progress
+func (h *HTTPWorker) Cancel() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cancel != nil {
+		h.cancel()
+	}
+}
+
+// Slots returns the number of requests made at once
+func (h *HTTPWorker) Slots() int {
+	if h.Concurrency <= 0 {
+		return 1
+	}
+	return h.Concurrency
+}
+
+// Run runs the worker
+func (h *HTTPWorker) Run() error {
+	return runSlots(h.Id, h.Output, h.Slots(), h.read, h.write, h.quit, h.post)
+}
+
+// post evaluates x on the server. A non-nil error means the server could not
+// be used, while a failed evaluation is returned in Ans.Err.
+func (h *HTTPWorker) post(x []float64) (Ans, error) {
+	id := atomic.AddUint64(&h.lastID, 1)
+	body, err := json.Marshal(wire.EvalRequest{ID: id, X: wire.ToFloats(x)})
+	if err != nil {
+		return Ans{}, err
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	h.mu.Lock()
+	parent := h.ctx
+	h.mu.Unlock()
+	ctx := parent
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, h.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return Ans{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return h.timedOut(x, parent, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Ans{}, fmt.Errorf("httpworker: %s", resp.Status)
+	}
+	var r wire.EvalResponse
+	data, err := io.ReadAll(resp.Body)
+	if err == nil {
+		err = wire.UnmarshalResponse(data, &r)
+	}
+	if err != nil {
+		if ans, terr := h.timedOut(x, parent, err); terr == nil {
+			return ans, nil
+		}
+		return Ans{}, fmt.Errorf("httpworker: bad response: %v", err)
+	}
+	return evalAnswer(x, r)
+}
+
+// timedOut returns the answer for a request which failed with err. If the
+// request took too long, either because of Timeout or the Client's own
+// timeout, that is the point's fault and the error goes in Ans.Err.
+// Otherwise, or if the worker was canceled, the error is returned.
+func (h *HTTPWorker) timedOut(x []float64, parent context.Context, err error) (Ans, error) {
+	if perr := parent.Err(); perr != nil {
+		return Ans{}, perr
+	}
+	var nerr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &nerr) && nerr.Timeout()) {
+		return Ans{Loc: x, Err: fmt.Errorf("httpworker: evaluation took too long: %v", err)}, nil
+	}
+	return Ans{}, err
+}
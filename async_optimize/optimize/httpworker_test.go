@@ -0,0 +1,80 @@
+package optimize
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/functions"
+)
+
+func TestHTTPWorker(t *testing.T) {
+	server := httptest.NewServer(functions.HTTPHandler{Objer: sphere{}})
+	defer server.Close()
+	read, write, quit, done := startWorker(t, &HTTPWorker{URL: server.URL})
+
+	// A controller may propose points which are not finite. They are the
+	// point's problem, not the worker's.
+	for _, x := range [][]float64{{1, 2}, {math.Inf(1), 0}, {math.NaN(), 0}, {3, 0}} {
+		read <- x
+		ans := <-write
+		want := (sphere{}).Obj(x)
+		if ans.Err != nil || (ans.Obj != want && !(math.IsNaN(want) && math.IsNaN(ans.Obj))) {
+			t.Errorf("answer %+v at %v, want %v", ans, x, want)
+		}
+	}
+	close(quit)
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+}
+
+func TestHTTPWorkerBrokenServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	read, write, _, done := startWorker(t, &HTTPWorker{URL: server.URL})
+	read <- []float64{1}
+	if ans := <-write; ans.Err == nil {
+		t.Error("no error from a broken server")
+	} else if _, ok := ans.Err.(*WorkerError); !ok {
+		t.Errorf("error %v, want a WorkerError", ans.Err)
+	}
+	if err := <-done; err == nil {
+		t.Error("worker kept running with a broken server")
+	}
+}
+
+// slowNegative takes a while at points with a negative first element
+type slowNegative struct{}
+
+func (slowNegative) Obj(x []float64) float64 {
+	if x[0] < 0 {
+		time.Sleep(200 * time.Millisecond)
+	}
+	return (sphere{}).Obj(x)
+}
+
+func TestHTTPWorkerTimeout(t *testing.T) {
+	server := httptest.NewServer(functions.HTTPHandler{Objer: slowNegative{}})
+	defer server.Close()
+	read, write, quit, done := startWorker(t, &HTTPWorker{URL: server.URL, Timeout: 20 * time.Millisecond})
+	// Taking too long is the point's fault, so the worker keeps going
+	read <- []float64{-1}
+	if ans := <-write; ans.Err == nil {
+		t.Error("no error from a point which took too long")
+	} else if _, ok := ans.Err.(*WorkerError); ok {
+		t.Errorf("error %v is a WorkerError", ans.Err)
+	}
+	read <- []float64{1, 2}
+	if ans := <-write; ans.Err != nil || ans.Obj != 5 {
+		t.Errorf("answer %+v after a timeout", ans)
+	}
+	close(quit)
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+}
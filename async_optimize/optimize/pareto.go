@@ -0,0 +1,225 @@
+package optimize
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Many design problems have several competing objectives, like cost and
+// performance. There is usually no single best point, but instead a set of
+// points where no objective can be improved without making another one worse.
+// This set is called the Pareto front.
+
+// MultiObjer is an objective function with several objectives, all of which
+// are to be minimized. Workers call Objs, and use the first objective as the
+// scalar objective value of the answer. Obj is still needed so that a
+// MultiObjer can be used everywhere an Objer is expected. Objs must return
+// the same number of objectives every time; Async treats a point where it
+// returns none, or a different number than the first point, as a point where
+// the objective failed.
+type MultiObjer interface {
+	Objer
+	Objs([]float64) []float64
+}
+
+// MultiAdder is a controller that can use all of the objective values of a
+// MultiObjer. If the controller is a MultiAdder, Async calls AddMulti instead
+// of Add for multi-objective results. A point where the objective failed is
+// given to AddMulti with an infinite value in every objective, or to Add if no
+// point has been evaluated yet.
+type MultiAdder interface {
+	AddMulti(loc []float64, objs []float64)
+}
+
+// Dominates returns true if a is at least as good as b in every objective,
+// and strictly better in at least one
+func Dominates(a, b []float64) bool {
+	if len(a) != len(b) {
+		panic("length mismatch")
+	}
+	var better bool
+	for i, v := range a {
+		if v > b[i] {
+			return false
+		}
+		if v < b[i] {
+			better = true
+		}
+	}
+	return better
+}
+
+// ParetoArchive stores the non-dominated set of the answers it has been given
+type ParetoArchive struct {
+	front []Ans
+}
+
+// Add adds the answer to the archive if it is not dominated by any member.
+// Any members that it dominates are removed. The return value is true if the
+// answer was added. An answer with a different number of objectives than the
+// members can't be compared with them, and is not added.
+func (p *ParetoArchive) Add(ans Ans) bool {
+	if len(ans.Objs) == 0 {
+		return false
+	}
+	if len(p.front) > 0 && len(ans.Objs) != len(p.front[0].Objs) {
+		return false
+	}
+	n := 0
+	for _, member := range p.front {
+		if Dominates(member.Objs, ans.Objs) || equalObjs(member.Objs, ans.Objs) {
+			return false
+		}
+		if !Dominates(ans.Objs, member.Objs) {
+			p.front[n] = member
+			n++
+		}
+	}
+	p.front = p.front[:n]
+
+	// The location memory is reused by Async, so copy it
+	loc := make([]float64, len(ans.Loc))
+	copy(loc, ans.Loc)
+	objs := make([]float64, len(ans.Objs))
+	copy(objs, ans.Objs)
+	p.front = append(p.front, Ans{Loc: loc, Obj: ans.Obj, Objs: objs})
+	return true
+}
+
+func equalObjs(a, b []float64) bool {
+	for i, v := range a {
+		if v != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Len returns the number of points in the archive
+func (p *ParetoArchive) Len() int {
+	return len(p.front)
+}
+
+// Front returns the non-dominated answers sorted by the first objective
+func (p *ParetoArchive) Front() []Ans {
+	front := make([]Ans, len(p.front))
+	copy(front, p.front)
+	sort.Slice(front, func(i, j int) bool { return front[i].Objs[0] < front[j].Objs[0] })
+	return front
+}
+
+// Hypervolume returns the volume of objective space dominated by the archive
+// and bounded by the reference point ref. Larger is better. Points which
+// do not dominate ref do not contribute. ref must have a value for every
+// objective; Hypervolume panics if it does not.
+func (p *ParetoArchive) Hypervolume(ref []float64) float64 {
+	if len(p.front) > 0 && len(ref) != len(p.front[0].Objs) {
+		panic(fmt.Sprintf("pareto: reference point has %d values for %d objectives", len(ref), len(p.front[0].Objs)))
+	}
+	pts := make([][]float64, 0, len(p.front))
+	for _, ans := range p.front {
+		if Dominates(ans.Objs, ref) {
+			pts = append(pts, ans.Objs)
+		}
+	}
+	return hypervolume(pts, ref)
+}
+
+// hypervolume computes the hypervolume by slicing along the last objective.
+// The points are sorted by the last objective, and each slab between
+// consecutive values contributes the (d-1)-dimensional hypervolume of the
+// points below it times the slab height. This is exponential in the number
+// of objectives, but is fine for the small number typically used.
+func hypervolume(pts [][]float64, ref []float64) float64 {
+	if len(pts) == 0 {
+		return 0
+	}
+	d := len(ref)
+	if d == 1 {
+		best := math.Inf(1)
+		for _, p := range pts {
+			best = math.Min(best, p[0])
+		}
+		return ref[0] - best
+	}
+	sorted := make([][]float64, len(pts))
+	copy(sorted, pts)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i][d-1] < sorted[j][d-1] })
+
+	var volume float64
+	for i, p := range sorted {
+		top := ref[d-1]
+		if i+1 < len(sorted) {
+			top = sorted[i+1][d-1]
+		}
+		height := top - p[d-1]
+		if height == 0 {
+			continue
+		}
+		// Project the points in the slab onto the first d-1 objectives
+		proj := make([][]float64, i+1)
+		for j := range proj {
+			proj[j] = sorted[j][:d-1]
+		}
+		volume += hypervolume(nonDominated(proj), ref[:d-1]) * height
+	}
+	return volume
+}
+
+func nonDominated(pts [][]float64) [][]float64 {
+	var front [][]float64
+	for i, p := range pts {
+		dominated := false
+		for j, q := range pts {
+			if i != j && (Dominates(q, p) || (j < i && equalObjs(q, p))) {
+				dominated = true
+				break
+			}
+		}
+		if !dominated {
+			front = append(front, p)
+		}
+	}
+	return front
+}
+
+// WriteCSV writes the non-dominated set to w. Each row contains the location
+// followed by the objective values.
+func (p *ParetoArchive) WriteCSV(w io.Writer) error {
+	front := p.Front()
+	if len(front) == 0 {
+		return errors.New("pareto: archive is empty")
+	}
+	cw := csv.NewWriter(w)
+	nDim := len(front[0].Loc)
+	nObj := len(front[0].Objs)
+	header := make([]string, 0, nDim+nObj)
+	for i := 0; i < nDim; i++ {
+		header = append(header, "x"+strconv.Itoa(i))
+	}
+	for i := 0; i < nObj; i++ {
+		header = append(header, "f"+strconv.Itoa(i))
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	row := make([]string, nDim+nObj)
+	for _, ans := range front {
+		for i, v := range ans.Loc {
+			row[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		for i, v := range ans.Objs {
+			row[nDim+i] = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,240 @@
+package optimize
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/btracey/goexamples/async_optimize/optimize/controller"
+)
+
+func TestDominates(t *testing.T) {
+	for _, test := range []struct {
+		a, b []float64
+		want bool
+	}{
+		{[]float64{1, 1}, []float64{2, 2}, true},
+		{[]float64{1, 2}, []float64{2, 2}, true},
+		{[]float64{2, 2}, []float64{2, 2}, false},
+		{[]float64{1, 3}, []float64{2, 2}, false},
+		{[]float64{3, 3}, []float64{2, 2}, false},
+	} {
+		if got := Dominates(test.a, test.b); got != test.want {
+			t.Errorf("Dominates(%v, %v) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestParetoArchiveAdd(t *testing.T) {
+	p := &ParetoArchive{}
+	add := func(f0, f1 float64) bool {
+		return p.Add(Ans{Loc: []float64{f0}, Obj: f0, Objs: []float64{f0, f1}})
+	}
+	if !add(2, 2) || !add(1, 3) || !add(3, 1) {
+		t.Fatal("non-dominated answer rejected")
+	}
+	if add(3, 3) {
+		t.Error("dominated answer added")
+	}
+	if add(2, 2) {
+		t.Error("duplicate answer added")
+	}
+	if p.Add(Ans{Loc: []float64{0}, Obj: 0}) {
+		t.Error("answer without objectives added")
+	}
+	// Dominates (2, 2) and (3, 1), but not (1, 3)
+	if !add(1.5, 0.5) {
+		t.Fatal("dominating answer rejected")
+	}
+	front := p.Front()
+	if len(front) != 2 || front[0].Objs[0] != 1 || front[1].Objs[0] != 1.5 {
+		t.Errorf("front %v, want (1, 3) and (1.5, 0.5)", front)
+	}
+}
+
+func TestParetoArchiveCopies(t *testing.T) {
+	p := &ParetoArchive{}
+	ans := Ans{Loc: []float64{1, 2}, Objs: []float64{3, 4}}
+	p.Add(ans)
+	ans.Loc[0] = 10
+	ans.Objs[0] = 10
+	got := p.Front()[0]
+	if got.Loc[0] != 1 || got.Objs[0] != 3 {
+		t.Errorf("archive shares memory with the answer: %v", got)
+	}
+}
+
+func TestHypervolume(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		pts  [][]float64
+		ref  []float64
+		want float64
+	}{
+		{"empty", nil, []float64{1, 1}, 0},
+		{"one point", [][]float64{{1, 1}}, []float64{3, 4}, 6},
+		// A staircase of unit steps
+		{"staircase", [][]float64{{1, 3}, {2, 2}, {3, 1}}, []float64{4, 4}, 6},
+		{"outside the reference", [][]float64{{1, 1}, {5, 0}}, []float64{2, 2}, 1},
+		{"box", [][]float64{{0, 0, 0}}, []float64{1, 2, 3}, 6},
+		// Two boxes of 4 and 2 overlapping in a unit cube
+		{"two boxes", [][]float64{{0, 0, 1}, {1, 1, 0}}, []float64{2, 2, 2}, 5},
+	} {
+		p := &ParetoArchive{}
+		for _, objs := range test.pts {
+			p.Add(Ans{Loc: []float64{0}, Objs: objs})
+		}
+		if got := p.Hypervolume(test.ref); math.Abs(got-test.want) > 1e-12 {
+			t.Errorf("%s: hypervolume %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHypervolumeLinearFront(t *testing.T) {
+	// Points on f0 + f1 = 1 approach the area under the line as the front
+	// gets denser, and the staircase always stays below it
+	p := &ParetoArchive{}
+	n := 100
+	for i := 0; i <= n; i++ {
+		f := float64(i) / float64(n)
+		p.Add(Ans{Loc: []float64{f}, Objs: []float64{f, 1 - f}})
+	}
+	got := p.Hypervolume([]float64{1, 1})
+	if got > 0.5 || got < 0.5-1.0/float64(n) {
+		t.Errorf("hypervolume %v, want just under 0.5", got)
+	}
+}
+
+func TestParetoArchiveWriteCSV(t *testing.T) {
+	p := &ParetoArchive{}
+	if err := p.WriteCSV(&bytes.Buffer{}); err == nil {
+		t.Error("no error writing an empty archive")
+	}
+	p.Add(Ans{Loc: []float64{0.5, 1}, Objs: []float64{2, 1}})
+	p.Add(Ans{Loc: []float64{0.25, 1}, Objs: []float64{1, 2}})
+	var buf bytes.Buffer
+	if err := p.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "x0,x1,f0,f1\n0.25,1,1,2\n0.5,1,2,1\n"
+	if buf.String() != want {
+		t.Errorf("csv\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+// twoObjectives has the Pareto set 0 <= x0 <= 2, x1 = 0
+type twoObjectives struct{}
+
+func (twoObjectives) Obj(x []float64) float64 {
+	return twoObjectives{}.Objs(x)[0]
+}
+
+func (twoObjectives) Objs(x []float64) []float64 {
+	return []float64{x[0]*x[0] + x[1]*x[1], (x[0]-2)*(x[0]-2) + x[1]*x[1]}
+}
+
+// multiRecorder samples uniformly and counts how the results arrive
+type multiRecorder struct {
+	adds, multis int
+}
+
+func (m *multiRecorder) Next(x []float64) {
+	for i := range x {
+		x[i] = 4*rand.Float64() - 1
+	}
+}
+
+func (m *multiRecorder) Add(x []float64, obj float64) {
+	m.adds++
+}
+
+func (m *multiRecorder) AddMulti(x []float64, objs []float64) {
+	m.multis++
+	if objs[0] != (twoObjectives{}).Objs(x)[0] {
+		panic("objectives do not belong to the location")
+	}
+}
+
+func localWorkers(n int) []Worker {
+	workers := make([]Worker, n)
+	for i := range workers {
+		workers[i] = &LocalWorker{Id: i}
+	}
+	return workers
+}
+
+func TestAsyncPareto(t *testing.T) {
+	rec := &multiRecorder{}
+	async := &Async{
+		MaxFunEvals: 500,
+		NumDim:      2,
+		Workers:     localWorkers(4),
+		Controller:  rec,
+	}
+	ans, err := async.Optimize(twoObjectives{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.multis != 500 || rec.adds != 0 {
+		t.Errorf("controller got %d results by AddMulti and %d by Add, want all 500 by AddMulti", rec.multis, rec.adds)
+	}
+	if ans.Obj != (twoObjectives{}).Obj(ans.Loc) {
+		t.Errorf("best objective %v is not the first objective at %v", ans.Obj, ans.Loc)
+	}
+	front := async.Pareto().Front()
+	if len(front) < 5 {
+		t.Fatalf("only %d points in the front", len(front))
+	}
+	for i, a := range front {
+		if a.Loc[0] < -0.5 || a.Loc[0] > 2.5 {
+			t.Errorf("front point %v is far from the Pareto set", a.Loc)
+		}
+		for _, b := range front[i+1:] {
+			if Dominates(a.Objs, b.Objs) || Dominates(b.Objs, a.Objs) {
+				t.Errorf("front contains %v and %v, one of which dominates the other", a.Objs, b.Objs)
+			}
+		}
+	}
+}
+
+// changingObjectives is twoObjectives until it has been called 20 times,
+// and then returns a third objective
+type changingObjectives struct {
+	twoObjectives
+	calls int
+}
+
+func (c *changingObjectives) Objs(x []float64) []float64 {
+	c.calls++
+	objs := c.twoObjectives.Objs(x)
+	if c.calls > 20 {
+		objs = append(objs, 0)
+	}
+	return objs
+}
+
+func TestAsyncChangingObjectives(t *testing.T) {
+	async := &Async{
+		MaxFunEvals: 100,
+		NumDim:      2,
+		Workers:     localWorkers(1),
+		Controller:  &controller.NSGA2{PopSize: 10},
+	}
+	// The points with a third objective can't be compared with the others,
+	// so the objective failed at them
+	if _, err := async.Optimize(&changingObjectives{}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := async.WorkerStats(); stats[0].Failures != 80 {
+		t.Errorf("worker stats %+v, want 80 failures", stats)
+	}
+	for _, a := range async.Pareto().Front() {
+		if len(a.Objs) != 2 {
+			t.Errorf("front point %v has %d objectives", a.Loc, len(a.Objs))
+		}
+	}
+	if got := async.Pareto().Hypervolume([]float64{10, 10}); got <= 0 {
+		t.Errorf("hypervolume %v", got)
+	}
+}
@@ -0,0 +1,432 @@
+package optimize
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// The set of workers can change while Optimize is running. Workers can be
+// added and removed by the user, evaluators can connect in coordinator mode,
+// and workers can fail. Every worker gets its own quit channel, so that a
+// single worker can be told to stop. A worker only checks its quit channel
+// between evaluations, so a removed worker finishes ("drains") the point it
+// is working on before it stops.
+//
+// Every worker also gets its own channel of points, with room for as many as
+// the worker has slots, so that the Scheduler can choose where each point
+// goes. The worker's answers are passed on to Optimize by a goroutine which
+// adds which worker they came from.
+
+// MultiWorker is a worker that can evaluate several points at once. Async keeps
+// up to Slots points in flight for the worker instead of one.
+type MultiWorker interface {
+	Worker
+	Slots() int
+}
+
+// Canceler is a worker that can abandon the evaluations it has started, for
+// example by telling a server to stop working on them. Async calls Cancel on
+// every worker that is still running when it stops. The worker must still
+// send back every point it has read, with a *WorkerError in Ans.Err, before it
+// stops.
+type Canceler interface {
+	Worker
+	Cancel()
+}
+
+// poolEntry is the state Async keeps for a running worker
+type poolEntry struct {
+	worker   Worker
+	quit     chan bool
+	in       chan []float64 // Points for the worker, with room for slots of them
+	out      chan Ans       // Answers from the worker
+	slots    int            // Number of points the worker can evaluate at once
+	caps     wire.Capabilities
+	ready    bool // Init has succeeded, so the worker can be sent points
+	draining bool // The worker has been told to quit, but has not yet stopped
+	stopped  bool
+
+	inFlight    int           // Points sent to the worker and not yet answered
+	evaluations int           // Points answered
+	failures    int           // Points the objective function failed at
+	busy        time.Duration // inFlight added up over time (see schedule.go)
+	changed     time.Time     // When inFlight last changed
+}
+
+// workerAns is an answer passed on from a worker. If returned is true, the
+// worker stopped without reading the point, and ans only holds Loc.
+type workerAns struct {
+	entry    *poolEntry
+	ans      Ans
+	returned bool
+}
+
+// workerReady is sent to Optimize when a worker has been initialized
+type workerReady struct {
+	entry *poolEntry
+	caps  wire.Capabilities
+}
+
+// workerDone is sent to Optimize when a worker stops
+type workerDone struct {
+	entry *poolEntry
+	err   error
+}
+
+// sameWorker returns whether a and b are the same worker. Comparing interfaces
+// with == panics if the values can't be compared, in which case they are
+// treated as different.
+func sameWorker(a, b Worker) bool {
+	if !reflect.ValueOf(a).Comparable() || !reflect.ValueOf(b).Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// find returns the pool's entry for the worker, or nil if it is not running
+func (async *Async) find(worker Worker) *poolEntry {
+	for entry := range async.pool {
+		if sameWorker(entry.worker, worker) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// AddWorker adds a worker to the pool. It is appended to Workers, so it is
+// used by later calls to Optimize as well. If Optimize is running, the worker
+// is also started right away and Async starts sending it points. A worker
+// added just as a run finishes is not used until the next one.
+func (async *Async) AddWorker(worker Worker) {
+	async.mu.Lock()
+	async.Workers = append(async.Workers, worker)
+	if !async.running {
+		async.mu.Unlock()
+		return
+	}
+	add, finished := async.addWorker, async.quitWorker
+	async.mu.Unlock()
+	select {
+	case add <- worker:
+	case <-finished:
+	}
+}
+
+// RemoveWorker removes a worker from the pool. It is removed from Workers, so
+// later calls to Optimize don't use it either. If Optimize is running, the
+// worker also finishes its current evaluation and then stops, and Async
+// reduces the number of points it keeps in flight. If every worker is removed
+// from a running optimization, Optimize returns an error unless Listen is set.
+//
+// The worker is found by comparing it with ==, so a worker whose value can not
+// be compared (a struct holding a slice, for example) can not be removed. Use
+// a pointer to it instead.
+func (async *Async) RemoveWorker(worker Worker) {
+	async.mu.Lock()
+	for i, w := range async.Workers {
+		if sameWorker(w, worker) {
+			async.Workers = append(async.Workers[:i], async.Workers[i+1:]...)
+			break
+		}
+	}
+	if !async.running {
+		async.mu.Unlock()
+		return
+	}
+	remove, finished := async.removeWorker, async.quitWorker
+	async.mu.Unlock()
+	select {
+	case remove <- worker:
+	case <-finished:
+	}
+}
+
+// startWorker launches the worker in its own goroutine. It is not sent any
+// points until Init has succeeded.
+func (async *Async) startWorker(worker Worker) {
+	if async.find(worker) != nil {
+		// Already running
+		return
+	}
+	slots := 1
+	if m, ok := worker.(MultiWorker); ok && m.Slots() > 1 {
+		slots = m.Slots()
+	}
+	entry := &poolEntry{
+		worker: worker,
+		quit:   make(chan bool),
+		in:     make(chan []float64, slots),
+		out:    make(chan Ans),
+		slots:  slots,
+	}
+	async.pool[entry] = true
+	async.started = append(async.started, entry)
+	async.live.Add(1)
+	go func() {
+		defer async.live.Done()
+		forwarded := make(chan struct{})
+		go func() {
+			for ans := range entry.out {
+				async.fromWorker <- workerAns{entry: entry, ans: ans}
+			}
+			close(forwarded)
+		}()
+		err := async.runWorker(entry)
+		close(entry.out)
+		<-forwarded
+		// The worker may have stopped with points still in its channel.
+		// Every point sent has to come back, so return them.
+	Returned:
+		for {
+			select {
+			case x := <-entry.in:
+				async.fromWorker <- workerAns{entry: entry, ans: Ans{Loc: x}, returned: true}
+			default:
+				break Returned
+			}
+		}
+		// Tell Optimize the worker stopped, unless Optimize has already
+		// finished.
+		select {
+		case async.workerDone <- workerDone{entry: entry, err: err}:
+		case <-async.quitWorker:
+		}
+	}()
+}
+
+func (async *Async) runWorker(entry *poolEntry) error {
+	err := entry.worker.Init(entry.in, entry.out, async.fun, entry.quit)
+	if err != nil {
+		return err
+	}
+	var caps wire.Capabilities
+	if a, ok := entry.worker.(Advertiser); ok {
+		caps = a.Capabilities()
+	}
+	select {
+	case async.workerReady <- workerReady{entry: entry, caps: caps}:
+	case <-async.quitWorker:
+		// Optimize has finished, so the worker has been told to quit. Run
+		// it anyway so it can clean up.
+	}
+	return entry.worker.Run()
+}
+
+// workerInitialized lets the scheduler send points to the worker
+func (async *Async) workerInitialized(ready workerReady) {
+	entry := ready.entry
+	entry.ready = true
+	entry.caps = ready.caps
+	entry.changed = time.Now()
+	if !entry.draining && !entry.stopped {
+		async.nSlots += entry.slots
+	}
+}
+
+// drainWorker tells the worker to stop after its current evaluation
+func (async *Async) drainWorker(worker Worker) {
+	entry := async.find(worker)
+	if entry == nil || entry.draining {
+		return
+	}
+	entry.draining = true
+	close(entry.quit)
+	if entry.ready {
+		async.nSlots -= entry.slots
+	}
+}
+
+// workerStopped removes a stopped worker from the pool. It returns the points
+// still in the worker's channel, which need to be sent to another worker.
+func (async *Async) workerStopped(done workerDone) [][]float64 {
+	entry := done.entry
+	if !async.pool[entry] {
+		return nil
+	}
+	if entry.ready && !entry.draining {
+		async.nSlots -= entry.slots
+	}
+	entry.stopped = true
+	delete(async.pool, entry)
+	if done.err != nil {
+		async.workerErrs = append(async.workerErrs, done.err)
+	}
+	// The worker gave back what was in its channel when it stopped, but
+	// until now it could still be sent points. Nothing reads the channel any
+	// more, so take those back too.
+	var left [][]float64
+	for {
+		select {
+		case x := <-entry.in:
+			entry.received(workerAns{returned: true})
+			left = append(left, x)
+		default:
+			return left
+		}
+	}
+}
+
+// stopWorkers tells every worker to quit. In select, can always read from a
+// closed channel, so this is enough
+func (async *Async) stopWorkers() {
+	for entry := range async.pool {
+		if !entry.draining {
+			close(entry.quit)
+		}
+		if c, ok := entry.worker.(Canceler); ok {
+			c.Cancel()
+		}
+	}
+	close(async.quitWorker)
+}
+
+// schedule asks the Scheduler which worker to send x to. It returns nil if x
+// has to wait.
+func (async *Async) schedule(x []float64) *poolEntry {
+	async.candidates = async.candidates[:0]
+	async.infos = async.infos[:0]
+	free := false
+	for _, entry := range async.started {
+		if !entry.ready || entry.draining || entry.stopped {
+			continue
+		}
+		info := entry.info()
+		free = free || info.Free()
+		async.candidates = append(async.candidates, entry)
+		async.infos = append(async.infos, info)
+	}
+	if !free {
+		return nil
+	}
+	scheduler := async.Scheduler
+	if scheduler == nil {
+		scheduler = Fastest{}
+	}
+	i := scheduler.Schedule(x, async.infos)
+	if i < 0 || i >= len(async.infos) || !async.infos[i].Free() {
+		return nil
+	}
+	return async.candidates[i]
+}
+
+// settled returns whether every worker in the pool is ready for points, so
+// that if none of them has anything to do, nothing is going to change
+func (async *Async) settled() bool {
+	for entry := range async.pool {
+		if !entry.ready || entry.draining {
+			return false
+		}
+	}
+	return true
+}
+
+// sent records that a point was sent to the worker
+func (entry *poolEntry) sent() {
+	entry.update()
+	entry.inFlight++
+}
+
+// received records an answer from the worker. Points the worker gave back
+// are not counted as evaluations.
+func (entry *poolEntry) received(wa workerAns) {
+	entry.update()
+	entry.inFlight--
+	// A worker which reconnects may now be talking to a different machine
+	if a, ok := entry.worker.(Advertiser); ok {
+		entry.caps = a.Capabilities()
+	}
+	if wa.returned {
+		return
+	}
+	if _, ok := wa.ans.Err.(*WorkerError); ok {
+		return
+	}
+	entry.evaluations++
+	if wa.ans.Err != nil {
+		entry.failures++
+	}
+}
+
+// update adds the points the worker has had since the last change to busy
+func (entry *poolEntry) update() {
+	now := time.Now()
+	if entry.changed.IsZero() {
+		entry.changed = now
+	}
+	entry.busy += time.Duration(entry.inFlight) * now.Sub(entry.changed)
+	entry.changed = now
+}
+
+// info returns what is known about the worker
+func (entry *poolEntry) info() WorkerInfo {
+	info := WorkerInfo{
+		Worker:       entry.worker,
+		Capabilities: entry.caps,
+		Slots:        entry.slots,
+		InFlight:     entry.inFlight,
+		Evaluations:  entry.evaluations,
+		Failures:     entry.failures,
+	}
+	if entry.evaluations > 0 {
+		info.EvalTime = entry.busy / time.Duration(entry.evaluations)
+	}
+	return info
+}
+
+// runSlots is the Run method of workers which make independent requests, like
+// HTTPWorker. Each of the n slots gets its own goroutine, which reads a point,
+// evaluates it with eval and sends back the answer. If eval returns an error,
+// the worker can no longer be used: the point is sent back with a
+// *WorkerError, and the other slots finish what they are doing and stop.
+func runSlots(id int, output bool, n int, read <-chan []float64, write chan<- Ans, quit <-chan bool, eval func([]float64) (Ans, error)) error {
+	if output {
+		fmt.Printf("worker %d launched\n", id)
+	}
+	stop := make(chan struct{})
+	var once sync.Once
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				select {
+				case x := <-read:
+					ans, err := eval(x)
+					if err != nil {
+						write <- Ans{Loc: x, Err: &WorkerError{Id: id, Err: err}}
+						once.Do(func() { close(stop) })
+						errs <- err
+						return
+					}
+					write <- ans
+					if output {
+						fmt.Printf("worker %d finished running\n", id)
+					}
+				case <-quit:
+					errs <- nil
+					return
+				case <-stop:
+					errs <- nil
+					return
+				}
+			}
+		}()
+	}
+	var err error
+	for i := 0; i < n; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if output {
+		if err != nil {
+			fmt.Printf("worker %d retired: %v\n", id, err)
+		} else {
+			fmt.Printf("worker %d quit\n", id)
+		}
+	}
+	return err
+}
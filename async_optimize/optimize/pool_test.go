@@ -0,0 +1,89 @@
+package optimize
+
+import (
+	"testing"
+	"time"
+)
+
+// tagged can't be compared with ==, because it holds a slice
+type tagged struct {
+	Tags []string
+	*LocalWorker
+}
+
+func TestNonComparableWorkers(t *testing.T) {
+	c := &counter{}
+	async := &Async{
+		MaxFunEvals: 100,
+		NumDim:      2,
+		Workers:     []Worker{tagged{nil, &LocalWorker{}}, tagged{[]string{"b"}, &LocalWorker{}}},
+		Controller:  c,
+	}
+	// Removing a worker which can't be compared does nothing
+	async.RemoveWorker(tagged{nil, &LocalWorker{}})
+	if len(async.Workers) != 2 {
+		t.Fatalf("%d workers after removing one that was never added", len(async.Workers))
+	}
+	if _, err := async.Optimize(sphere{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.objs) != 100 {
+		t.Errorf("controller got %d results, want 100", len(c.objs))
+	}
+	if n := len(async.WorkerStats()); n != 2 {
+		t.Errorf("%d workers, want 2", n)
+	}
+}
+
+// slowSphere takes a millisecond
+type slowSphere struct{}
+
+func (slowSphere) Obj(x []float64) float64 {
+	time.Sleep(time.Millisecond)
+	return sphere{}.Obj(x)
+}
+
+// trigger calls f, in a new goroutine, when the given result arrives
+type trigger struct {
+	counter
+	f map[int]func()
+}
+
+func (t *trigger) Add(x []float64, obj float64) {
+	t.counter.Add(x, obj)
+	if f, ok := t.f[len(t.objs)]; ok {
+		go f()
+	}
+}
+
+func TestAddRemoveWhileRunning(t *testing.T) {
+	first, second := &LocalWorker{Id: 0}, &LocalWorker{Id: 1}
+	async := &Async{
+		MaxFunEvals: 100,
+		NumDim:      2,
+		Workers:     []Worker{first},
+	}
+	c := &trigger{f: map[int]func(){
+		10: func() { async.AddWorker(second) },
+		30: func() { async.RemoveWorker(first) },
+	}}
+	async.Controller = c
+	if _, err := async.Optimize(slowSphere{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.objs) != 100 {
+		t.Errorf("controller got %d results, want 100", len(c.objs))
+	}
+	stats := async.WorkerStats()
+	if len(stats) != 2 || stats[0].Evaluations >= 100 || stats[1].Evaluations == 0 {
+		t.Errorf("worker stats %+v, want both workers used", stats)
+	}
+	// The changes last beyond the run
+	if len(async.Workers) != 1 || async.Workers[0] != second {
+		t.Errorf("workers %v after the run, want only the one added", async.Workers)
+	}
+	async.RemoveWorker(second)
+	if len(async.Workers) != 0 {
+		t.Errorf("workers %v after removing the only one", async.Workers)
+	}
+}
@@ -0,0 +1,358 @@
+package optimize
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// A ProcessWorker is a worker which keeps a child process running and sends it
+// one point at a time, for objective functions which are too expensive to
+// start for every evaluation. The child is started by Init, so any loading is
+// done once. The objective function passed to Optimize is not used.
+//
+// The child reads points from standard input and writes answers to standard
+// output, one per line, and must answer each point before it is sent the next.
+// Anything else it wants to print should go to standard error. In the plain
+// protocol a point is its coordinates separated by spaces
+//
+//	0.5 -1.25
+//
+// and the answer is a number, or "error" followed by a message if the
+// objective failed at the point. If JSON is set, each line is instead a JSON
+// request or response as described in the wire package, which allows
+// multiple objectives and constraints.
+//
+// If the child exits or its output can not be read, it is restarted and the
+// point is sent again. If the child still fails after being restarted
+// MaxRestarts times for the same point, the worker gives the point back to
+// Async and stops.
+//
+// If an evaluation takes longer than Timeout, the child is killed and
+// restarted, and the point is answered with the error, since it is likely the
+// point that is the problem. If the child can't be restarted, the worker
+// stops after answering. A worker which is told to quit finishes its
+// evaluation first, like every worker, but one which is canceled does not
+// wait: the child is killed and the point given back to Async.
+type ProcessWorker struct {
+	read  <-chan []float64 // channel for reading in values to evaluate
+	write chan<- Ans       // channel for returning the evaulated objectives
+	quit  <-chan bool      // Channel to signal closure of the goroutine upon completion
+
+	Id     int // ID of the worker
+	Output bool
+
+	Path string   // Program to run
+	Args []string // Arguments of the program
+	Env  []string // Extra "KEY=value" environment variables
+	Dir  string   // Working directory of the child (default the current one)
+	JSON bool     // Use the JSON lines protocol
+
+	MaxRestarts int           // Restarts for the same point before giving up (default 5, negative for none)
+	Timeout     time.Duration // Longest an evaluation may take (default none)
+	Stderr      io.Writer     // Where the child's standard error goes (default os.Stderr)
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	lastID uint64
+
+	cancelMu sync.Mutex
+	cancel   chan struct{} // Closed by Cancel
+}
+
+// errStopped is returned by evaluate if the worker was canceled before the
+// child answered
+var errStopped = errors.New("processworker: stopped during evaluation")
+
+// errTimeout is returned by evaluate if the child took longer than Timeout
+var errTimeout = errors.New("processworker: evaluation timed out")
+
+// startError is returned by try if the point was answered, but the child
+// could not be restarted afterwards
+type startError struct {
+	err error
+}
+
+func (s *startError) Error() string {
+	return "processworker: restarting the child: " + s.err.Error()
+}
+
+func (p *ProcessWorker) Init(read <-chan []float64, write chan<- Ans, fun Objer, quit <-chan bool) error {
+	p.read = read
+	p.write = write
+	p.quit = quit
+	p.cancelMu.Lock()
+	p.cancel = make(chan struct{})
+	p.cancelMu.Unlock()
+	return p.start()
+}
+
+// Cancel kills the child if it is evaluating a point, gives the point back
+// with a *WorkerError, and stops the worker
+func (p *ProcessWorker) Cancel() {
+	p.cancelMu.Lock()
+	defer p.cancelMu.Unlock()
+	if p.cancel == nil {
+		return
+	}
+	select {
+	case <-p.cancel:
+	default:
+		close(p.cancel)
+	}
+}
+
+// start launches the child process
+func (p *ProcessWorker) start() error {
+	cmd := exec.Command(p.Path, p.Args...)
+	cmd.Dir = p.Dir
+	cmd.Env = append(os.Environ(), p.Env...)
+	cmd.Stderr = p.Stderr
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	// A killed child can leave programs it started holding its standard
+	// error, so don't wait long for it to close
+	cmd.WaitDelay = time.Second
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	p.cmd = cmd
+	p.stdin = stdin
+	p.stdout = bufio.NewReader(stdout)
+	return nil
+}
+
+// stop closes the child's input, which tells it to exit, and waits for it.
+// A child which does not exit within the grace period is killed.
+func (p *ProcessWorker) stop(grace time.Duration) error {
+	p.stdin.Close()
+	done := make(chan error, 1)
+	go func() { done <- p.cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(grace):
+		p.cmd.Process.Kill()
+		return <-done
+	}
+}
+
+// Run runs the worker
+func (p *ProcessWorker) Run() error {
+	if p.Output {
+		fmt.Printf("worker %d launched\n", p.Id)
+	}
+	maxRestarts := p.MaxRestarts
+	if maxRestarts == 0 {
+		maxRestarts = 5
+	}
+	p.cancelMu.Lock()
+	cancel := p.cancel
+	p.cancelMu.Unlock()
+	for {
+		select {
+		case x := <-p.read:
+			ans, err := p.try(x)
+			for restarts := 0; err != nil; restarts++ {
+				if serr, ok := err.(*startError); ok {
+					// The point has its answer, but there is no child
+					// for the next one
+					p.write <- ans
+					if p.Output {
+						fmt.Printf("worker %d retired: %v\n", p.Id, serr)
+					}
+					return serr.err
+				}
+				// The child is broken. Replace it and try again.
+				p.stop(0)
+				if err == errStopped {
+					p.write <- Ans{Loc: x, Err: &WorkerError{Id: p.Id, Err: context.Canceled}}
+					if p.Output {
+						fmt.Printf("worker %d quit\n", p.Id)
+					}
+					return nil
+				}
+				if p.Output {
+					fmt.Printf("worker %d child failed: %v\n", p.Id, err)
+				}
+				if restarts >= maxRestarts {
+					p.write <- Ans{Loc: x, Err: &WorkerError{Id: p.Id, Err: err}}
+					if p.Output {
+						fmt.Printf("worker %d retired\n", p.Id)
+					}
+					return err
+				}
+				if serr := p.start(); serr != nil {
+					err = serr
+					continue
+				}
+				ans, err = p.try(x)
+			}
+			p.write <- ans
+			if p.Output {
+				fmt.Printf("worker %d finished running\n", p.Id)
+			}
+		case <-p.quit:
+			p.stop(5 * time.Second)
+			if p.Output {
+				fmt.Printf("worker %d quit\n", p.Id)
+			}
+			return nil
+		case <-cancel:
+			p.stop(0)
+			if p.Output {
+				fmt.Printf("worker %d quit\n", p.Id)
+			}
+			return nil
+		}
+	}
+}
+
+// try evaluates x. If the evaluation times out, the point is answered with the
+// error, and the child, which is stuck, is replaced. If that fails, the answer
+// is returned along with a *startError.
+func (p *ProcessWorker) try(x []float64) (Ans, error) {
+	ans, err := p.evaluate(x)
+	if err == errTimeout {
+		p.stop(0)
+		ans = Ans{Loc: x, Err: fmt.Errorf("processworker: evaluation took longer than %v", p.Timeout)}
+		if err := p.start(); err != nil {
+			return ans, &startError{err}
+		}
+		return ans, nil
+	}
+	return ans, err
+}
+
+// evaluate sends x to the child and reads the answer. A non-nil error means
+// the child is broken, while a failed evaluation is returned in Ans.Err. The
+// child is killed if it takes longer than Timeout, or if the worker is
+// canceled in the meantime.
+func (p *ProcessWorker) evaluate(x []float64) (Ans, error) {
+	var line []byte
+	if p.JSON {
+		p.lastID++
+		b, err := json.Marshal(wire.EvalRequest{ID: p.lastID, X: wire.ToFloats(x)})
+		if err != nil {
+			return Ans{}, err
+		}
+		line = append(b, '\n')
+	} else {
+		s := make([]string, len(x))
+		for i, v := range x {
+			s[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		line = []byte(strings.Join(s, " ") + "\n")
+	}
+
+	// Talk to the child in another goroutine, so that this one can give up
+	// on it. Killing the child makes the goroutine's read fail, and the
+	// channel has room for its answer so it never blocks.
+	type reply struct {
+		ans Ans
+		err error
+	}
+	done := make(chan reply, 1)
+	stdin, stdout := p.stdin, p.stdout
+	go func() {
+		ans, err := p.exchange(x, line, stdin, stdout)
+		done <- reply{ans, err}
+	}()
+	var timeout <-chan time.Time
+	if p.Timeout > 0 {
+		timer := time.NewTimer(p.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	p.cancelMu.Lock()
+	cancel := p.cancel
+	p.cancelMu.Unlock()
+	select {
+	case r := <-done:
+		return r.ans, r.err
+	case <-timeout:
+		p.cmd.Process.Kill()
+		return Ans{}, errTimeout
+	case <-cancel:
+		p.cmd.Process.Kill()
+		return Ans{}, errStopped
+	}
+}
+
+// exchange writes the line for x to the child and reads the answer
+func (p *ProcessWorker) exchange(x []float64, line []byte, stdin io.Writer, stdout *bufio.Reader) (Ans, error) {
+	_, err := stdin.Write(line)
+	if err != nil {
+		return Ans{}, err
+	}
+	reply, err := stdout.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = errors.New("processworker: child exited")
+		}
+		return Ans{}, err
+	}
+	reply = strings.TrimSpace(reply)
+	if p.JSON {
+		return parseJSONAnswer(x, reply)
+	}
+	if strings.HasPrefix(reply, "error") {
+		msg := strings.TrimSpace(strings.TrimPrefix(reply, "error"))
+		return Ans{Loc: x, Err: &wire.RemoteError{Msg: msg}}, nil
+	}
+	obj, err := strconv.ParseFloat(reply, 64)
+	if err != nil {
+		return Ans{}, fmt.Errorf("processworker: bad answer %q", reply)
+	}
+	return Ans{Loc: x, Obj: obj}, nil
+}
+
+// parseJSONAnswer reads an answer in the JSON format of the wire package
+func parseJSONAnswer(x []float64, reply string) (Ans, error) {
+	var r wire.EvalResponse
+	err := wire.UnmarshalResponse([]byte(reply), &r)
+	if err != nil {
+		return Ans{}, fmt.Errorf("processworker: bad answer %q", reply)
+	}
+	return evalAnswer(x, r)
+}
+
+// evalAnswer converts a wire.EvalResponse to an answer. A failed evaluation is
+// returned in Ans.Err, while a response without an objective value is an error.
+func evalAnswer(x []float64, r wire.EvalResponse) (Ans, error) {
+	if r.Error != "" {
+		return Ans{Loc: x, Err: &wire.RemoteError{Msg: r.Error}}, nil
+	}
+	ans := Ans{Loc: x, Objs: wire.Floats(r.Objs), Cons: wire.Floats(r.Cons)}
+	switch {
+	case r.Obj != nil:
+		ans.Obj = float64(*r.Obj)
+	case len(ans.Objs) > 0:
+		ans.Obj = ans.Objs[0]
+	default:
+		return Ans{}, errors.New("response has no objective value")
+	}
+	return ans, nil
+}
@@ -0,0 +1,191 @@
+package optimize
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// child returns a ProcessWorker running the script with sh, skipping the
+// test if there is no shell
+func child(t *testing.T, script string) *ProcessWorker {
+	path, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell")
+	}
+	return &ProcessWorker{Path: path, Args: []string{"-c", script}, Stderr: &bytes.Buffer{}}
+}
+
+// ask sends x to the worker and returns the answer
+func ask(read chan<- []float64, write <-chan Ans, x ...float64) Ans {
+	read <- x
+	return <-write
+}
+
+func TestProcessWorker(t *testing.T) {
+	p := child(t, `while read a b; do if [ "$a" -lt 0 ]; then echo "error negative"; else echo $((a*a+b*b)); fi; done`)
+	read, write, quit, done := startWorker(t, p)
+	if ans := ask(read, write, 1, 2); ans.Err != nil || ans.Obj != 5 {
+		t.Errorf("answer %+v, want 5", ans)
+	}
+	ans := ask(read, write, -1, 2)
+	if _, ok := ans.Err.(*wire.RemoteError); !ok {
+		t.Errorf("answer %+v, want the child's error", ans)
+	}
+	close(quit)
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+}
+
+func TestProcessWorkerRestarts(t *testing.T) {
+	// Every child answers one point and exits
+	p := child(t, `read a b; echo $a`)
+	read, write, quit, done := startWorker(t, p)
+	for i := 0; i < 3; i++ {
+		// The first child answers, and each later one is started after
+		// the point is sent to the one before and fails
+		if ans := ask(read, write, float64(i), 0); ans.Err != nil || ans.Obj != float64(i) {
+			t.Errorf("answer %+v, want %d", ans, i)
+		}
+	}
+	close(quit)
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+
+	// A child which never answers is given up on
+	p = child(t, `exit 1`)
+	p.MaxRestarts = 2
+	read, write, _, done = startWorker(t, p)
+	if ans := ask(read, write, 1); ans.Err == nil {
+		t.Error("no error from a broken child")
+	} else if _, ok := ans.Err.(*WorkerError); !ok {
+		t.Errorf("error %v, want a WorkerError", ans.Err)
+	}
+	if err := <-done; err == nil {
+		t.Error("Run returned nil with a broken child")
+	}
+}
+
+func TestProcessWorkerTimeout(t *testing.T) {
+	// Negative points take forever
+	p := child(t, `while read a b; do if [ "$a" -lt 0 ]; then sleep 10; fi; echo $a; done`)
+	p.Timeout = 100 * time.Millisecond
+	read, write, quit, done := startWorker(t, p)
+	start := time.Now()
+	ans := ask(read, write, -1)
+	if ans.Err == nil {
+		t.Error("no error from an evaluation which timed out")
+	} else if _, ok := ans.Err.(*WorkerError); ok {
+		t.Errorf("error %v blames the worker, not the point", ans.Err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("timeout took %v", d)
+	}
+	// The child was replaced
+	if ans := ask(read, write, 3); ans.Err != nil || ans.Obj != 3 {
+		t.Errorf("answer %+v after a timeout, want 3", ans)
+	}
+	close(quit)
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+}
+
+func TestProcessWorkerTimeoutRestartFails(t *testing.T) {
+	// The program is gone by the time the child needs replacing
+	path := filepath.Join(t.TempDir(), "child")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nsleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell")
+	}
+	p := &ProcessWorker{Path: path, Timeout: 300 * time.Millisecond, Stderr: &bytes.Buffer{}}
+	read, write, _, done := startWorker(t, p)
+	read <- []float64{1}
+	// Let the shell open the script first
+	time.Sleep(100 * time.Millisecond)
+	os.Remove(path)
+	ans := <-write
+	if ans.Err == nil || ans.Loc[0] != 1 {
+		t.Errorf("answer %+v, want the timeout", ans)
+	} else if _, ok := ans.Err.(*WorkerError); ok {
+		t.Errorf("error %v blames the worker, not the point", ans.Err)
+	}
+	if err := <-done; err == nil {
+		t.Error("Run returned nil when the child couldn't be restarted")
+	}
+}
+
+func TestProcessWorkerStopsDuringEvaluation(t *testing.T) {
+	// A worker told to quit finishes the evaluation
+	p := child(t, `read a b; sleep 0.2; echo $a`)
+	read, write, quit, done := startWorker(t, p)
+	read <- []float64{1}
+	time.Sleep(10 * time.Millisecond)
+	close(quit)
+	if ans := <-write; ans.Err != nil || ans.Obj != 1 {
+		t.Errorf("answer %+v, want 1", ans)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+
+	// A canceled one gives the point back without waiting
+	p = child(t, `read a b; exec sleep 10`)
+	read, write, _, done = startWorker(t, p)
+	read <- []float64{1}
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	p.Cancel()
+	ans := <-write
+	if _, ok := ans.Err.(*WorkerError); !ok || ans.Loc[0] != 1 {
+		t.Errorf("answer %+v, want the point back with a WorkerError", ans)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("worker took %v to stop", d)
+	}
+}
+
+func TestRemoveProcessWorkerWhileRunning(t *testing.T) {
+	if _, err := exec.LookPath("awk"); err != nil {
+		t.Skip("no awk")
+	}
+	// The child notes every point it is sent before taking its time over it
+	sent := filepath.Join(t.TempDir(), "sent")
+	p := child(t, `while read a b; do echo $a >> `+sent+`; sleep 0.02; awk -v a=$a -v b=$b 'BEGIN { printf "%.17g\n", a*a + b*b }'; done`)
+	async := &Async{
+		MaxFunEvals: 100,
+		NumDim:      2,
+		Workers:     []Worker{p, &LocalWorker{Id: 1}},
+	}
+	c := &trigger{f: map[int]func(){
+		20: func() { async.RemoveWorker(p) },
+	}}
+	async.Controller = c
+	if _, err := async.Optimize(slowSphere{}); err != nil {
+		t.Fatal(err)
+	}
+	checkResults(t, &c.counter, 100)
+	// The point the child had when it was removed was answered, not given
+	// back
+	b, err := os.ReadFile(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := bytes.Count(b, []byte("\n"))
+	stats := async.WorkerStats()
+	if n == 0 || stats[0].Evaluations != n || stats[0].Failures != 0 {
+		t.Errorf("child was sent %d points, stats %+v", n, stats[0])
+	}
+}
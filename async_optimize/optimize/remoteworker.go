@@ -1,13 +1,41 @@
 package optimize
 
 import (
-	"encoding/gob"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
 )
 
 // A RemoteWorker is a worker which concurrently executes an objective function
-// over TCP
+// over TCP using the protocol in the wire package. If the objective function
+// fails on the server, the answer is sent back with the error in Ans.Err.
+//
+// If the connection breaks, the worker reconnects and sends the point again.
+// It waits Backoff before the first attempt, doubling the wait after every
+// failed attempt up to MaxBackoff. After MaxRetries failed attempts the worker
+// retires, and the point is given back to Async. A point which is sent again
+// MaxResends times and still never answered may be what breaks the server,
+// so instead of sending it again it is given back to Async with a
+// *WorkerError. If the worker is told to quit, or canceled, while it is
+// waiting to reconnect, it gives the points back and stops at once.
+//
+// Both ends send heartbeats every Heartbeat while the connection is open. If
+// nothing arrives from the server for Timeout, the server is declared dead.
+// The worker retires without trying to reconnect and the point is given back
+// to Async. The same happens if the server says it is shutting down.
+//
+// If TLSConfig is set the connection is made over TLS, and if Secret is set
+// the worker and server prove to each other that they know it before the
+// objective function is sent (see the wire package). The server must be
+// configured the same way. The secret alone does not protect the connection
+// from someone in the middle of it, so use TLS as well on a network that is
+// not trusted.
 type RemoteWorker struct {
 	// To help with code legibility and safety, channels can also be read-only
 	// <-chan, or write-only chan<-. Channels are always created as being neither,
@@ -24,72 +52,446 @@ type RemoteWorker struct {
 	Output bool
 	quit   <-chan bool // Channel to signal closure of the goroutine upon completion
 
-	Port string // Port where things will be sent
+	Port      string         // Port where things will be sent
+	Transport wire.Transport // How to connect to Port (default TCP)
+
+	MaxRetries int           // Reconnection attempts before retiring (default 5, negative for none)
+	Backoff    time.Duration // Wait before the first reconnection attempt (default 100ms)
+	MaxBackoff time.Duration // Longest wait between attempts (default 10s)
+	MaxResends int           // Times a point is sent again after the connection breaks (default 3, negative for none)
+
+	Heartbeat time.Duration // Interval between heartbeats (default 1s, negative for none)
+	Timeout   time.Duration // Time without a message before the server is dead (default 10s, negative for none)
+
+	TLSConfig *tls.Config // If not nil, connect using TLS
+	Secret    []byte      // If not nil, authenticate with the shared secret
 
-	conn net.Conn     // Tcp connection
-	enc  *gob.Encoder // Writer stream
-	dec  *gob.Decoder // Reader stream
+	accepted net.Conn   // Connection made by the remote end (see Async.Listen)
+	conn     *wire.Conn // Connection to the server
+	lastID   uint64     // ID of the last request sent
+
+	capsMu sync.Mutex
+	caps   wire.Capabilities // From the handshake of the current connection
+
+	cancelMu sync.Mutex
+	cancel   chan struct{} // Closed by Cancel
 }
 
-func (r *RemoteWorker) Init(read <-chan []float64, write chan<- Ans, fun Objer, quit <-chan bool) {
+func (r *RemoteWorker) Init(read <-chan []float64, write chan<- Ans, fun Objer, quit <-chan bool) error {
 	r.read = read
 	r.write = write
 	r.fun = fun
 	r.quit = quit
+	r.cancelMu.Lock()
+	r.cancel = make(chan struct{})
+	r.cancelMu.Unlock()
+	if r.accepted != nil {
+		return r.handshake(r.accepted)
+	}
+	return r.connect()
+}
 
+// connect establishes the connection and sends the objective function
+func (r *RemoteWorker) connect() error {
 	// Establish TCP connection
-	conn, err := net.Dial("tcp", r.Port)
+	conn, err := wire.Dial(r.Transport, r.Port, r.TLSConfig)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	return r.handshake(conn)
+}
+
+// handshake sends the objective function over a new connection
+func (r *RemoteWorker) handshake(conn net.Conn) error {
+	heartbeat, timeout := wire.Liveness(r.Heartbeat, r.Timeout)
+	r.conn = wire.NewConn(conn, timeout)
+
+	if r.Secret != nil {
+		err := wire.ClientAuth(r.conn, r.Secret)
+		if err != nil {
+			r.conn.Close()
+			return err
+		}
 	}
-	r.conn = conn
 
 	// Now that the connection is established, serialize the objective function
 	// and send it over the wire
-	enc := gob.NewEncoder(conn)
-	r.dec = gob.NewDecoder(conn)
-	err = enc.Encode(&fun)
+	caps, err := wire.ClientHandshake(r.conn, r.fun)
 	if err != nil {
-		panic(err)
+		r.conn.Close()
+		return err
+	}
+	r.capsMu.Lock()
+	r.caps = caps
+	r.capsMu.Unlock()
+	r.conn.Heartbeat(heartbeat)
+	return nil
+}
+
+// errQuit is returned by reconnect if the worker is told to quit or canceled
+// while waiting
+var errQuit = errors.New("worker told to quit")
+
+// reconnect tries to establish a new connection with exponential backoff
+func (r *RemoteWorker) reconnect() error {
+	maxRetries := r.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = 5
+	}
+	backoff := r.Backoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	maxBackoff := r.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Second
+	}
+	err := errors.New("reconnection disabled")
+	for i := 0; i < maxRetries; i++ {
+		// The wait can be long, so stop waiting if nobody wants the
+		// connection any more
+		select {
+		case <-time.After(backoff):
+		case <-r.quit:
+			return errQuit
+		case <-r.canceled():
+			return errQuit
+		}
+		if r.Output {
+			fmt.Printf("worker %d reconnecting\n", r.Id)
+		}
+		err = r.connect()
+		if err == nil {
+			return nil
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	return err
+}
+
+// Capabilities returns the server's description of itself from the handshake.
+// It changes if the worker reconnects to a server which describes itself
+// differently, for example one restarted with other tags.
+func (r *RemoteWorker) Capabilities() wire.Capabilities {
+	r.capsMu.Lock()
+	defer r.capsMu.Unlock()
+	return r.caps
+}
+
+// Cancel tells the server to stop working on the points that have been sent,
+// gives them back with a *WorkerError, and stops the worker
+func (w *RemoteWorker) Cancel() {
+	w.cancelMu.Lock()
+	defer w.cancelMu.Unlock()
+	if w.cancel == nil {
+		return
+	}
+	select {
+	case <-w.cancel:
+	default:
+		close(w.cancel)
+	}
+}
+
+// canceled returns the channel closed by Cancel
+func (w *RemoteWorker) canceled() <-chan struct{} {
+	w.cancelMu.Lock()
+	defer w.cancelMu.Unlock()
+	return w.cancel
+}
+
+// Run runs the worker. If the connection fails, the point being evaluated is
+// sent back with a *WorkerError and Run returns the error.
+func (w *RemoteWorker) Run() error {
+	return w.run(1, 1, 0)
+}
+
+// A RemoteHost is a worker for a remote server which evaluates up to Capacity
+// points at once over a single connection. Every request carries an ID, so
+// the results can come back in any order. Async counts a RemoteHost as
+// Capacity workers. The embedded RemoteWorker holds the connection settings.
+//
+// If the objective function is cheap, the time for a message to go back and
+// forth can be longer than the evaluation. If BatchSize is more than one, the
+// host collects up to BatchSize points and sends them in a single message,
+// waiting at most BatchWait for the batch to fill. The server answers once
+// the whole batch is done, so to keep it busy Capacity should be a few times
+// BatchSize. A server which does not say it understands batches (see
+// wire.Capabilities) is sent one point at a time.
+type RemoteHost struct {
+	RemoteWorker
+	Capacity  int           // Number of points evaluated at once (default 1)
+	BatchSize int           // Most points sent in one message (default 1)
+	BatchWait time.Duration // Longest wait for a batch to fill (default 1ms)
+}
+
+// Slots returns the capacity of the host
+func (h *RemoteHost) Slots() int {
+	if h.Capacity <= 0 {
+		return 1
+	}
+	return h.Capacity
+}
+
+// Run runs the worker. If the connection fails, the points being evaluated
+// are sent back with a *WorkerError and Run returns the error.
+func (h *RemoteHost) Run() error {
+	batchSize := h.BatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	batchWait := h.BatchWait
+	if batchWait <= 0 {
+		batchWait = time.Millisecond
+	}
+	return h.run(h.Slots(), batchSize, batchWait)
+}
+
+// incoming is a message read from a connection. gen tells which connection it
+// came from, so that messages from a connection which has been replaced are
+// ignored.
+type incoming struct {
+	gen int
+	m   wire.Message
+	err error
+}
+
+// receive reads messages from the connection until it fails
+func (w *RemoteWorker) receive(conn *wire.Conn, gen int, in chan<- incoming, done <-chan struct{}) {
+	for {
+		m, err := conn.ReceiveMessage()
+		select {
+		case in <- incoming{gen: gen, m: m, err: err}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
 	}
-	r.enc = enc
 }
 
-// Run runs the worker
-func (w *RemoteWorker) Run() {
+// run sends up to capacity points at a time over the connection, in messages
+// of up to batchSize points
+func (w *RemoteWorker) run(capacity, batchSize int, batchWait time.Duration) error {
 	if w.Output {
 		fmt.Printf("worker %d launched\n", w.Id)
 	}
-OuterLoop:
+	done := make(chan struct{})
+	defer close(done)
+
+	// All of the messages from the server are read in a separate goroutine,
+	// so that results can be handled in whatever order they arrive.
+	in := make(chan incoming)
+	gen := 0
+	go w.receive(w.conn, gen, in, done)
+
+	pending := make(map[uint64][]float64) // Points sent and not yet answered
+	resent := make(map[uint64]int)        // Times each pending point has been sent again
+	maxResends := w.MaxResends
+	if maxResends == 0 {
+		maxResends = 3
+	}
+	quitting := false
+	quit := w.quit
+	cancel := w.canceled()
+
 	// Continue looking for function calls to execute until told to quit
-	for {
+	for !quitting || len(pending) > 0 {
+		// Only accept new points if there is room. A nil channel is never
+		// ready, so the select statement skips it.
+		read := w.read
+		if quitting || len(pending) >= capacity {
+			read = nil
+		}
+
+		var err error
 		select {
-		case x := <-w.read:
+		case x := <-read:
 			// Instead of calling the objective function, call it remotely
-			err := w.enc.Encode(x)
-			if err != nil {
-				panic(err)
+			w.lastID++
+			pending[w.lastID] = x
+			ids := []uint64{w.lastID}
+			if n := w.batchLimit(batchSize); n > 1 {
+				ids = w.fillBatch(ids, pending, capacity, n, batchWait)
 			}
-
-			// Listen back for the objective value
-			var obj float64
-			err = w.dec.Decode(&obj)
-			if err != nil {
-				panic(err)
+			err = w.send(ids, pending)
+		case msg := <-in:
+			if msg.gen != gen {
+				// From an old connection
+				continue
+			}
+			if msg.err != nil {
+				err = msg.err
+				break
+			}
+			err = w.handle(msg.m, pending)
+		case <-quit:
+			// Stop taking new points, but finish the ones already sent. A
+			// closed channel is always ready, so stop listening to it.
+			quitting = true
+			quit = nil
+		case <-cancel:
+			// Stop taking new points, and abandon the ones already sent.
+			// Answers that still arrive for them are ignored.
+			quitting = true
+			cancel = nil
+			for id, x := range pending {
+				w.conn.Send(wire.Message{Kind: wire.Cancel, ID: id})
+				w.write <- Ans{Loc: x, Err: &WorkerError{Id: w.Id, Err: context.Canceled}}
+				delete(pending, id)
 			}
+		}
+		if err == nil {
+			continue
+		}
 
-			w.write <- Ans{Loc: x, Obj: obj}
+		// The connection failed. Try to get a new one, and resend everything
+		// that has not been answered.
+		w.conn.Close()
+		if w.Output {
+			fmt.Printf("worker %d connection failed: %v\n", w.Id, err)
+		}
+		rerr := err
+		if _, ok := err.(*wire.DeadError); !ok && err != wire.ErrShutdown {
+			// A server that is hung is unlikely to do better on a new
+			// connection, and one that is shutting down has said it is
+			// going away, but otherwise try again
+			rerr = w.reconnect()
+		}
+		if rerr == nil {
+			gen++
+			go w.receive(w.conn, gen, in, done)
+			for id := range resent {
+				if _, ok := pending[id]; !ok {
+					delete(resent, id)
+				}
+			}
+			ids := make([]uint64, 0, len(pending))
+			for id, x := range pending {
+				if resent[id] >= maxResends {
+					// Don't let one point keep breaking the connection
+					w.write <- Ans{Loc: x, Err: &WorkerError{Id: w.Id, Err: fmt.Errorf("connection broke %d times while evaluating the point: %v", resent[id]+1, err)}}
+					delete(pending, id)
+					delete(resent, id)
+					continue
+				}
+				resent[id]++
+				ids = append(ids, id)
+			}
+			for len(ids) > 0 && rerr == nil {
+				n := w.batchLimit(batchSize)
+				if n > len(ids) {
+					n = len(ids)
+				}
+				rerr = w.send(ids[:n], pending)
+				ids = ids[n:]
+			}
+		}
+		if rerr != nil {
+			// Give up and hand the points back
+			for id, x := range pending {
+				w.write <- Ans{Loc: x, Err: &WorkerError{Id: w.Id, Err: err}}
+				delete(pending, id)
+			}
+			if rerr == errQuit {
+				// Stopped on purpose, so this is not a failure
+				if w.Output {
+					fmt.Printf("worker %d quit\n", w.Id)
+				}
+				return nil
+			}
 			if w.Output {
-				fmt.Printf("worker %d finished running\n", w.Id)
+				fmt.Printf("worker %d retired: %v\n", w.Id, rerr)
 			}
-		case <-w.quit:
-
-			// If read from the quit channel, break out of the loop
-			break OuterLoop
+			return err
 		}
 	}
+	// Let the server know this is a clean close
+	w.conn.Send(wire.Message{Kind: wire.Shutdown})
 	w.conn.Close()
 	if w.Output {
 		fmt.Printf("worker %d quit\n", w.Id)
 	}
+	return nil
+}
+
+// batchLimit returns the most points to send in one message to the server
+// at the other end of the current connection
+func (w *RemoteWorker) batchLimit(batchSize int) int {
+	if !w.Capabilities().Batches {
+		return 1
+	}
+	return batchSize
+}
+
+// fillBatch reads more points until the batch has batchSize points, there is no
+// more capacity, or no point arrives within batchWait
+func (w *RemoteWorker) fillBatch(ids []uint64, pending map[uint64][]float64, capacity, batchSize int, batchWait time.Duration) []uint64 {
+	timer := time.NewTimer(batchWait)
+	defer timer.Stop()
+	for len(ids) < batchSize && len(pending) < capacity {
+		select {
+		case x := <-w.read:
+			w.lastID++
+			pending[w.lastID] = x
+			ids = append(ids, w.lastID)
+		case <-timer.C:
+			return ids
+		}
+	}
+	return ids
+}
+
+// send asks the server to evaluate the pending points with the IDs, in a
+// single message
+func (w *RemoteWorker) send(ids []uint64, pending map[uint64][]float64) error {
+	if len(ids) == 1 {
+		return w.conn.Send(wire.Message{Kind: wire.Evaluate, ID: ids[0], X: pending[ids[0]]})
+	}
+	batch := make([]wire.Message, len(ids))
+	for i, id := range ids {
+		batch[i] = wire.Message{Kind: wire.Evaluate, ID: id, X: pending[id]}
+	}
+	return w.conn.Send(wire.Message{Kind: wire.EvaluateBatch, Batch: batch})
+}
+
+// handle deals with a message from the server. A non-nil error means the
+// connection has failed, while an error evaluating the objective is sent to
+// Async in Ans.Err.
+func (w *RemoteWorker) handle(m wire.Message, pending map[uint64][]float64) error {
+	switch m.Kind {
+	case wire.Result, wire.Error:
+		if m.Kind == wire.Error && m.ID == 0 {
+			// Not about any request, so about the connection
+			return &wire.RemoteError{Msg: m.Err}
+		}
+		x, ok := pending[m.ID]
+		if !ok {
+			// About an old request, so ignore it
+			return nil
+		}
+		delete(pending, m.ID)
+		if m.Kind == wire.Error {
+			w.write <- Ans{Loc: x, Err: &wire.RemoteError{Msg: m.Err}}
+		} else {
+			w.write <- Ans{Loc: x, Obj: m.Obj, Objs: m.Objs, Cons: m.Cons}
+		}
+		if w.Output {
+			fmt.Printf("worker %d finished running\n", w.Id)
+		}
+	case wire.ResultBatch:
+		for _, m := range m.Batch {
+			err := w.handle(m, pending)
+			if err != nil {
+				return err
+			}
+		}
+	case wire.Shutdown:
+		return wire.ErrShutdown
+	}
+	return nil
 }
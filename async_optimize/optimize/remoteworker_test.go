@@ -0,0 +1,346 @@
+package optimize
+
+import (
+	"encoding/gob"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+func init() {
+	// The workers send the objective function in the handshake
+	gob.Register(sphere{})
+}
+
+// fakeServer evaluates sphere over a Pipe. If crash returns true for a
+// point, the connection is closed instead of answering, as if the server
+// died evaluating it. If hang is set, the server goes quiet instead, as if the
+// machine had dropped off the network. If batches is set, the server
+// understands EvaluateBatch; otherwise it answers one like an older server.
+type fakeServer struct {
+	pipe     *wire.Pipe
+	name     string
+	crash    func(conn, evals int, x []float64) bool
+	hang     bool
+	batches  bool
+	listener interface{ Close() error }
+
+	mu      sync.Mutex
+	conns   int
+	largest int // Most points in one message
+}
+
+func newFakeServer(t *testing.T, crash func(conn, evals int, x []float64) bool) *fakeServer {
+	s := &fakeServer{pipe: &wire.Pipe{}, name: t.Name(), crash: crash}
+	l, err := s.pipe.Listen(s.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			n := s.conns
+			s.mu.Unlock()
+			go s.serve(wire.NewConn(conn, 0), n)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(c *wire.Conn, n int) {
+	defer c.Close()
+	// Answer in the background like a real server, so that a client with
+	// several points to send is not stuck behind an unread answer
+	var answers sync.WaitGroup
+	defer answers.Wait()
+	answer := func(m wire.Message) {
+		answers.Add(1)
+		go func() {
+			defer answers.Done()
+			c.Send(m)
+		}()
+	}
+	resolve := func(wire.Message) (interface{}, error) { return sphere{}, nil }
+	if _, err := wire.ServerHandshake(c, resolve, wire.Capabilities{Cores: n, Batches: s.batches}); err != nil {
+		return
+	}
+	for evals := 0; ; {
+		m, err := c.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		if m.Kind == wire.EvaluateBatch {
+			if !s.batches {
+				c.Send(wire.Message{Kind: wire.Error, Err: "unexpected evaluate batch message"})
+				continue
+			}
+			s.mu.Lock()
+			if len(m.Batch) > s.largest {
+				s.largest = len(m.Batch)
+			}
+			s.mu.Unlock()
+			replies := make([]wire.Message, len(m.Batch))
+			for i, req := range m.Batch {
+				replies[i] = wire.Message{Kind: wire.Result, ID: req.ID, Obj: (sphere{}).Obj(req.X)}
+			}
+			answer(wire.Message{Kind: wire.ResultBatch, Batch: replies})
+			continue
+		}
+		if m.Kind != wire.Evaluate {
+			continue
+		}
+		if s.crash != nil && s.crash(n, evals, m.X) {
+			for s.hang {
+				// Read until the client gives up on the connection
+				if _, err := c.ReceiveMessage(); err != nil {
+					return
+				}
+			}
+			return
+		}
+		evals++
+		answer(wire.Message{Kind: wire.Result, ID: m.ID, Obj: (sphere{}).Obj(m.X)})
+	}
+}
+
+func (s *fakeServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+func (s *fakeServer) worker() *RemoteWorker {
+	return &RemoteWorker{
+		Port:      s.name,
+		Transport: s.pipe,
+		Backoff:   time.Millisecond,
+		Heartbeat: -1,
+		Timeout:   -1,
+	}
+}
+
+// startWorker runs the worker outside of Async. It returns the channels to
+// talk to it and the channel Run's error arrives on.
+func startWorker(t *testing.T, w Worker) (chan<- []float64, <-chan Ans, chan<- bool, <-chan error) {
+	read := make(chan []float64)
+	write := make(chan Ans)
+	quit := make(chan bool)
+	if err := w.Init(read, write, wire.Named{Name: "sphere"}, quit); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- w.Run() }()
+	return read, write, quit, done
+}
+
+func TestRemoteWorkerReconnects(t *testing.T) {
+	// Every connection breaks after two evaluations
+	s := newFakeServer(t, func(conn, evals int, x []float64) bool { return evals == 2 })
+	defer s.listener.Close()
+	w := s.worker()
+	read, write, quit, done := startWorker(t, w)
+	for i := 0; i < 10; i++ {
+		x := []float64{float64(i), 1}
+		read <- x
+		ans := <-write
+		if ans.Err != nil || ans.Obj != (sphere{}).Obj(x) {
+			t.Fatalf("answer %+v for %v", ans, x)
+		}
+	}
+	close(quit)
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+	if n := s.connections(); n != 5 {
+		t.Errorf("%d connections for 10 points, want 5", n)
+	}
+	// The fake server says which connection it is in the handshake
+	if cores := w.Capabilities().Cores; cores != 5 {
+		t.Errorf("capabilities from connection %d, want the last one", cores)
+	}
+}
+
+func TestRemoteWorkerTimeout(t *testing.T) {
+	// The server goes quiet on the first point
+	s := newFakeServer(t, func(conn, evals int, x []float64) bool { return true })
+	s.hang = true
+	defer s.listener.Close()
+	w := s.worker()
+	w.Timeout = 20 * time.Millisecond
+	read, write, _, done := startWorker(t, w)
+	read <- []float64{3}
+	// A hung server is not tried again
+	ans := <-write
+	if we, ok := ans.Err.(*WorkerError); !ok || !isDead(we.Err) {
+		t.Errorf("answer %+v, want the point back with a WorkerError", ans)
+	}
+	if err := <-done; !isDead(err) {
+		t.Errorf("Run returned %v, want a DeadError", err)
+	}
+	if n := s.connections(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+}
+
+func isDead(err error) bool {
+	_, ok := err.(*wire.DeadError)
+	return ok
+}
+
+func TestRemoteWorkerGivesUpOnPoint(t *testing.T) {
+	// The server dies whenever it is sent a negative point
+	s := newFakeServer(t, func(conn, evals int, x []float64) bool { return x[0] < 0 })
+	defer s.listener.Close()
+	w := s.worker()
+	w.MaxResends = 2
+	read, write, quit, done := startWorker(t, w)
+	read <- []float64{-1}
+	ans := <-write
+	if _, ok := ans.Err.(*WorkerError); !ok || ans.Loc[0] != -1 {
+		t.Fatalf("answer %+v, want the point back with a WorkerError", ans)
+	}
+	// Sent once and then twice more, and the worker reconnected after the
+	// last time before giving up on the point
+	if n := s.connections(); n != 4 {
+		t.Errorf("%d connections, want 4", n)
+	}
+	// The worker is still usable
+	read <- []float64{2}
+	if ans := <-write; ans.Err != nil || ans.Obj != 4 {
+		t.Errorf("answer %+v after giving up on a point", ans)
+	}
+	close(quit)
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+}
+
+func TestRemoteWorkerRetires(t *testing.T) {
+	var s *fakeServer
+	s = newFakeServer(t, func(conn, evals int, x []float64) bool {
+		// Stop listening, then die
+		s.listener.Close()
+		return true
+	})
+	w := s.worker()
+	w.MaxRetries = 3
+	read, write, _, done := startWorker(t, w)
+	read <- []float64{1}
+	ans := <-write
+	if _, ok := ans.Err.(*WorkerError); !ok {
+		t.Errorf("answer %+v, want the point back with a WorkerError", ans)
+	}
+	if err := <-done; err == nil {
+		t.Error("Run returned nil after the server went away")
+	}
+}
+
+func TestRemoteWorkerQuitWhileReconnecting(t *testing.T) {
+	for _, cancel := range []bool{false, true} {
+		var s *fakeServer
+		s = newFakeServer(t, func(conn, evals int, x []float64) bool {
+			// Stop listening, then die
+			s.listener.Close()
+			return true
+		})
+		w := s.worker()
+		w.Backoff = time.Hour
+		read, write, quit, done := startWorker(t, w)
+		read <- []float64{1}
+		// Wait until the connection has broken
+		for s.connections() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		start := time.Now()
+		if cancel {
+			w.Cancel()
+		} else {
+			close(quit)
+		}
+		ans := <-write
+		if _, ok := ans.Err.(*WorkerError); !ok || ans.Loc[0] != 1 {
+			t.Errorf("answer %+v, want the point back with a WorkerError", ans)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("Run returned %v after being told to stop", err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("worker took %v to stop", d)
+		}
+	}
+}
+
+func TestAsyncRemoteWorkers(t *testing.T) {
+	// Connections break now and then
+	s := newFakeServer(t, func(conn, evals int, x []float64) bool { return evals == 3 })
+	defer s.listener.Close()
+	c := &counter{}
+	async := &Async{
+		MaxFunEvals: 100,
+		NumDim:      2,
+		Workers:     []Worker{s.worker(), s.worker(), &LocalWorker{}},
+		Controller:  c,
+	}
+	_, err := async.Optimize(sphere{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.objs) != 100 {
+		t.Errorf("controller got %d results, want 100", len(c.objs))
+	}
+	for i, obj := range c.objs {
+		if obj != (sphere{}).Obj(c.locs[i]) {
+			t.Errorf("result %v at %v is not the objective", obj, c.locs[i])
+		}
+	}
+}
+
+func TestRemoteHostBatches(t *testing.T) {
+	for _, batches := range []bool{false, true} {
+		t.Run(strconv.FormatBool(batches), func(t *testing.T) {
+			s := newFakeServer(t, nil)
+			defer s.listener.Close()
+			s.batches = batches
+			h := &RemoteHost{Capacity: 8, BatchSize: 4, BatchWait: 50 * time.Millisecond}
+			h.Port = s.name
+			h.Transport = s.pipe
+			h.Heartbeat = -1
+			h.Timeout = -1
+			read, write, quit, done := startWorker(t, h)
+			const points = 16
+			go func() {
+				for i := 0; i < points; i++ {
+					read <- []float64{float64(i), 1}
+				}
+			}()
+			for i := 0; i < points; i++ {
+				ans := <-write
+				if ans.Err != nil || ans.Obj != (sphere{}).Obj(ans.Loc) {
+					t.Errorf("answer %+v", ans)
+				}
+			}
+			close(quit)
+			if err := <-done; err != nil {
+				t.Errorf("Run returned %v", err)
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			// A server which does not understand batches must not be sent one
+			if batches && s.largest < 2 || !batches && s.largest != 0 {
+				t.Errorf("largest batch %d", s.largest)
+			}
+			if s.conns != 1 {
+				t.Errorf("%d connections, want 1", s.conns)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package optimize
+
+import (
+	"errors"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync/atomic"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// An RPCWorker is a worker which evaluates points by calling the
+// Objective.Evaluate method of a net/rpc service, such as functions.RPCServer.
+// Like HTTPWorker, the server decides what is evaluated, and the objective
+// function passed to Optimize is not used. Up to Concurrency calls are made at
+// once over a single connection. If a call fails, the point is given back to
+// Async and the worker stops. This includes a server which is shutting down,
+// which fails the calls it does not finish.
+type RPCWorker struct {
+	read  <-chan []float64 // channel for reading in values to evaluate
+	write chan<- Ans       // channel for returning the evaulated objectives
+	quit  <-chan bool      // Channel to signal closure of the goroutine upon completion
+
+	Id     int // ID of the worker
+	Output bool
+
+	Addr        string         // Address of the server
+	Transport   wire.Transport // How to connect to Addr (default TCP)
+	JSON        bool           // Use JSON-RPC instead of gob
+	Concurrency int            // Number of calls made at once (default 1)
+
+	client *rpc.Client
+	lastID uint64 // ID of the last request, updated atomically
+}
+
+func (r *RPCWorker) Init(read <-chan []float64, write chan<- Ans, fun Objer, quit <-chan bool) error {
+	if r.Addr == "" {
+		return errors.New("rpcworker: no address")
+	}
+	r.read = read
+	r.write = write
+	r.quit = quit
+	conn, err := wire.Dial(r.Transport, r.Addr, nil)
+	if err != nil {
+		return err
+	}
+	if r.JSON {
+		r.client = jsonrpc.NewClient(conn)
+	} else {
+		r.client = rpc.NewClient(conn)
+	}
+	return nil
+}
+
+// Slots returns the number of calls made at once
+func (r *RPCWorker) Slots() int {
+	if r.Concurrency <= 0 {
+		return 1
+	}
+	return r.Concurrency
+}
+
+// Run runs the worker
+func (r *RPCWorker) Run() error {
+	defer r.client.Close()
+	return runSlots(r.Id, r.Output, r.Slots(), r.read, r.write, r.quit, r.call)
+}
+
+// call evaluates x on the server
+func (r *RPCWorker) call(x []float64) (Ans, error) {
+	id := atomic.AddUint64(&r.lastID, 1)
+	var resp wire.EvalResponse
+	err := r.client.Call("Objective.Evaluate", wire.EvalRequest{ID: id, X: wire.ToFloats(x)}, &resp)
+	if err != nil {
+		return Ans{}, err
+	}
+	if !r.JSON && resp.Obj == nil && resp.Objs == nil && resp.Error == "" {
+		// gob does not send zero values, so the objective was zero
+		resp.Obj = new(wire.Float)
+	}
+	return evalAnswer(x, resp)
+}
@@ -0,0 +1,99 @@
+package optimize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/btracey/goexamples/async_optimize/functions"
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// rpcServer serves sphere on a Pipe until the test ends
+func rpcServer(t *testing.T, json bool) *wire.Pipe {
+	pipe, _ := serveRPC(t, sphere{}, json)
+	return pipe
+}
+
+// serveRPC serves fun on a Pipe until the test ends
+func serveRPC(t *testing.T, fun Objer, json bool) (*wire.Pipe, *functions.RPCServer) {
+	pipe := &wire.Pipe{}
+	l, err := pipe.Listen("rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &functions.RPCServer{Objer: fun, JSON: json}
+	go s.Serve(l)
+	return pipe, s
+}
+
+func TestRPCWorker(t *testing.T) {
+	for _, json := range []bool{false, true} {
+		w := &RPCWorker{Addr: "rpc", Transport: rpcServer(t, json), JSON: json}
+		read, write, quit, done := startWorker(t, w)
+		// Zero is not sent by gob, so make sure it is not mistaken for a
+		// missing answer
+		for _, x := range [][]float64{{1, 2}, {0, 0}} {
+			if ans := ask(read, write, x...); ans.Err != nil || ans.Obj != (sphere{}).Obj(x) {
+				t.Errorf("json %v: answer %+v at %v", json, ans, x)
+			}
+		}
+		close(quit)
+		if err := <-done; err != nil {
+			t.Errorf("json %v: Run returned %v", json, err)
+		}
+	}
+}
+
+func TestAsyncRPCWorkers(t *testing.T) {
+	c := &counter{}
+	async := &Async{
+		MaxFunEvals: 100,
+		NumDim:      2,
+		Workers: []Worker{
+			&RPCWorker{Addr: "rpc", Transport: rpcServer(t, false), Concurrency: 2},
+			&RPCWorker{Addr: "rpc", Transport: rpcServer(t, true), JSON: true},
+		},
+		Controller: c,
+	}
+	if _, err := async.Optimize(sphere{}); err != nil {
+		t.Fatal(err)
+	}
+	checkResults(t, c, 100)
+	for _, w := range async.WorkerStats() {
+		if w.Evaluations == 0 {
+			t.Errorf("worker stats %+v, want both workers used", async.WorkerStats())
+		}
+	}
+}
+
+func TestAsyncRPCServerShutdown(t *testing.T) {
+	// One of the servers shuts down part of the way through. The points it
+	// had are not its objective's fault, so they go to the other server.
+	closing, s := serveRPC(t, slowSphere{}, false)
+	c := &trigger{f: map[int]func(){
+		30: func() { s.Shutdown(context.Background()) },
+	}}
+	async := &Async{
+		MaxFunEvals: 200,
+		NumDim:      2,
+		Workers: []Worker{
+			&RPCWorker{Addr: "rpc", Transport: closing, Concurrency: 2},
+			&RPCWorker{Addr: "rpc", Transport: rpcServer(t, false)},
+		},
+		Controller: c,
+	}
+	if _, err := async.Optimize(sphere{}); err != nil {
+		t.Fatal(err)
+	}
+	checkResults(t, &c.counter, 200)
+	stats := async.WorkerStats()
+	for _, w := range stats {
+		if w.Failures != 0 {
+			t.Errorf("worker stats %+v, want no failed points", stats)
+		}
+	}
+	if len(async.WorkerErrors()) != 1 {
+		t.Errorf("worker errors %v, want the worker of the closed server", async.WorkerErrors())
+	}
+}
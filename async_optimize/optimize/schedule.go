@@ -0,0 +1,210 @@
+package optimize
+
+import (
+	"math"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// Every worker has its own channel of points, and a Scheduler decides which
+// channel each point goes down. To help it decide, Async keeps track of what
+// every worker is doing and how long its evaluations take. Workers which are
+// Advertisers also say what kind of machine they run on; for a RemoteWorker
+// that is what the server sent in its handshake.
+//
+// The time an evaluation takes is measured from the moment the point is sent
+// until the answer comes back, so it includes the time spent waiting on the
+// worker and on the network. Rather than remembering when each point was
+// sent, Async adds up the number of points each worker has over time. By
+// Little's law, that total divided by the number of answers is the average
+// time a point spends with the worker.
+//
+// That average includes the points the objective function failed at, which
+// can fail much faster than a real evaluation takes. The schedulers rank
+// workers by the time they spend for each point they evaluate without
+// failing instead, so a worker which fails fast does not look fast.
+
+// Advertiser is a worker that can describe the machine it evaluates on. Async
+// asks after Init succeeds and again with every answer, since the machine can
+// change (a RemoteWorker may reconnect to a restarted server), and passes the
+// latest answer to the Scheduler. Capabilities is called from Optimize's
+// goroutine while the worker runs, so it must be safe to call concurrently
+// with Run.
+type Advertiser interface {
+	Worker
+	Capabilities() wire.Capabilities
+}
+
+// WorkerInfo is what Async knows about a worker
+type WorkerInfo struct {
+	Worker       Worker
+	Capabilities wire.Capabilities // Zero if the worker is not an Advertiser
+	Slots        int               // Number of points the worker can have at once
+	InFlight     int               // Number of points the worker has now
+	Evaluations  int               // Number of points the worker has finished
+	Failures     int               // Number of those the objective function failed at
+	EvalTime     time.Duration     // Average time a point spends with the worker, zero until one finishes
+}
+
+// neverSucceeded is the cost of a worker which has only failed
+const neverSucceeded = time.Duration(math.MaxInt64)
+
+// cost returns the time the worker spends for each point it evaluates
+// without failing, zero until one finishes
+func (w WorkerInfo) cost() time.Duration {
+	if w.Failures == 0 {
+		return w.EvalTime
+	}
+	ok := w.Evaluations - w.Failures
+	if ok <= 0 {
+		return neverSucceeded
+	}
+	return w.EvalTime * time.Duration(w.Evaluations) / time.Duration(ok)
+}
+
+// Free returns whether the worker can take another point
+func (w WorkerInfo) Free() bool {
+	return w.InFlight < w.Slots
+}
+
+// Throughput returns the number of evaluations per second the worker can do
+// with all of its slots busy, or zero if none have finished
+func (w WorkerInfo) Throughput() float64 {
+	if w.EvalTime == 0 {
+		return 0
+	}
+	return float64(w.Slots) / w.EvalTime.Seconds()
+}
+
+// A Scheduler chooses which worker evaluates each point. Schedule is given
+// every running worker and returns the index of the one to send x to, which
+// must be Free. It returns -1 to hold on to x until something changes (a
+// worker finishes a point, or joins or leaves the pool). If Schedule holds on
+// to a point while no worker has anything to do, Optimize fails, since
+// nothing will change.
+type Scheduler interface {
+	Schedule(x []float64, workers []WorkerInfo) int
+}
+
+// Fastest sends every point to the free worker which spends the least time
+// for each point it evaluates without failing. Workers which have not
+// finished a point yet come first, so that every worker gets measured, and
+// workers which have failed at every point come last. It is the default
+// Scheduler.
+type Fastest struct{}
+
+func (Fastest) Schedule(x []float64, workers []WorkerInfo) int {
+	best := -1
+	for i, w := range workers {
+		if !w.Free() {
+			continue
+		}
+		if best == -1 || w.cost() < workers[best].cost() {
+			best = i
+		}
+	}
+	return best
+}
+
+// Preferred sends points to the workers which have all of Tags. If Only is
+// true, the other workers are never used; otherwise they are used when none of
+// the preferred workers is free. If Points is not nil, the preference only
+// applies to the points for which it returns true. The worker is chosen from
+// the candidates by Then (default Fastest).
+type Preferred struct {
+	Tags   []string
+	Only   bool
+	Points func(x []float64) bool
+	Then   Scheduler
+}
+
+func (p Preferred) Schedule(x []float64, workers []WorkerInfo) int {
+	then := p.Then
+	if then == nil {
+		then = Fastest{}
+	}
+	if p.Points != nil && !p.Points(x) {
+		return then.Schedule(x, workers)
+	}
+	i := scheduleAmong(then, x, workers, func(w WorkerInfo) bool {
+		return w.Capabilities.HasTags(p.Tags...)
+	})
+	if i != -1 || p.Only {
+		return i
+	}
+	return then.Schedule(x, workers)
+}
+
+// CostAware keeps expensive points off slow workers. A point is expensive if
+// Cost(x) is more than Threshold, and a worker is slow if the time it spends
+// for each point it evaluates without failing is more than Slowdown times
+// that of the fastest worker (default 2). Expensive points wait for a worker
+// which is not slow. Workers which have not finished a point yet are not
+// known to be slow, while workers which have failed at every point are,
+// unless every worker has. The worker is chosen from the candidates by Then
+// (default Fastest).
+//
+// Async only holds on to one point at a time, so while an expensive point
+// waits for a fast worker, the points after it wait too, even cheap ones which
+// a free slow worker could take. If expensive points are common, the slow
+// workers can sit idle for much of the run; raise Threshold or Slowdown, or
+// remove the slow workers, if that costs more than it saves.
+type CostAware struct {
+	Cost      func(x []float64) float64
+	Threshold float64
+	Slowdown  float64
+	Then      Scheduler
+}
+
+func (c CostAware) Schedule(x []float64, workers []WorkerInfo) int {
+	then := c.Then
+	if then == nil {
+		then = Fastest{}
+	}
+	if c.Cost(x) <= c.Threshold {
+		return then.Schedule(x, workers)
+	}
+	slowdown := c.Slowdown
+	if slowdown <= 0 {
+		slowdown = 2
+	}
+	var fastest time.Duration
+	succeeded := false
+	for _, w := range workers {
+		c := w.cost()
+		if c == neverSucceeded {
+			continue
+		}
+		succeeded = true
+		if c > 0 && (fastest == 0 || c < fastest) {
+			fastest = c
+		}
+	}
+	if !succeeded {
+		// There is nobody better to wait for
+		return then.Schedule(x, workers)
+	}
+	limit := time.Duration(slowdown * float64(fastest))
+	return scheduleAmong(then, x, workers, func(w WorkerInfo) bool {
+		return w.cost() <= limit
+	})
+}
+
+// scheduleAmong runs the scheduler on the workers for which keep returns true,
+// and returns the index of the chosen one in workers
+func scheduleAmong(s Scheduler, x []float64, workers []WorkerInfo, keep func(WorkerInfo) bool) int {
+	var index []int
+	var kept []WorkerInfo
+	for i, w := range workers {
+		if keep(w) {
+			index = append(index, i)
+			kept = append(kept, w)
+		}
+	}
+	i := s.Schedule(x, kept)
+	if i < 0 {
+		return -1
+	}
+	return index[i]
+}
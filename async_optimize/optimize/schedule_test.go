@@ -0,0 +1,198 @@
+package optimize
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btracey/goexamples/async_optimize/wire"
+)
+
+// info describes a worker with one slot for the schedulers
+func info(evalTime time.Duration, busy bool, tags ...string) WorkerInfo {
+	w := WorkerInfo{Slots: 1, EvalTime: evalTime, Capabilities: wire.Capabilities{Tags: tags}}
+	if busy {
+		w.InFlight = 1
+	}
+	return w
+}
+
+// failing is w after it has failed at failures of evaluations points
+func failing(w WorkerInfo, evaluations, failures int) WorkerInfo {
+	w.Evaluations, w.Failures = evaluations, failures
+	return w
+}
+
+func TestWorkerInfo(t *testing.T) {
+	w := WorkerInfo{Slots: 4, InFlight: 3, EvalTime: 2 * time.Second}
+	if !w.Free() {
+		t.Error("worker with a slot left is not free")
+	}
+	if got := w.Throughput(); got != 2 {
+		t.Errorf("throughput %v, want 2 per second", got)
+	}
+	w.InFlight = 4
+	w.EvalTime = 0
+	if w.Free() || w.Throughput() != 0 {
+		t.Errorf("%+v is free or has a throughput", w)
+	}
+}
+
+func TestFastest(t *testing.T) {
+	for _, test := range []struct {
+		workers []WorkerInfo
+		want    int
+	}{
+		{[]WorkerInfo{info(3*time.Second, false), info(time.Second, false), info(2*time.Second, false)}, 1},
+		{[]WorkerInfo{info(3*time.Second, false), info(time.Second, true), info(2*time.Second, false)}, 2},
+		// Workers which have not been measured come first
+		{[]WorkerInfo{info(time.Second, false), info(0, false)}, 1},
+		{[]WorkerInfo{info(time.Second, true), info(0, true)}, -1},
+		// Failures count against a worker
+		{[]WorkerInfo{failing(info(time.Millisecond, false), 10, 10), info(time.Second, false)}, 1},
+		{[]WorkerInfo{failing(info(time.Second, false), 4, 3), info(2*time.Second, false)}, 1},
+		{[]WorkerInfo{failing(info(time.Second, false), 4, 1), info(2*time.Second, false)}, 0},
+		{nil, -1},
+	} {
+		if got := (Fastest{}).Schedule(nil, test.workers); got != test.want {
+			t.Errorf("%+v: chose %d, want %d", test.workers, got, test.want)
+		}
+	}
+}
+
+func TestPreferred(t *testing.T) {
+	gpu := func(busy bool) []WorkerInfo {
+		return []WorkerInfo{info(time.Second, false), info(2*time.Second, busy, "gpu"), info(3*time.Second, false, "gpu", "big")}
+	}
+	for _, test := range []struct {
+		p       Preferred
+		x       []float64
+		workers []WorkerInfo
+		want    int
+	}{
+		{Preferred{Tags: []string{"gpu"}}, nil, gpu(false), 1},
+		{Preferred{Tags: []string{"gpu", "big"}}, nil, gpu(false), 2},
+		// Other workers are used when the preferred ones are busy, unless Only
+		{Preferred{Tags: []string{"gpu", "big"}}, nil, []WorkerInfo{info(time.Second, false), info(time.Second, true, "gpu", "big")}, 0},
+		{Preferred{Tags: []string{"gpu", "big"}, Only: true}, nil, []WorkerInfo{info(time.Second, false), info(time.Second, true, "gpu", "big")}, -1},
+		// The preference only applies to some points
+		{Preferred{Tags: []string{"gpu"}, Points: func(x []float64) bool { return x[0] > 0 }}, []float64{1}, gpu(false), 1},
+		{Preferred{Tags: []string{"gpu"}, Points: func(x []float64) bool { return x[0] > 0 }}, []float64{-1}, gpu(false), 0},
+	} {
+		if got := test.p.Schedule(test.x, test.workers); got != test.want {
+			t.Errorf("%+v at %v: chose %d, want %d", test.p, test.x, got, test.want)
+		}
+	}
+}
+
+func TestCostAware(t *testing.T) {
+	c := CostAware{Cost: func(x []float64) float64 { return x[0] }, Threshold: 10}
+	cheap, expensive := []float64{1}, []float64{100}
+	for _, test := range []struct {
+		x       []float64
+		workers []WorkerInfo
+		want    int
+	}{
+		// Cheap points go to any worker
+		{cheap, []WorkerInfo{info(time.Second, true), info(5*time.Second, false)}, 1},
+		// Expensive points wait for a worker which is not slow
+		{expensive, []WorkerInfo{info(time.Second, true), info(5*time.Second, false)}, -1},
+		{expensive, []WorkerInfo{info(time.Second, true), info(2*time.Second, false), info(5*time.Second, false)}, 1},
+		// A worker which has not been measured is not known to be slow
+		{expensive, []WorkerInfo{info(time.Second, true), info(0, false)}, 1},
+		// A worker which fails fast is not fast
+		{expensive, []WorkerInfo{failing(info(time.Millisecond, false), 10, 10), info(time.Second, true)}, -1},
+		{expensive, []WorkerInfo{failing(info(time.Millisecond, false), 10, 10), info(0, true)}, -1},
+		{expensive, []WorkerInfo{failing(info(200*time.Millisecond, false), 10, 9), info(time.Second, false)}, 1},
+		// Unless there is nobody better
+		{expensive, []WorkerInfo{failing(info(time.Millisecond, false), 10, 10), failing(info(time.Second, true), 1, 1)}, 0},
+	} {
+		if got := c.Schedule(test.x, test.workers); got != test.want {
+			t.Errorf("%v on %+v: chose %d, want %d", test.x, test.workers, got, test.want)
+		}
+	}
+	c.Slowdown = 10
+	if got := c.Schedule(expensive, []WorkerInfo{info(time.Second, true), info(5*time.Second, false)}); got != 1 {
+		t.Errorf("with Slowdown 10, chose %d, want 1", got)
+	}
+}
+
+// failFast is a LocalWorker whose objective function fails at once
+type failFast struct{ *LocalWorker }
+
+func (f failFast) Init(read <-chan []float64, write chan<- Ans, fun Objer, quit <-chan bool) error {
+	return f.LocalWorker.Init(read, write, brokenObjer{}, quit)
+}
+
+func TestFastFailingWorker(t *testing.T) {
+	// Every point is expensive, so it waits for the fastest worker, which
+	// is not the one that fails at every point
+	c := &counter{}
+	async := &Async{
+		MaxFunEvals: 100,
+		NumDim:      2,
+		Workers:     []Worker{failFast{&LocalWorker{Id: 0}}, &LocalWorker{Id: 1}},
+		Controller:  c,
+		Scheduler:   CostAware{Cost: func(x []float64) float64 { return 1 }},
+	}
+	if _, err := async.Optimize(slowSphere{}); err != nil {
+		t.Fatal(err)
+	}
+	stats := async.WorkerStats()
+	if stats[0].Evaluations > 2 || stats[1].Evaluations < 98 {
+		t.Errorf("worker stats %+v, want the failing worker left alone", stats)
+	}
+}
+
+// retagged is a worker whose tags change once the objective function has
+// been called, as if it had reconnected to a different server
+type retagged struct {
+	*LocalWorker
+	evals *int64
+}
+
+func (r retagged) Capabilities() wire.Capabilities {
+	if atomic.LoadInt64(r.evals) > 0 {
+		return wire.Capabilities{Tags: []string{"new"}}
+	}
+	return wire.Capabilities{Tags: []string{"old"}}
+}
+
+type countedSphere struct{ evals *int64 }
+
+func (c countedSphere) Obj(x []float64) float64 {
+	atomic.AddInt64(c.evals, 1)
+	return sphere{}.Obj(x)
+}
+
+// recorder is Fastest, and remembers the tags of the first worker
+type recorder struct {
+	mu   sync.Mutex
+	tags [][]string
+}
+
+func (r *recorder) Schedule(x []float64, workers []WorkerInfo) int {
+	r.mu.Lock()
+	r.tags = append(r.tags, workers[0].Capabilities.Tags)
+	r.mu.Unlock()
+	return Fastest{}.Schedule(x, workers)
+}
+
+func TestCapabilitiesRefreshed(t *testing.T) {
+	var evals int64
+	r := &recorder{}
+	async := &Async{
+		MaxFunEvals: 10,
+		NumDim:      2,
+		Workers:     []Worker{retagged{LocalWorker: &LocalWorker{}, evals: &evals}},
+		Controller:  &counter{},
+		Scheduler:   r,
+	}
+	if _, err := async.Optimize(countedSphere{evals: &evals}); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.tags) < 2 || r.tags[0][0] != "old" || r.tags[len(r.tags)-1][0] != "new" {
+		t.Errorf("scheduler saw tags %v, want old and then new", r.tags)
+	}
+}
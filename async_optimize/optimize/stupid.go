@@ -10,6 +10,11 @@ import (
 type Ans struct {
 	Loc []float64
 	Obj float64
+
+	Objs []float64 // All of the objective values if the function is a MultiObjer
+	Cons []float64 // Constraint values if the function is a ConstrainedObjer
+
+	Err error // Non-nil if the evaluation failed
 }
 
 // Stupid is an optimizer which finds the objective of the function through iterative
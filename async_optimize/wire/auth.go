@@ -0,0 +1,132 @@
+package wire
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// The client sends the objective function, and the server runs whatever it
+// is sent, so servers on a shared network need to know who they are talking
+// to. There are two options, which can be used together. The connection can
+// use TLS, where certificates prove identity (in both directions if the
+// server requires client certificates). Or both ends can know a shared secret,
+// and prove it to each other without sending it:
+//
+//	client -> server  Auth{Nonce: cn}
+//	server -> client  Auth{Nonce: sn, MAC: HMAC(secret, "server", cn, sn)}
+//	client -> server  Auth{MAC: HMAC(secret, "client", sn, cn)}
+//
+// Each side checks the other's MAC using its own copy of the secret. The
+// random nonces make sure an old conversation can not be replayed. The
+// exchange happens before the Handshake, and until it is over only the fields
+// of a Message used by Auth are decoded. Anything else the peer sends, like an
+// objective function, is skipped by gob without being built.
+//
+// The secret only proves who is at the other end when the connection is made.
+// The messages are neither encrypted nor signed, so someone who can intercept
+// the connection can read them, or wait for the exchange to finish and then
+// change them. On a network that is not trusted, use TLS as well.
+
+// ErrAuth is returned when the peer does not know the shared secret
+var ErrAuth = errors.New("wire: authentication failed")
+
+const nonceSize = 32
+
+func newNonce() ([]byte, error) {
+	b := make([]byte, nonceSize)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+func mac(secret []byte, role string, a, b []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(role))
+	h.Write(a)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// authMessage holds the fields of a Message used by authentication. gob
+// matches fields by name, so decoding a Message into it skips the rest.
+type authMessage struct {
+	Kind  Kind
+	Err   string
+	Nonce []byte
+	MAC   []byte
+}
+
+// receiveAuth returns the next message that is not a heartbeat, decoding
+// only the fields used by authentication
+func receiveAuth(c *Conn) (authMessage, error) {
+	for {
+		var m authMessage
+		err := c.Receive(&m)
+		if err != nil {
+			return authMessage{}, err
+		}
+		if m.Kind != Heartbeat {
+			return m, nil
+		}
+	}
+}
+
+// ClientAuth proves to the server that the client knows the secret, and checks
+// that the server does too
+func ClientAuth(c *Conn, secret []byte) error {
+	cn, err := newNonce()
+	if err != nil {
+		return err
+	}
+	err = c.Send(Message{Kind: Auth, Nonce: cn})
+	if err != nil {
+		return err
+	}
+	m, err := receiveAuth(c)
+	if err != nil {
+		return err
+	}
+	if m.Kind == Error {
+		return &RemoteError{Msg: m.Err}
+	}
+	if m.Kind != Auth || len(m.Nonce) != nonceSize {
+		return fmt.Errorf("wire: expected auth, got %v", m.Kind)
+	}
+	if !hmac.Equal(m.MAC, mac(secret, "server", cn, m.Nonce)) {
+		return ErrAuth
+	}
+	return c.Send(Message{Kind: Auth, MAC: mac(secret, "client", m.Nonce, cn)})
+}
+
+// ServerAuth checks that the client knows the secret, and proves that the
+// server does too
+func ServerAuth(c *Conn, secret []byte) error {
+	m, err := receiveAuth(c)
+	if err != nil {
+		return err
+	}
+	if m.Kind != Auth || len(m.Nonce) != nonceSize {
+		c.Send(Message{Kind: Error, Err: "authentication required"})
+		return fmt.Errorf("wire: expected auth, got %v", m.Kind)
+	}
+	cn := m.Nonce
+	sn, err := newNonce()
+	if err != nil {
+		return err
+	}
+	err = c.Send(Message{Kind: Auth, Nonce: sn, MAC: mac(secret, "server", cn, sn)})
+	if err != nil {
+		return err
+	}
+	m, err = receiveAuth(c)
+	if err != nil {
+		return err
+	}
+	if m.Kind != Auth || !hmac.Equal(m.MAC, mac(secret, "client", sn, cn)) {
+		c.Send(Message{Kind: Error, Err: "authentication failed"})
+		return ErrAuth
+	}
+	return nil
+}
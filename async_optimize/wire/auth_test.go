@@ -0,0 +1,157 @@
+package wire
+
+import (
+	"encoding/gob"
+	"net"
+	"testing"
+	"time"
+)
+
+// trap records whether gob ever built one
+type trap struct{}
+
+var trapped bool
+
+func (trap) GobEncode() ([]byte, error) { return []byte{1}, nil }
+func (*trap) GobDecode([]byte) error {
+	trapped = true
+	return nil
+}
+
+func init() {
+	gob.Register(trap{})
+}
+
+// authPair runs ClientAuth and ServerAuth over a pipe with the two secrets
+func authPair(client, server []byte) (clientErr, serverErr error) {
+	a, b := net.Pipe()
+	c, s := NewConn(a, 0), NewConn(b, 0)
+	defer c.Close()
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() {
+		err := ServerAuth(s, server)
+		if err != nil {
+			// Let the client see the connection end
+			s.Close()
+		}
+		done <- err
+	}()
+	clientErr = ClientAuth(c, client)
+	if clientErr != nil {
+		c.Close()
+	}
+	return clientErr, <-done
+}
+
+func TestAuth(t *testing.T) {
+	if c, s := authPair([]byte("secret"), []byte("secret")); c != nil || s != nil {
+		t.Errorf("same secret: client %v, server %v", c, s)
+	}
+	// The server checks the client's MAC after proving itself, so a client
+	// with the wrong secret is caught first
+	if c, _ := authPair([]byte("wrong"), []byte("secret")); c != ErrAuth {
+		t.Errorf("client with the wrong secret got %v, want ErrAuth", c)
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	a, b := net.Pipe()
+	c, s := NewConn(a, 0), NewConn(b, 0)
+	defer c.Close()
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() { done <- ServerAuth(s, []byte("secret")) }()
+
+	// The client skips authentication and sends its objective function. It
+	// is refused without being decoded.
+	trapped = false
+	c.Send(Message{Kind: Heartbeat})
+	c.Send(Message{Kind: Handshake, Version: Version, Objective: trap{}})
+	m, err := c.ReceiveMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Kind != Error {
+		t.Errorf("server answered %v, want an error", m.Kind)
+	}
+	if err := <-done; err == nil {
+		t.Error("ServerAuth accepted a client without the secret")
+	}
+	if trapped {
+		t.Error("objective function decoded before authentication")
+	}
+}
+
+func TestTLS(t *testing.T) {
+	certPEM, keyPEM, err := GenerateCert("pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ServerTLS(certPEM, keyPEM, certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ClientTLS(certPEM, certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger, err := ClientTLS(certPEM, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pipe := &Pipe{}
+	l, err := Listen(pipe, "pipe", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c := NewConn(conn, 0)
+				defer c.Close()
+				// Answer until the client closes the connection
+				for {
+					m, err := c.ReceiveMessage()
+					if err != nil {
+						return
+					}
+					c.Send(Message{Kind: Result, ID: m.ID})
+				}
+			}()
+		}
+	}()
+
+	// A client with the certificate gets an answer
+	conn, err := Dial(pipe, "pipe", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewConn(conn, 0)
+	if err := c.Send(Message{Kind: Evaluate, ID: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := c.ReceiveMessage(); err != nil || m.ID != 3 {
+		t.Errorf("reply %+v, %v over TLS", m, err)
+	}
+	c.Close()
+
+	// One without is refused. The TLS 1.3 handshake finishes on the client
+	// before the server checks its certificate, so the refusal arrives on
+	// the first read.
+	conn, err = Dial(pipe, "pipe", stranger)
+	if err == nil {
+		c := NewConn(conn, time.Second)
+		_, err = c.ReceiveMessage()
+		c.Close()
+	}
+	if err == nil {
+		t.Error("client without a certificate was served")
+	}
+}
@@ -0,0 +1,80 @@
+package wire
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Remote machines can differ a lot, in speed and in what they have installed.
+// The server describes itself in its Handshake, and the optimizer can use the
+// description to decide which points to send where. A server which does not
+// send one (an older version, say) looks like one with zero Capabilities, so
+// every field is optional.
+
+// Capabilities describe the machine a server runs on
+type Capabilities struct {
+	Cores  int      // Number of CPUs
+	Memory uint64   // Bytes of memory, zero if unknown
+	Slots  int      // Number of evaluations the server runs at once
+	Tags   []string // Labels given to the server, for example "gpu" or "fast"
+
+	// Batches is set by servers which understand EvaluateBatch. Batches
+	// were added without changing Version, so that clients which send one
+	// point at a time can still use older servers, which do not set it.
+	Batches bool
+}
+
+// HasTags returns whether all of the tags are in c.Tags
+func (c Capabilities) HasTags(tags ...string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range c.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// LocalCapabilities describes the machine the program is running on, with
+// the given tags. Memory is only known on Linux. Slots is left at zero for
+// the caller to fill in.
+func LocalCapabilities(tags ...string) Capabilities {
+	return Capabilities{
+		Cores:  runtime.NumCPU(),
+		Memory: totalMemory(),
+		Tags:   tags,
+	}
+}
+
+// totalMemory reads the amount of memory from /proc/meminfo, which has a line
+// like "MemTotal:       16318412 kB". It returns zero if the file can not be
+// read.
+func totalMemory() uint64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0
+		}
+		return kb * 1024
+	}
+	return 0
+}
@@ -0,0 +1,182 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// The gob protocol can only be spoken by Go programs. For objective functions
+// written in other languages there is a simpler protocol using HTTP and JSON,
+// used by optimize.HTTPWorker and served by functions.HTTPHandler. Every
+// evaluation is a separate request:
+//
+//	POST <url>
+//	Content-Type: application/json
+//
+//	{"id": 7, "x": [0.5, -1.25]}
+//
+// The id is a number the server may ignore, and x is the location to
+// evaluate. The server answers with status 200 and a JSON object:
+//
+//	{"id": 7, "obj": 3.5}                    a single objective
+//	{"id": 7, "objs": [3.5, 2]}              several objectives (obj may be omitted)
+//	{"id": 7, "obj": 3.5, "cons": [-1, 0.2]} constraints, satisfied when <= 0
+//	{"id": 7, "error": "solver diverged"}    the objective failed at x
+//
+// JSON has no infinities, so numbers may also be given as the strings
+// "Infinity", "-Infinity" and "NaN". The optimizer writes x the same way, so a
+// controller which proposes such a point does not break the worker, but a
+// server which is not written in Go must be ready for elements of x which are
+// strings. The optimizer also reads the bare tokens Infinity, -Infinity and
+// NaN in a response, since that is what Python and JavaScript write (see
+// UnmarshalResponse). An error in the response means the point is bad, and
+// the optimizer treats it as infinitely bad. Any other status, or a body that
+// is not valid JSON, means the server is broken, and the point is given to
+// another worker.
+//
+// A server in Python can be as small as the following. Python's float reads
+// the strings, and json.dumps writes the bare tokens.
+//
+//	class Handler(http.server.BaseHTTPRequestHandler):
+//	    def do_POST(self):
+//	        req = json.loads(self.rfile.read(int(self.headers["Content-Length"])))
+//	        x = [float(v) for v in req["x"]]
+//	        body = json.dumps({"id": req["id"], "obj": simulate(x)}).encode()
+//	        self.send_response(200)
+//	        self.send_header("Content-Type", "application/json")
+//	        self.end_headers()
+//	        self.wfile.write(body)
+
+// EvalRequest is the body of an HTTP evaluation request
+type EvalRequest struct {
+	ID uint64  `json:"id"`
+	X  []Float `json:"x"`
+}
+
+// EvalResponse is the body of the reply to an EvalRequest
+type EvalResponse struct {
+	ID    uint64  `json:"id"`
+	Obj   *Float  `json:"obj,omitempty"`
+	Objs  []Float `json:"objs,omitempty"`
+	Cons  []Float `json:"cons,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+// UnmarshalResponse decodes a response to an EvalRequest. As well as the
+// strings read by Float, the bare tokens Infinity, -Infinity and NaN are
+// accepted where a number is expected. They are not valid JSON, so they are
+// turned into strings before decoding.
+func UnmarshalResponse(data []byte, r *EvalResponse) error {
+	return json.Unmarshal(quoteNonFinite(data), r)
+}
+
+// quoteNonFinite puts quotes around the tokens Infinity, -Infinity and NaN
+// wherever they appear outside of a string. No other token in valid JSON
+// starts with I, N or -I, so nothing else is changed.
+func quoteNonFinite(data []byte) []byte {
+	var out []byte
+	last := 0 // End of the data already copied to out
+	inString, escaped := false, false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		if c == '"' {
+			inString = true
+			continue
+		}
+		for _, tok := range []string{"Infinity", "-Infinity", "NaN"} {
+			if bytes.HasPrefix(data[i:], []byte(tok)) {
+				out = append(out, data[last:i]...)
+				out = append(out, '"')
+				out = append(out, tok...)
+				out = append(out, '"')
+				i += len(tok) - 1
+				last = i + 1
+				break
+			}
+		}
+	}
+	if out == nil {
+		return data
+	}
+	return append(out, data[last:]...)
+}
+
+// Float is a float64 which can hold infinities and NaN in JSON by writing them
+// as strings
+type Float float64
+
+// MarshalJSON writes finite values as numbers and others as strings
+func (f Float) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	switch {
+	case math.IsInf(v, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Infinity"`), nil
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	}
+	return []byte(strconv.FormatFloat(v, 'g', -1, 64)), nil
+}
+
+// UnmarshalJSON reads a number, or one of the strings written by MarshalJSON
+func (f *Float) UnmarshalJSON(b []byte) error {
+	var v float64
+	if err := json.Unmarshal(b, &v); err == nil {
+		*f = Float(v)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("wire: %s is not a number", b)
+	}
+	switch s {
+	case "Infinity", "+Infinity", "inf":
+		*f = Float(math.Inf(1))
+	case "-Infinity", "-inf":
+		*f = Float(math.Inf(-1))
+	case "NaN", "nan":
+		*f = Float(math.NaN())
+	default:
+		return fmt.Errorf("wire: %q is not a number", s)
+	}
+	return nil
+}
+
+// Floats converts a slice of Float to float64
+func Floats(fs []Float) []float64 {
+	if fs == nil {
+		return nil
+	}
+	v := make([]float64, len(fs))
+	for i, f := range fs {
+		v[i] = float64(f)
+	}
+	return v
+}
+
+// ToFloats converts a slice of float64 to Float
+func ToFloats(v []float64) []Float {
+	if v == nil {
+		return nil
+	}
+	fs := make([]Float, len(v))
+	for i, f := range v {
+		fs[i] = Float(f)
+	}
+	return fs
+}
@@ -0,0 +1,64 @@
+package wire
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestFloatJSON(t *testing.T) {
+	in := []float64{1.5, -2, 0, math.Inf(1), math.Inf(-1), math.NaN()}
+	b, err := json.Marshal(EvalRequest{ID: 3, X: ToFloats(in)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"id":3,"x":[1.5,-2,0,"Infinity","-Infinity","NaN"]}`
+	if string(b) != want {
+		t.Errorf("marshaled %s, want %s", b, want)
+	}
+	var req EvalRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		t.Fatal(err)
+	}
+	out := Floats(req.X)
+	for i, v := range in {
+		if out[i] != v && !(math.IsNaN(v) && math.IsNaN(out[i])) {
+			t.Errorf("element %d is %v after a round trip, want %v", i, out[i], v)
+		}
+	}
+
+	// Other spellings are understood too
+	var resp EvalResponse
+	if err := json.Unmarshal([]byte(`{"obj":"inf","cons":["-inf","nan",2]}`), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsInf(float64(*resp.Obj), 1) || !math.IsInf(float64(resp.Cons[0]), -1) || !math.IsNaN(float64(resp.Cons[1])) {
+		t.Errorf("decoded %v %v", *resp.Obj, resp.Cons)
+	}
+	if err := json.Unmarshal([]byte(`{"obj":"big"}`), &resp); err == nil {
+		t.Error("decoded a string which is not a number")
+	}
+}
+
+func TestUnmarshalResponse(t *testing.T) {
+	// Python's json.dumps writes bare tokens for values which are not finite
+	var resp EvalResponse
+	err := UnmarshalResponse([]byte(`{"id": 2, "objs": [Infinity, -Infinity, NaN, 1], "cons": ["NaN"]}`), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objs := Floats(resp.Objs)
+	if resp.ID != 2 || !math.IsInf(objs[0], 1) || !math.IsInf(objs[1], -1) || !math.IsNaN(objs[2]) || objs[3] != 1 || !math.IsNaN(float64(resp.Cons[0])) {
+		t.Errorf("decoded %+v", resp)
+	}
+
+	// Strings are left alone
+	resp = EvalResponse{}
+	err = UnmarshalResponse([]byte(`{"error": "got NaN at \"Infinity\" -Infinity"}`), &resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != `got NaN at "Infinity" -Infinity` {
+		t.Errorf("error %q changed", resp.Error)
+	}
+}
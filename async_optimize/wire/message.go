@@ -0,0 +1,224 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Version is the version of the protocol. It is increased whenever a change
+// would confuse a peer using an older version.
+const Version = 1
+
+// Kind is the type of a Message
+type Kind int
+
+const (
+	Handshake     Kind = iota + 1 // Start of the connection (Version, Objective or Name and Params; Capabilities from the server)
+	Evaluate                      // Evaluate a location (ID, X)
+	Result                        // Result of an evaluation (ID, Obj, Objs, Cons)
+	Error                         // A request failed (ID, Err). ID is zero if the connection failed.
+	Cancel                        // Stop working on a request (ID). No answer is sent for it.
+	Heartbeat                     // The sender is still alive
+	Shutdown                      // The sender is about to close the connection
+	Auth                          // Shared secret authentication (Nonce, MAC)
+	EvaluateBatch                 // Evaluate several locations (Batch of Evaluate messages). Only sent if the server sets Capabilities.Batches.
+	ResultBatch                   // Answers to an EvaluateBatch (Batch of Result and Error messages)
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Handshake:
+		return "handshake"
+	case Evaluate:
+		return "evaluate"
+	case Result:
+		return "result"
+	case Error:
+		return "error"
+	case Cancel:
+		return "cancel"
+	case Heartbeat:
+		return "heartbeat"
+	case Shutdown:
+		return "shutdown"
+	case Auth:
+		return "auth"
+	case EvaluateBatch:
+		return "evaluate batch"
+	case ResultBatch:
+		return "result batch"
+	}
+	return fmt.Sprintf("kind(%d)", int(k))
+}
+
+// Message is the envelope for everything sent over a connection. Only the
+// fields listed for the Kind are used, and gob does not send fields with zero
+// values, so the unused fields cost nothing.
+type Message struct {
+	Kind    Kind
+	Version int
+	ID      uint64
+
+	// Objective is the objective function. The concrete type must be
+	// registered with gob.Register on both ends.
+	Objective interface{}
+
+	// Name and Params ask for an objective function registered on the
+	// server instead of sending one (see Named)
+	Name   string
+	Params map[string]string
+
+	// Capabilities describe the server, in its handshake
+	Capabilities Capabilities
+
+	X    []float64
+	Obj  float64
+	Objs []float64 // Set if the objective has multiple objectives
+	Cons []float64 // Set if the objective has constraints
+	Err  string
+
+	Nonce []byte
+	MAC   []byte
+
+	// Batch holds the messages of an EvaluateBatch or ResultBatch. Sending
+	// several points in one message saves a round trip for each, which
+	// matters when the objective function is cheap.
+	Batch []Message
+}
+
+// ErrShutdown is returned when the peer sent a Shutdown message
+var ErrShutdown = errors.New("wire: peer shut down")
+
+// VersionError is returned when the peer speaks a different version of the
+// protocol
+type VersionError struct {
+	Local, Remote int
+}
+
+func (v *VersionError) Error() string {
+	return fmt.Sprintf("wire: peer speaks protocol version %d, want %d", v.Remote, v.Local)
+}
+
+// RemoteError is an error reported by the peer in an Error message
+type RemoteError struct {
+	Msg string
+}
+
+func (r *RemoteError) Error() string {
+	return "remote: " + r.Msg
+}
+
+// Named refers to an objective function registered by name on the server,
+// configured by Params. It has an Obj method so that it can be passed to
+// anything which takes an objective function, but it can only be evaluated
+// remotely.
+type Named struct {
+	Name   string
+	Params map[string]string
+}
+
+// Obj panics, since the function only exists on the server
+func (n Named) Obj(x []float64) float64 {
+	panic("wire: objective " + n.Name + " can only be evaluated remotely")
+}
+
+// ClientHandshake sends the objective function and waits for the server to
+// accept it. If the objective is a Named, only the name and parameters are
+// sent. The server's description of itself is returned.
+func ClientHandshake(c *Conn, objective interface{}) (Capabilities, error) {
+	hello := Message{Kind: Handshake, Version: Version, Objective: objective}
+	if n, ok := objective.(Named); ok {
+		hello = Message{Kind: Handshake, Version: Version, Name: n.Name, Params: n.Params}
+	}
+	err := c.Send(hello)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	m, err := c.ReceiveMessage()
+	if err != nil {
+		return Capabilities{}, err
+	}
+	switch m.Kind {
+	case Handshake:
+		if m.Version != Version {
+			return Capabilities{}, &VersionError{Local: Version, Remote: m.Version}
+		}
+		return m.Capabilities, nil
+	case Error:
+		return Capabilities{}, &RemoteError{Msg: m.Err}
+	}
+	return Capabilities{}, fmt.Errorf("wire: expected handshake, got %v", m.Kind)
+}
+
+// ServerHandshake reads the client's handshake and passes it to resolve,
+// which returns the objective function to use. If resolve is nil, the
+// objective function sent by the client is used. If the client speaks a
+// different version or resolve fails, the client is told why before the error
+// is returned. Otherwise the client is sent caps.
+func ServerHandshake(c *Conn, resolve func(Message) (interface{}, error), caps Capabilities) (interface{}, error) {
+	m, err := c.ReceiveMessage()
+	if err != nil {
+		return nil, err
+	}
+	return serverHandshake(c, m, resolve, caps)
+}
+
+// namedHello holds the fields of a handshake which ask for an objective
+// function by name. gob matches fields by name, so decoding a Message into it
+// skips the rest.
+type namedHello struct {
+	Kind    Kind
+	Version int
+	Name    string
+	Params  map[string]string
+}
+
+// ServerNamedHandshake is ServerHandshake for a server which only runs
+// objective functions it knows by name. The Objective field of the handshake
+// is not decoded, so an objective function sent by the client is never built,
+// and resolve sees a message without one.
+func ServerNamedHandshake(c *Conn, resolve func(Message) (interface{}, error), caps Capabilities) (interface{}, error) {
+	var h namedHello
+	for {
+		err := c.Receive(&h)
+		if err != nil {
+			return nil, err
+		}
+		if h.Kind != Heartbeat {
+			break
+		}
+	}
+	m := Message{Kind: h.Kind, Version: h.Version, Name: h.Name, Params: h.Params}
+	return serverHandshake(c, m, resolve, caps)
+}
+
+// serverHandshake answers the client's handshake m
+func serverHandshake(c *Conn, m Message, resolve func(Message) (interface{}, error), caps Capabilities) (interface{}, error) {
+	if m.Kind != Handshake {
+		err := fmt.Errorf("wire: expected handshake, got %v", m.Kind)
+		c.Send(Message{Kind: Error, Err: err.Error()})
+		return nil, err
+	}
+	if m.Version != Version {
+		err := &VersionError{Local: Version, Remote: m.Version}
+		c.Send(Message{Kind: Error, Err: fmt.Sprintf("server speaks protocol version %d, not %d", Version, m.Version)})
+		return nil, err
+	}
+	if resolve == nil {
+		resolve = sentObjective
+	}
+	objective, err := resolve(m)
+	if err != nil {
+		c.Send(Message{Kind: Error, Err: err.Error()})
+		return nil, err
+	}
+	return objective, c.Send(Message{Kind: Handshake, Version: Version, Capabilities: caps})
+}
+
+// sentObjective returns the objective function sent in the handshake
+func sentObjective(m Message) (interface{}, error) {
+	if m.Objective == nil {
+		return nil, errors.New("wire: no objective function in handshake")
+	}
+	return m.Objective, nil
+}
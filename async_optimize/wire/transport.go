@@ -0,0 +1,159 @@
+package wire
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+)
+
+// The protocol only needs a reliable stream of bytes in each direction, so it
+// does not have to run over TCP. A Transport makes the connections. TCP is
+// the default, Unix uses Unix domain sockets, which are faster and can be
+// protected with file permissions when both ends are on the same machine, and
+// Pipe connects the two ends inside a single program without opening any
+// ports, which makes the remote code paths easy to test.
+
+// Transport dials and listens on addresses of a particular kind
+type Transport interface {
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+// TCP is the transport for TCP addresses like "localhost:2000"
+type TCP struct{}
+
+func (TCP) Dial(addr string) (net.Conn, error)       { return net.Dial("tcp", addr) }
+func (TCP) Listen(addr string) (net.Listener, error) { return net.Listen("tcp", addr) }
+
+// Unix is the transport for Unix domain sockets, where the address is the
+// path of the socket file
+type Unix struct{}
+
+func (Unix) Dial(addr string) (net.Conn, error)       { return net.Dial("unix", addr) }
+func (Unix) Listen(addr string) (net.Listener, error) { return net.Listen("unix", addr) }
+
+// Dial connects to the address using the transport, or TCP if t is nil. If
+// config is not nil, TLS is used on top of the connection. If config does not
+// set ServerName, the host of the address is used.
+func Dial(t Transport, addr string, config *tls.Config) (net.Conn, error) {
+	if t == nil {
+		t = TCP{}
+	}
+	conn, err := t.Dial(addr)
+	if err != nil || config == nil {
+		return conn, err
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config.ServerName = host
+	}
+	tc := tls.Client(conn, config)
+	err = tc.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// Listen listens on the address using the transport, or TCP if t is nil. If
+// config is not nil, the connections use TLS.
+func Listen(t Transport, addr string, config *tls.Config) (net.Listener, error) {
+	if t == nil {
+		t = TCP{}
+	}
+	l, err := t.Listen(addr)
+	if err != nil || config == nil {
+		return l, err
+	}
+	return tls.NewListener(l, config), nil
+}
+
+// Pipe is an in-memory transport. Addresses are just names, and each
+// connection is a net.Pipe between the dialer and the listener. Both ends must
+// use the same Pipe. The zero value is ready to use.
+type Pipe struct {
+	mu        sync.Mutex
+	listeners map[string]*pipeListener
+}
+
+// Dial connects to the listener with the name
+func (p *Pipe) Dial(addr string) (net.Conn, error) {
+	p.mu.Lock()
+	l, ok := p.listeners[addr]
+	p.mu.Unlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: pipeAddr(addr), Err: errors.New("connection refused")}
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: pipeAddr(addr), Err: errors.New("connection refused")}
+	}
+}
+
+// Listen creates a listener with the name
+func (p *Pipe) Listen(addr string) (net.Listener, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.listeners == nil {
+		p.listeners = make(map[string]*pipeListener)
+	}
+	if _, ok := p.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "pipe", Addr: pipeAddr(addr), Err: errors.New("address already in use")}
+	}
+	l := &pipeListener{
+		pipe:   p,
+		addr:   pipeAddr(addr),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	p.listeners[addr] = l
+	return l, nil
+}
+
+type pipeListener struct {
+	pipe   *Pipe
+	addr   pipeAddr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: l.addr, Err: errors.New("use of closed listener")}
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.pipe.mu.Lock()
+		delete(l.pipe.listeners, string(l.addr))
+		l.pipe.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+// pipeAddr is the net.Addr of a Pipe listener
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
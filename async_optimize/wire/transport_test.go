@@ -0,0 +1,92 @@
+package wire
+
+import (
+	"io"
+	"testing"
+)
+
+func TestPipe(t *testing.T) {
+	pipe := &Pipe{}
+	if _, err := pipe.Dial("server"); err == nil {
+		t.Error("dialed a name nobody is listening on")
+	}
+	l, err := pipe.Listen("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pipe.Listen("server"); err == nil {
+		t.Error("listened twice on the same name")
+	}
+	if l.Addr().String() != "server" || l.Addr().Network() != "pipe" {
+		t.Errorf("address %v", l.Addr())
+	}
+
+	// Messages go both ways
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c := NewConn(conn, 0)
+		defer c.Close()
+		for {
+			m, err := c.ReceiveMessage()
+			if err != nil {
+				return
+			}
+			c.Send(Message{Kind: Result, ID: m.ID, Obj: m.X[0] * 2})
+		}
+	}()
+	conn, err := Dial(pipe, "server", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewConn(conn, 0)
+	for i := 1; i <= 3; i++ {
+		if err := c.Send(Message{Kind: Evaluate, ID: uint64(i), X: []float64{float64(i)}}); err != nil {
+			t.Fatal(err)
+		}
+		m, err := c.ReceiveMessage()
+		if err != nil || m.ID != uint64(i) || m.Obj != float64(2*i) {
+			t.Errorf("reply %+v, %v to request %d", m, err, i)
+		}
+	}
+	c.Close()
+
+	// Once the listener is closed, the name is free again
+	l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Error("accepted on a closed listener")
+	}
+	if _, err := pipe.Dial("server"); err == nil {
+		t.Error("dialed a closed listener")
+	}
+	l, err = pipe.Listen("server")
+	if err != nil {
+		t.Fatalf("can't listen again after closing: %v", err)
+	}
+	l.Close()
+}
+
+func TestPipeClose(t *testing.T) {
+	pipe := &Pipe{}
+	l, err := Listen(pipe, "server", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := pipe.Dial("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The other end closing is seen as the end of the stream
+	var m Message
+	if err := NewConn(conn, 0).Receive(&m); err != io.EOF {
+		t.Errorf("error %v after the other end closed, want EOF", err)
+	}
+}
@@ -0,0 +1,156 @@
+// Package wire contains the messages and connection handling shared by the two
+// ends of a remote evaluation, optimize.RemoteWorker and functions.Remote on
+// the client side, and functions.RemoteReceiver on the server side.
+//
+// Every value sent over the connection is a gob-encoded Message. The client
+// starts with a Handshake carrying the protocol version and the objective
+// function, and the server answers with a Handshake of its own describing the
+// machine it runs on (see Capabilities), or an Error if it cannot accept.
+// After that the client sends Evaluate requests, each with its own ID, and
+// the server answers each with a Result or an Error carrying the same ID.
+// Several requests can also be sent together in an EvaluateBatch, which is
+// answered with a ResultBatch, but only to a server which sets
+// Capabilities.Batches. Either side can send a Heartbeat at any time,
+// and a Shutdown before closing the connection.
+//
+// If both ends are configured with a shared secret, an exchange of Auth
+// messages comes before the Handshake (see ClientAuth). Connections can also
+// use TLS, see Dial, Listen and GenerateCert, and need not use TCP, see
+// Transport.
+package wire
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Default liveness settings
+const (
+	DefaultHeartbeat = time.Second      // How often heartbeats are sent
+	DefaultTimeout   = 10 * time.Second // How long to wait for any message before giving up
+)
+
+// Conn wraps a network connection with gob streams. Sends are safe to call
+// concurrently, so that heartbeats can be sent while a result is being
+// computed.
+type Conn struct {
+	conn net.Conn
+	enc  *gob.Encoder
+	dec  *gob.Decoder
+
+	mu      sync.Mutex // Protects enc
+	timeout time.Duration
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// NewConn wraps the connection. If timeout is positive, Receive fails if
+// nothing at all arrives from the other end within the timeout.
+func NewConn(conn net.Conn, timeout time.Duration) *Conn {
+	return &Conn{
+		conn:    conn,
+		enc:     gob.NewEncoder(conn),
+		dec:     gob.NewDecoder(conn),
+		timeout: timeout,
+		stop:    make(chan struct{}),
+	}
+}
+
+// Send gob-encodes the value onto the connection
+func (c *Conn) Send(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enc.Encode(v)
+}
+
+// Receive decodes the next value from the connection
+func (c *Conn) Receive(v interface{}) error {
+	if c.timeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	err := c.dec.Decode(v)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return &DeadError{Timeout: c.timeout}
+	}
+	return err
+}
+
+// ReceiveMessage returns the next message that is not a heartbeat. Every
+// heartbeat resets the timeout, so a peer that is busy but alive is never
+// declared dead.
+func (c *Conn) ReceiveMessage() (Message, error) {
+	for {
+		var m Message
+		err := c.Receive(&m)
+		if err != nil {
+			return Message{}, err
+		}
+		if m.Kind != Heartbeat {
+			return m, nil
+		}
+	}
+}
+
+// Heartbeat sends a heartbeat every interval until the connection is closed
+func (c *Conn) Heartbeat(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if c.Send(Message{Kind: Heartbeat}) != nil {
+					return
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// RemoteAddr returns the address of the other end
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close stops the heartbeats and closes the connection
+func (c *Conn) Close() error {
+	c.once.Do(func() { close(c.stop) })
+	return c.conn.Close()
+}
+
+// DeadError is returned by Receive when the other end has not sent anything,
+// not even a heartbeat, within the timeout
+type DeadError struct {
+	Timeout time.Duration
+}
+
+func (d *DeadError) Error() string {
+	return fmt.Sprintf("wire: no message from peer in %v", d.Timeout)
+}
+
+// Liveness returns the heartbeat interval and timeout to use given the
+// configured values. Zero values are replaced by the defaults, and a negative
+// value disables the feature (the returned value is zero).
+func Liveness(heartbeat, timeout time.Duration) (time.Duration, time.Duration) {
+	if heartbeat == 0 {
+		heartbeat = DefaultHeartbeat
+	}
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	if heartbeat < 0 {
+		heartbeat = 0
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	return heartbeat, timeout
+}
@@ -0,0 +1,64 @@
+package wire
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLiveness(t *testing.T) {
+	for _, test := range []struct {
+		heartbeat, timeout time.Duration
+		wantH, wantT       time.Duration
+	}{
+		{0, 0, DefaultHeartbeat, DefaultTimeout},
+		{time.Millisecond, time.Second, time.Millisecond, time.Second},
+		{-1, -1, 0, 0},
+		{-1, 0, 0, DefaultTimeout},
+	} {
+		h, to := Liveness(test.heartbeat, test.timeout)
+		if h != test.wantH || to != test.wantT {
+			t.Errorf("Liveness(%v, %v) = %v, %v, want %v, %v", test.heartbeat, test.timeout, h, to, test.wantH, test.wantT)
+		}
+	}
+}
+
+func TestDeadPeer(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	c := NewConn(b, 20*time.Millisecond)
+	defer c.Close()
+	_, err := c.ReceiveMessage()
+	if _, ok := err.(*DeadError); !ok {
+		t.Errorf("error %v from a silent peer, want a DeadError", err)
+	}
+}
+
+func TestHeartbeatKeepsAlive(t *testing.T) {
+	a, b := net.Pipe()
+	sender := NewConn(a, 0)
+	defer sender.Close()
+	receiver := NewConn(b, 50*time.Millisecond)
+	defer receiver.Close()
+
+	// The answer takes several timeouts, but the heartbeats say the sender
+	// is still there
+	sender.Heartbeat(5 * time.Millisecond)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		sender.Send(Message{Kind: Result, ID: 7, Obj: 3})
+	}()
+	m, err := receiver.ReceiveMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Kind != Result || m.ID != 7 || m.Obj != 3 {
+		t.Errorf("received %+v, want the result", m)
+	}
+
+	// Closing stops the heartbeats, so the receiver gives up
+	sender.Close()
+	if _, err := receiver.ReceiveMessage(); err == nil {
+		t.Error("no error after the sender closed")
+	}
+}